@@ -10,7 +10,9 @@ import (
 	"os"
 
 	"github.com/gideonw/peltr/cmd/peltr/server"
+	"github.com/gideonw/peltr/cmd/peltr/stop"
 	"github.com/gideonw/peltr/cmd/peltr/test"
+	"github.com/gideonw/peltr/cmd/peltr/token"
 	"github.com/gideonw/peltr/cmd/peltr/worker"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -46,6 +48,8 @@ func init() {
 	rootCmd.AddCommand(server.Command)
 	rootCmd.AddCommand(worker.Command)
 	rootCmd.AddCommand(test.Command)
+	rootCmd.AddCommand(token.Command)
+	rootCmd.AddCommand(stop.Command)
 }
 
 func Execute() {
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/spf13/viper"
+)
+
+// apiAuth builds the API authenticators from the flags, client certificates
+// first, then signed and static tokens. No authenticator leaves the API
+// open. The TLS config is set if the API is served over HTTPS.
+func apiAuth() (auth.Authenticator, *tls.Config, error) {
+	chain := auth.Chain{}
+	var tlsConfig *tls.Config
+
+	cert, key := viper.GetString("peltr.server.api-cert"), viper.GetString("peltr.server.api-key")
+	clientCA := viper.GetString("peltr.server.api-client-ca")
+	if (cert == "") != (key == "") {
+		return nil, nil, errors.New("api-cert and api-key are set together")
+	}
+	if cert != "" {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if clientCA != "" {
+		if tlsConfig == nil {
+			return nil, nil, errors.New("api-client-ca needs the API served over HTTPS, set api-cert and api-key")
+		}
+		pool, err := auth.LoadCertPool(clientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		// callers without a certificate can still use a token
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		chain = append(chain, auth.ClientCerts{})
+	}
+
+	if path := viper.GetString("peltr.server.auth-hmac-secret-file"); path != "" {
+		secret, err := auth.ReadSecretFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, auth.HMACTokens{Secret: secret})
+	}
+	if path := viper.GetString("peltr.server.auth-token-file"); path != "" {
+		tokens, err := auth.LoadTokenFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		chain = append(chain, tokens)
+	}
+
+	if len(chain) == 0 {
+		return nil, tlsConfig, nil
+	}
+	return chain, tlsConfig, nil
+}
+
+// leaderTLS builds the TLS config followers proxy the API to the leader
+// with, nil if the API is served over plain HTTP. The leader's certificate
+// must be issued by --leader-ca, or a system root, for its advertised host.
+func leaderTLS(https bool) (*tls.Config, error) {
+	leaderCA := viper.GetString("peltr.server.leader-ca")
+	if !https {
+		if leaderCA != "" {
+			return nil, errors.New("leader-ca needs the API served over HTTPS, set api-cert and api-key")
+		}
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if leaderCA != "" {
+		pool, err := auth.LoadCertPool(leaderCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// controlTLS builds the TLS config of the control port from the flags, nil
+// if workers connect over plain TCP. With a client CA workers must present
+// a certificate issued by it.
+func controlTLS() (*tls.Config, *auth.KeyPair, error) {
+	cert, key := viper.GetString("peltr.server.control-cert"), viper.GetString("peltr.server.control-key")
+	clientCA := viper.GetString("peltr.server.control-client-ca")
+	if (cert == "") != (key == "") {
+		return nil, nil, errors.New("control-cert and control-key are set together")
+	}
+	if cert == "" {
+		if clientCA != "" {
+			return nil, nil, errors.New("control-client-ca needs the control port served over TLS, set control-cert and control-key")
+		}
+		return nil, nil, nil
+	}
+
+	kp, err := auth.LoadKeyPair(cert, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: kp.GetCertificate}
+	if clientCA != "" {
+		pool, err := auth.LoadCertPool(clientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, kp, nil
+}
@@ -8,9 +8,19 @@ package server
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/gideonw/peltr/pkg/proto"
 	"github.com/gideonw/peltr/pkg/server"
+	"github.com/gideonw/peltr/pkg/store"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
@@ -25,33 +35,234 @@ var Command = &cobra.Command{
 		log := viper.Get("logger").(zerolog.Logger)
 
 		m := server.NewMetricsStore()
-		runtime := server.NewRuntime(m, log, viper.GetInt("peltr.port"))
+		weights := map[string]int{}
+		for owner, weight := range viper.GetStringMapString("peltr.server.owner-weights") {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w < 1 {
+				log.Fatal().Str("owner", owner).Str("weight", weight).Msg("owner weight must be a positive integer")
+				return
+			}
+			weights[owner] = w
+		}
+
+		quotas, err := namespaceQuotas()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error reading namespace quotas")
+			return
+		}
+
+		targets := proto.TargetPolicy{
+			Allow: viper.GetStringSlice("peltr.server.allow-targets"),
+			Deny:  viper.GetStringSlice("peltr.server.deny-targets"),
+		}
+		if err := targets.Validate(); err != nil {
+			log.Fatal().Err(err).Msg("Error reading the target policy")
+			return
+		}
+		hostRates := map[string]int{}
+		for host, rate := range viper.GetStringMapString("peltr.server.host-rates") {
+			r, err := strconv.Atoi(rate)
+			if err != nil || r < 1 {
+				log.Fatal().Str("host", host).Str("rate", rate).Msg("host rate must be a positive integer")
+				return
+			}
+			hostRates[strings.ToLower(host)] = r
+		}
+
+		advertise := viper.GetString("peltr.server.advertise")
+		if advertise == "" {
+			advertise, _ = os.Hostname()
+		}
+		config := server.Config{
+			Port:         viper.GetInt("peltr.port"),
+			OwnerWeights: weights,
+			Quotas:       quotas,
+			Targets:      targets,
+			MaxHostRate:  viper.GetInt("peltr.server.max-host-rate"),
+			HostRates:    hostRates,
+			Preemption:   viper.GetBool("peltr.server.preemption"),
+			API:          net.JoinHostPort(advertise, strconv.Itoa(viper.GetInt("peltr.prom-http"))),
+			Control:      net.JoinHostPort(advertise, strconv.Itoa(viper.GetInt("peltr.port"))),
+		}
+		config.ID = config.Control
+		if dir := viper.GetString("peltr.server.data-dir"); dir != "" {
+			err := os.MkdirAll(dir, 0o755)
+			if err != nil {
+				log.Fatal().Err(err).Str("dir", dir).Msg("Error creating the data dir")
+				return
+			}
+			s, err := store.Open(filepath.Join(dir, "peltr.db"))
+			if err != nil {
+				log.Fatal().Err(err).Str("dir", dir).Msg("Error opening the store")
+				return
+			}
+			defer s.Close()
+			config.Store = s
+		}
+
+		authn, tlsConfig, err := apiAuth()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error configuring API authentication")
+			return
+		}
+		config.Auth = authn
+		config.LeaderTLS, err = leaderTLS(tlsConfig != nil)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error configuring TLS to the leader")
+			return
+		}
 
-		err := runtime.Listen()
+		if path := viper.GetString("peltr.server.worker-credentials-file"); path != "" {
+			keyring, err := auth.LoadKeyring(path)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error reading worker credentials")
+				return
+			}
+			config.WorkerAuth = &server.WorkerAuth{Keyring: keyring, AllowToken: viper.GetBool("peltr.server.worker-allow-token")}
+			log.Info().Int("credentials", keyring.Len()).Msg("workers must enroll")
+		}
+
+		config.ControlTLS, config.ControlCert, err = controlTLS()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error configuring TLS on the control port")
+			return
+		}
+		if config.ControlCert != nil {
+			log.Info().
+				Str("pin", auth.CertificatePin(config.ControlCert.Leaf())).
+				Bool("clientCerts", config.ControlTLS.ClientCAs != nil).
+				Msg("workers connect over TLS")
+		}
+
+		runtime := server.NewRuntime(m, log, config)
+		err = runtime.Listen()
 		if err != nil {
 			log.Fatal().Err(err).Msg("Error listening on server port")
 			return
 		}
 		defer runtime.Close()
 
+		// give up the lease on shutdown so a follower takes over at once
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+			<-sig
+			runtime.Close()
+			os.Exit(0)
+		}()
+
+		go runtime.ElectionLoop()
 		go runtime.HandleConnections()
 		go runtime.ControlLoop()
+		go runtime.CredentialsLoop()
 
-		http.HandleFunc("/workers", runtime.HandleListWorkers)
-		http.HandleFunc("/jobs", runtime.HandleListJobQueue)
-		http.HandleFunc("/job", runtime.HandleJob)
-		http.Handle("/metrics", promhttp.Handler())
-		http.ListenAndServe(fmt.Sprintf(":%d", viper.GetInt("peltr.prom-http")), nil)
+		// followers proxy the API to the leader, callers are authenticated
+		// by the server that serves them
+		api := runtime.APIHandler()
+		secure := func(h http.HandlerFunc) http.HandlerFunc {
+			return runtime.Lead(runtime.Authenticate(runtime.Authorize(h)))
+		}
+		http.HandleFunc(server.API_PREFIX+"/", runtime.Lead(api.ServeHTTP))
+		http.Handle(server.API_PREFIX+"/leader", api)
+		http.HandleFunc("/workers", secure(runtime.HandleListWorkers))
+		http.HandleFunc("/jobs", secure(runtime.HandleListJobQueue))
+		http.HandleFunc("/job", secure(runtime.HandleJob))
+		http.HandleFunc("/job/", secure(runtime.HandleJob))
+		http.HandleFunc("/schedules", secure(runtime.HandleListSchedules))
+		http.HandleFunc("/schedule", secure(runtime.HandleSchedule))
+		http.HandleFunc("/schedule/", secure(runtime.HandleSchedule))
+		http.HandleFunc("/suites", secure(runtime.HandleListSuites))
+		http.HandleFunc("/suite", secure(runtime.HandleSuite))
+		http.HandleFunc("/suite/", secure(runtime.HandleSuite))
+		http.HandleFunc("/leader", runtime.Authenticate(runtime.Authorize(runtime.HandleLeader)))
+		http.HandleFunc("/metrics", runtime.Authenticate(runtime.Authorize(promhttp.Handler().ServeHTTP)))
+		http.Handle(server.DASHBOARD_PREFIX, server.DashboardHandler())
+		http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/" {
+				http.NotFound(rw, req)
+				return
+			}
+			http.Redirect(rw, req, server.DASHBOARD_PREFIX, http.StatusFound)
+		})
+		addr := fmt.Sprintf(":%d", viper.GetInt("peltr.prom-http"))
+		if tlsConfig != nil {
+			srv := &http.Server{Addr: addr, TLSConfig: tlsConfig}
+			err = srv.ListenAndServeTLS(viper.GetString("peltr.server.api-cert"), viper.GetString("peltr.server.api-key"))
+		} else {
+			err = http.ListenAndServe(addr, nil)
+		}
+		log.Fatal().Err(err).Msg("Error serving the API")
 
 	},
 }
 
+// namespaceQuotas reads the quotas of the [peltr.server.namespaces.{name}]
+// tables of the config, "*" is the quota of namespaces not listed
+func namespaceQuotas() (map[string]server.Quota, error) {
+	var tables map[string]struct {
+		MaxJobs       int `mapstructure:"max-jobs"`
+		MaxRate       int `mapstructure:"max-rate"`
+		MaxWorkers    int `mapstructure:"max-workers"`
+		DailyRequests int `mapstructure:"daily-requests"`
+	}
+	if err := viper.UnmarshalKey("peltr.server.namespaces", &tables); err != nil {
+		return nil, err
+	}
+	quotas := make(map[string]server.Quota, len(tables))
+	for ns, t := range tables {
+		q := server.Quota{MaxJobs: t.MaxJobs, MaxRate: t.MaxRate, MaxWorkers: t.MaxWorkers, DailyRequests: t.DailyRequests}
+		if q.MaxJobs < 0 || q.MaxRate < 0 || q.MaxWorkers < 0 || q.DailyRequests < 0 {
+			return nil, fmt.Errorf("quota of namespace %s must not be negative", ns)
+		}
+		quotas[ns] = q
+	}
+	return quotas, nil
+}
+
 func init() {
 	// Flags for this command
 	Command.Flags().IntP("port", "p", 8000, "Database server port for client connections (-p8000)")
 	Command.Flags().Int("prom-http", 8010, "Set the port for /metrics is bound to (-m8010)")
+	Command.Flags().StringToString("owner-weight", map[string]string{}, "Share of the job queue per owner (--owner-weight team=2), default 1")
+	Command.Flags().StringSlice("allow-target", []string{}, "Hosts, *.domain patterns or CIDRs jobs may send to, any target not denied if not set")
+	Command.Flags().StringSlice("deny-target", []string{}, "Hosts, *.domain patterns or CIDRs jobs may never send to")
+	Command.Flags().Int("max-host-rate", 0, "Total req/s the running jobs may send a host, 0 is unlimited")
+	Command.Flags().StringToString("host-rate", map[string]string{}, "Total req/s of a host or *.domain pattern (--host-rate api.example.com=500), default --max-host-rate")
+	Command.Flags().Bool("preemption", true, "Stop lower priority jobs to run a job no worker has capacity for")
+	Command.Flags().String("data-dir", "", "Directory to keep jobs in across restarts, jobs are only kept in memory if not set")
+	Command.Flags().String("advertise", "", "Host other servers reach this one on when it leads, default the hostname")
+	Command.Flags().String("auth-token-file", "", "CSV file of token,name,role API bearer tokens, roles are viewer, submitter and admin")
+	Command.Flags().String("auth-hmac-secret-file", "", "File of the secret API tokens made with peltr token are signed with")
+	Command.Flags().String("worker-credentials-file", "", "CSV file of name,secret keys workers enroll with, any worker is taken if not set")
+	Command.Flags().Bool("worker-allow-token", false, "Take workers that send their key's secret instead of answering the challenge")
+	Command.Flags().String("api-cert", "", "Certificate to serve the API over HTTPS with")
+	Command.Flags().String("api-key", "", "Key of the API certificate")
+	Command.Flags().String("api-client-ca", "", "CA of the client certificates API callers can authenticate with")
+	Command.Flags().String("leader-ca", "", "CA that issued the other servers' API certificates, default the system roots")
+	Command.Flags().String("control-cert", "", "Certificate to serve the worker port over TLS with, read again when it changes")
+	Command.Flags().String("control-key", "", "Key of the control certificate")
+	Command.Flags().String("control-client-ca", "", "CA that must have issued the certificates workers present")
 
 	// Bind flags to viper
 	viper.BindPFlag("peltr.port", Command.Flags().Lookup("port"))
 	viper.BindPFlag("peltr.prom-http", Command.Flags().Lookup("prom-http"))
+	viper.BindPFlag("peltr.server.owner-weights", Command.Flags().Lookup("owner-weight"))
+	viper.BindPFlag("peltr.server.allow-targets", Command.Flags().Lookup("allow-target"))
+	viper.BindPFlag("peltr.server.deny-targets", Command.Flags().Lookup("deny-target"))
+	viper.BindPFlag("peltr.server.max-host-rate", Command.Flags().Lookup("max-host-rate"))
+	viper.BindPFlag("peltr.server.host-rates", Command.Flags().Lookup("host-rate"))
+	viper.BindPFlag("peltr.server.preemption", Command.Flags().Lookup("preemption"))
+	viper.BindPFlag("peltr.server.data-dir", Command.Flags().Lookup("data-dir"))
+	viper.BindPFlag("peltr.server.advertise", Command.Flags().Lookup("advertise"))
+	viper.BindPFlag("peltr.server.auth-token-file", Command.Flags().Lookup("auth-token-file"))
+	viper.BindPFlag("peltr.server.auth-hmac-secret-file", Command.Flags().Lookup("auth-hmac-secret-file"))
+	viper.BindPFlag("peltr.server.worker-credentials-file", Command.Flags().Lookup("worker-credentials-file"))
+	viper.BindPFlag("peltr.server.worker-allow-token", Command.Flags().Lookup("worker-allow-token"))
+	viper.BindPFlag("peltr.server.api-cert", Command.Flags().Lookup("api-cert"))
+	viper.BindPFlag("peltr.server.api-key", Command.Flags().Lookup("api-key"))
+	viper.BindPFlag("peltr.server.api-client-ca", Command.Flags().Lookup("api-client-ca"))
+	viper.BindPFlag("peltr.server.leader-ca", Command.Flags().Lookup("leader-ca"))
+	viper.BindPFlag("peltr.server.control-cert", Command.Flags().Lookup("control-cert"))
+	viper.BindPFlag("peltr.server.control-key", Command.Flags().Lookup("control-key"))
+	viper.BindPFlag("peltr.server.control-client-ca", Command.Flags().Lookup("control-client-ca"))
 }
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package stop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gideonw/peltr/pkg/server"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var Command = &cobra.Command{
+	Use:   "stop-all",
+	Short: "Cancels every running job and stops the scheduler until resumed",
+
+	Run: func(cmd *cobra.Command, args []string) {
+		log := viper.Get("logger").(zerolog.Logger)
+
+		u, err := url.Parse(viper.GetString("stop.host"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid host")
+			return
+		}
+		u.Path = server.API_PREFIX + "/stop"
+
+		method, body := http.MethodPost, []byte{}
+		if viper.GetBool("stop.resume") {
+			method = http.MethodDelete
+		} else {
+			body, _ = json.Marshal(map[string]string{"reason": viper.GetString("stop.reason")})
+		}
+		var stop server.Stop
+		if err := call(method, u.String(), body, &stop); err != nil {
+			log.Fatal().Err(err).Msg("Error calling the server")
+			return
+		}
+
+		if stop.Stopped {
+			log.Warn().
+				Str("by", stop.By).
+				Str("reason", stop.Reason).
+				Int("cancelled", len(stop.Cancelled)).
+				Msg("scheduler stopped, resume with peltr stop-all --resume")
+		} else {
+			log.Info().Str("by", stop.ResumedBy).Msg("scheduler resumed")
+		}
+	},
+}
+
+// call sends the request to the API and decodes the response into v
+func call(method, u string, body []byte, v interface{}) error {
+	var r io.Reader
+	if len(body) > 0 {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := viper.GetString("stop.token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error server.APIError `json:"error"`
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(b, &apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, apiErr.Error.Message)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func init() {
+	// Flags for this command
+	Command.Flags().StringP("host", "H", "http://localhost:8010", "API of any of the servers")
+	Command.Flags().String("reason", "", "Why the scheduler is stopped, kept with who stopped it")
+	Command.Flags().Bool("resume", false, "Resume the scheduler after a stop instead")
+	Command.Flags().String("token", "", "API bearer token of an admin, default $PELTR_TOKEN")
+
+	// Bind flags to viper
+	viper.BindPFlag("stop.host", Command.Flags().Lookup("host"))
+	viper.BindPFlag("stop.reason", Command.Flags().Lookup("reason"))
+	viper.BindPFlag("stop.resume", Command.Flags().Lookup("resume"))
+	viper.BindPFlag("stop.token", Command.Flags().Lookup("token"))
+	viper.BindEnv("stop.token", "PELTR_TOKEN")
+}
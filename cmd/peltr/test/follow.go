@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gideonw/peltr/pkg/server"
+	"github.com/rs/zerolog"
+)
+
+// eventsURL is the event stream of the job on the server the job was
+// submitted to
+func eventsURL(host, id string) (string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", err
+	}
+	u.Path = server.API_PREFIX + "/jobs/" + url.PathEscape(id) + "/events"
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// follow logs the job's events until it finishes and returns its final
+// state
+func follow(log zerolog.Logger, host, id string) (server.JobState, error) {
+	u, err := eventsURL(host, id)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	authorize(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("following job %s: %s", id, resp.Status)
+	}
+
+	var state server.JobState
+	event := ""
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := []byte(strings.TrimPrefix(line, "data: "))
+			switch event {
+			case "state":
+				var ev server.JobStateEvent
+				if err := json.Unmarshal(data, &ev); err != nil {
+					return state, err
+				}
+				state = ev.State
+				log.Info().Str("id", id).Str("state", string(ev.State)).Str("reason", ev.Reason).Str("worker", ev.WorkerID).Msg("job state")
+			case "progress":
+				var p server.JobProgress
+				if err := json.Unmarshal(data, &p); err != nil {
+					return state, err
+				}
+				log.Info().
+					Str("id", id).
+					Int("requests", p.Requests).
+					Int("errors", p.Errors).
+					Float64("rps", p.RPS).
+					Float64("p50", p.LatencyMs.P50).
+					Float64("p99", p.LatencyMs.P99).
+					Msg("job progress")
+			case "end":
+				return state, nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return state, err
+	}
+	return state, fmt.Errorf("stream of job %s ended before the job finished", id)
+}
@@ -11,8 +11,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/gideonw/peltr/pkg/server"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
@@ -41,6 +45,7 @@ var Command = &cobra.Command{
 			Str("endpoint", args[0]).
 			Msg("test settings")
 
+		submitted := []string{}
 		for i := 0; i < viper.GetInt("number"); i++ {
 			uuid, _ := uuid.NewRandom()
 			b, err := json.Marshal(proto.Job{
@@ -50,15 +55,20 @@ var Command = &cobra.Command{
 				Concurrency: viper.GetInt("concurrency"),
 				Duration:    viper.GetInt("duration"),
 				Rate:        viper.GetInt("rate"),
+				Namespace:   viper.GetString("namespace"),
 			})
 			if err != nil {
 				log.Error().Err(err).Str("id", uuid.String()).Msg("error making json payload")
 				return
 			}
-			buf := bytes.NewBuffer(b)
-			resp, err := http.Post(viper.GetString("host"), "application/json", buf)
+			resp, err := submit(viper.GetString("host"), uuid.String(), b, viper.GetInt("retries"))
 			if err != nil {
 				log.Error().Err(err).Str("id", uuid.String()).Msg("error making POST")
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				submitted = append(submitted, uuid.String())
 			}
 			log.Info().
 				Str("status", resp.Status).
@@ -72,18 +82,88 @@ var Command = &cobra.Command{
 				Msg("sending job via POST")
 		}
 
+		if viper.GetBool("follow") {
+			followAll(log, viper.GetString("host"), submitted)
+		}
+
 		log.Info().Msg("complete")
 	},
 }
 
+// followAll follows the jobs until they finish, the command fails if any
+// job didn't complete
+func followAll(log zerolog.Logger, host string, ids []string) {
+	var wg sync.WaitGroup
+	failed := make(chan string, len(ids))
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			state, err := follow(log, host, id)
+			if err != nil {
+				log.Error().Err(err).Str("id", id).Msg("error following job")
+			}
+			if state != server.JobStateCompleted {
+				failed <- id
+			}
+		}(id)
+	}
+	wg.Wait()
+	close(failed)
+
+	if len(failed) > 0 {
+		for id := range failed {
+			log.Error().Str("id", id).Msg("job didn't complete")
+		}
+		os.Exit(1)
+	}
+}
+
+// submit posts the job, retrying on network errors. The job's ID is sent as
+// its Idempotency-Key so a retry of a job the server got doesn't queue it
+// twice.
+func submit(host, key string, body []byte, retries int) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPost, host, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		authorize(req)
+		resp, err = http.DefaultClient.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// authorize sets the API token on the request, if there is one
+func authorize(req *http.Request) {
+	if token := viper.GetString("token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
 func init() {
 	// Flags for this command
 	Command.Flags().IntP("number", "n", 1, "")
 	Command.Flags().IntP("req", "t", 100, "")
 	Command.Flags().IntP("rate", "r", 100, "")
-	Command.Flags().IntP("concurrency", "c", 10, "")
+	Command.Flags().IntP("concurrency", "j", 10, "")
 	Command.Flags().IntP("duration", "s", 10, "")
 	Command.Flags().StringP("host", "H", "", "")
+	Command.Flags().Int("retries", 3, "Times to retry a submission on network errors")
+	Command.Flags().BoolP("follow", "f", false, "Follow the jobs until they finish, fail if any doesn't complete")
+	Command.Flags().String("token", "", "API bearer token, default $PELTR_TOKEN")
+	Command.Flags().String("namespace", "", "Namespace to submit the jobs to, default the token's only namespace or default")
 
 	// Bind flags to viper
 	viper.BindPFlag("number", Command.Flags().Lookup("number"))
@@ -92,4 +172,9 @@ func init() {
 	viper.BindPFlag("concurrency", Command.Flags().Lookup("concurrency"))
 	viper.BindPFlag("duration", Command.Flags().Lookup("duration"))
 	viper.BindPFlag("host", Command.Flags().Lookup("host"))
+	viper.BindPFlag("retries", Command.Flags().Lookup("retries"))
+	viper.BindPFlag("follow", Command.Flags().Lookup("follow"))
+	viper.BindPFlag("token", Command.Flags().Lookup("token"))
+	viper.BindPFlag("namespace", Command.Flags().Lookup("namespace"))
+	viper.BindEnv("token", "PELTR_TOKEN")
 }
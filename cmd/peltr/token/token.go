@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package token
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var Command = &cobra.Command{
+	Use:   "token",
+	Short: "Signs an API token with the servers' HMAC secret",
+	// logs go to stderr, the token is the only output
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		viper.Set("peltr.local", false)
+		cmd.Root().PersistentPreRun(cmd, args)
+	},
+
+	Run: func(cmd *cobra.Command, args []string) {
+		log := viper.Get("logger").(zerolog.Logger)
+
+		secret, err := auth.ReadSecretFile(viper.GetString("token.secret-file"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error reading the secret")
+			return
+		}
+		role, err := auth.ParseRole(viper.GetString("token.role"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid role")
+			return
+		}
+		id := auth.Identity{
+			Name:       viper.GetString("token.name"),
+			Role:       role,
+			Namespaces: viper.GetStringSlice("token.namespaces"),
+		}
+		token, err := auth.HMACTokens{Secret: secret}.Sign(id, viper.GetDuration("token.ttl"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error signing the token")
+			return
+		}
+		fmt.Println(token)
+	},
+}
+
+func init() {
+	// Flags for this command
+	Command.Flags().String("secret-file", "", "File of the secret the servers verify tokens with (--auth-hmac-secret-file)")
+	Command.Flags().String("name", "", "Name of the caller the token is for")
+	Command.Flags().String("role", "submitter", "Role of the caller: viewer, submitter or admin")
+	Command.Flags().Duration("ttl", 30*24*time.Hour, "How long the token is valid")
+	Command.Flags().StringSlice("namespace", []string{}, "Namespaces the role applies in, comma separated, default every namespace")
+
+	// Bind flags to viper
+	viper.BindPFlag("token.secret-file", Command.Flags().Lookup("secret-file"))
+	viper.BindPFlag("token.name", Command.Flags().Lookup("name"))
+	viper.BindPFlag("token.role", Command.Flags().Lookup("role"))
+	viper.BindPFlag("token.ttl", Command.Flags().Lookup("ttl"))
+	viper.BindPFlag("token.namespaces", Command.Flags().Lookup("namespace"))
+}
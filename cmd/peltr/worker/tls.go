@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package worker
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/gideonw/peltr/pkg/worker"
+	"github.com/spf13/viper"
+)
+
+// workerTLS builds the TLS config the worker dials the servers with from
+// the flags, nil if it dials over plain TCP. The servers' certificates are
+// verified against the CA, the system's if none is set, and their pins. With
+// pins and no CA only the pins are checked, for self-signed certificates.
+func workerTLS() (*worker.TLS, error) {
+	ca := viper.GetString("peltr.worker.tls-ca")
+	cert, key := viper.GetString("peltr.worker.tls-cert"), viper.GetString("peltr.worker.tls-key")
+	pins := viper.GetStringSlice("peltr.worker.tls-pin")
+	if (cert == "") != (key == "") {
+		return nil, errors.New("tls-cert and tls-key are set together")
+	}
+	if !viper.GetBool("peltr.worker.tls") && ca == "" && cert == "" && len(pins) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: viper.GetString("peltr.worker.tls-server-name"),
+	}
+	if ca != "" {
+		pool, err := auth.LoadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if len(pins) > 0 {
+		verify, err := auth.VerifyPins(pins)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyConnection = verify
+		// the pins are what the server is trusted by
+		config.InsecureSkipVerify = ca == ""
+	}
+
+	t := &worker.TLS{Config: config}
+	if cert != "" {
+		kp, err := auth.LoadKeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = kp.GetClientCertificate
+		t.Cert = kp
+	}
+	return t, nil
+}
@@ -25,9 +25,38 @@ var Command = &cobra.Command{
 		log := viper.Get("logger").(zerolog.Logger)
 
 		m := worker.NewMetricsStore()
-		runtime := worker.NewRuntime(m, log, viper.GetString("peltr.host"), viper.GetInt("peltr.port"))
+		limits := worker.Limits{
+			Jobs:        viper.GetUint("peltr.worker.capacity"),
+			Rate:        viper.GetUint("peltr.worker.max-rate"),
+			Concurrency: viper.GetUint("peltr.worker.concurrency"),
+		}
+		labels := viper.GetStringMapString("peltr.worker.labels")
+		for _, key := range []string{"zone", "region", "network"} {
+			if v := viper.GetString("peltr.worker." + key); v != "" {
+				labels[key] = v
+			}
+		}
+		log.Info().Interface("labels", labels).Msg("worker labels")
+
+		creds := worker.Credentials{
+			Name:       viper.GetString("peltr.worker.credential"),
+			SecretFile: viper.GetString("peltr.worker.credential-file"),
+			Token:      viper.GetBool("peltr.worker.send-token"),
+		}
+		if (creds.Name == "") != (creds.SecretFile == "") {
+			log.Fatal().Msg("credential and credential-file must be set together")
+			return
+		}
+
+		tlsConfig, err := workerTLS()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error configuring TLS to the servers")
+			return
+		}
+
+		runtime := worker.NewRuntime(m, log, viper.GetString("peltr.host"), viper.GetInt("peltr.port"), limits, labels, creds, tlsConfig)
 
-		err := runtime.Connect()
+		err = runtime.Connect()
 		if err != nil {
 			log.Fatal().Err(err).Msg("error connecting to server")
 			return
@@ -47,12 +76,42 @@ var Command = &cobra.Command{
 
 func init() {
 	// Flags for this command
-	Command.Flags().IntP("concurrency", "j", 100, "Server port to communicate over")
-	Command.Flags().StringP("host", "H", "localhost:8000", "Server host to connect to")
+	Command.Flags().IntP("concurrency", "j", 100, "Max concurrent requests across all jobs, 0 is unlimited")
+	Command.Flags().Int("capacity", 10, "Max jobs to run at once, 0 is unlimited")
+	Command.Flags().Int("max-rate", 0, "Max req/s across all jobs, 0 is unlimited")
+	Command.Flags().String("zone", "", "Zone label the worker runs in")
+	Command.Flags().String("region", "", "Region label the worker runs in")
+	Command.Flags().String("network", "", "Network label the worker runs in")
+	Command.Flags().StringToString("label", map[string]string{}, "Custom labels to place jobs by (--label key=value)")
+	Command.Flags().StringP("host", "H", "localhost:8000", "Server hosts to connect to, comma separated, tried in turn")
 	Command.Flags().IntP("prom-http", "m", 8010, "Set the port for /metrics")
+	Command.Flags().String("credential", "", "Name of the key the worker enrolls with")
+	Command.Flags().String("credential-file", "", "File of the key's secret, read each time the worker connects")
+	Command.Flags().Bool("send-token", false, "Send the secret itself instead of answering the server's challenge")
+	Command.Flags().Bool("tls", false, "Connect to the servers over TLS, implied by the other tls flags")
+	Command.Flags().String("tls-ca", "", "CA the servers' certificates are verified with, default the system's")
+	Command.Flags().StringSlice("tls-pin", []string{}, "Base64 SHA-256 of a server's public key to accept, comma separated, only the pins are checked without tls-ca")
+	Command.Flags().String("tls-server-name", "", "Name the servers' certificates are verified for, default the host dialed")
+	Command.Flags().String("tls-cert", "", "Client certificate to present to the servers, read again when it changes")
+	Command.Flags().String("tls-key", "", "Key of the client certificate")
 
 	// Bind flags to viper
 	viper.BindPFlag("peltr.host", Command.Flags().Lookup("host"))
 	viper.BindPFlag("peltr.prom-http", Command.Flags().Lookup("prom-http"))
 	viper.BindPFlag("peltr.worker.concurrency", Command.Flags().Lookup("concurrency"))
+	viper.BindPFlag("peltr.worker.capacity", Command.Flags().Lookup("capacity"))
+	viper.BindPFlag("peltr.worker.max-rate", Command.Flags().Lookup("max-rate"))
+	viper.BindPFlag("peltr.worker.zone", Command.Flags().Lookup("zone"))
+	viper.BindPFlag("peltr.worker.region", Command.Flags().Lookup("region"))
+	viper.BindPFlag("peltr.worker.network", Command.Flags().Lookup("network"))
+	viper.BindPFlag("peltr.worker.labels", Command.Flags().Lookup("label"))
+	viper.BindPFlag("peltr.worker.credential", Command.Flags().Lookup("credential"))
+	viper.BindPFlag("peltr.worker.credential-file", Command.Flags().Lookup("credential-file"))
+	viper.BindPFlag("peltr.worker.send-token", Command.Flags().Lookup("send-token"))
+	viper.BindPFlag("peltr.worker.tls", Command.Flags().Lookup("tls"))
+	viper.BindPFlag("peltr.worker.tls-ca", Command.Flags().Lookup("tls-ca"))
+	viper.BindPFlag("peltr.worker.tls-pin", Command.Flags().Lookup("tls-pin"))
+	viper.BindPFlag("peltr.worker.tls-server-name", Command.Flags().Lookup("tls-server-name"))
+	viper.BindPFlag("peltr.worker.tls-cert", Command.Flags().Lookup("tls-cert"))
+	viper.BindPFlag("peltr.worker.tls-key", Command.Flags().Lookup("tls-key"))
 }
@@ -17,7 +17,9 @@ func init() {
 	// init gob wire types
 	gob.RegisterName("Assign", &proto.Assign{})
 	gob.RegisterName("Job", &proto.Job{})
-	gob.RegisterName("Update", &[]proto.Status{})
+	gob.RegisterName("Status", &proto.Status{})
+	gob.RegisterName("Cancel", &proto.Cancel{})
+	gob.RegisterName("Update", &proto.Update{})
 }
 
 func main() {
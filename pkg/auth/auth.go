@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+// Package auth identifies API callers and the role they have.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role of a caller, each role can do what the roles before it can
+type Role int
+
+const (
+	// RoleNone is a caller that didn't authenticate
+	RoleNone Role = iota
+	// RoleViewer reads jobs, workers, schedules and suites
+	RoleViewer
+	// RoleSubmitter submits jobs, schedules and suites and changes or
+	// cancels its own
+	RoleSubmitter
+	// RoleAdmin changes or cancels anyone's
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleNone:      "none",
+	RoleViewer:    "viewer",
+	RoleSubmitter: "submitter",
+	RoleAdmin:     "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole parses viewer, submitter or admin
+func ParseRole(name string) (Role, error) {
+	for role, n := range roleNames {
+		if role != RoleNone && n == name {
+			return role, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q, roles are viewer, submitter and admin", name)
+}
+
+// MarshalText lets roles be written as their name in JSON
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(b []byte) error {
+	role, err := ParseRole(string(b))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// Identity is an authenticated caller, Method is how it authenticated.
+// Namespaces are the only namespaces the caller's role applies in, none is
+// every namespace.
+type Identity struct {
+	Name       string   `json:"name"`
+	Role       Role     `json:"role"`
+	Method     string   `json:"method"`
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// InNamespace reports if the caller's role applies in the namespace
+func (id Identity) InNamespace(ns string) bool {
+	if len(id.Namespaces) == 0 {
+		return true
+	}
+	for _, n := range id.Namespaces {
+		if n == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNamespaces splits a list of namespaces separated by spaces or commas
+func ParseNamespaces(s string) []string {
+	return strings.FieldsFunc(s, func(c rune) bool {
+		return c == ',' || c == ' '
+	})
+}
+
+// Anonymous is the identity of every caller when authentication is off
+var Anonymous = Identity{Name: "anonymous", Role: RoleAdmin, Method: "none"}
+
+// ErrInvalidCredentials is a caller that sent credentials that don't
+// authenticate it
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator identifies the caller of a request. It returns false if the
+// request has no credentials of its kind, and an error if the credentials
+// are invalid.
+type Authenticator interface {
+	Authenticate(req *http.Request) (Identity, bool, error)
+}
+
+// Chain tries each authenticator in order, the first one the request has
+// credentials for decides
+type Chain []Authenticator
+
+func (c Chain) Authenticate(req *http.Request) (Identity, bool, error) {
+	for _, a := range c {
+		id, ok, err := a.Authenticate(req)
+		if ok || err != nil {
+			return id, ok, err
+		}
+	}
+	return Identity{}, false, nil
+}
+
+// BearerToken of the request's Authorization header, if any
+func BearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+type identityKey struct{}
+
+// WithIdentity returns the context carrying the caller's identity
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the caller's identity, a caller without one has
+// RoleNone
+func FromContext(ctx context.Context) Identity {
+	id, _ := ctx.Value(identityKey{}).(Identity)
+	return id
+}
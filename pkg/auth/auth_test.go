@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACTokens(t *testing.T) {
+	h := HMACTokens{Secret: []byte("0123456789abcdef")}
+	token, err := h.Sign(Identity{Name: "ci", Role: RoleSubmitter, Namespaces: []string{"team-a"}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := h.Verify(token, time.Now())
+	if err != nil || id.Name != "ci" || id.Role != RoleSubmitter || !id.InNamespace("team-a") || id.InNamespace("team-b") {
+		t.Errorf("verified %+v, %v", id, err)
+	}
+	if _, err := h.Verify(token, time.Now().Add(2*time.Hour)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expired token: %v", err)
+	}
+	other := HMACTokens{Secret: []byte("fedcba9876543210")}
+	if _, err := other.Verify(token, time.Now()); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("token of another secret: %v", err)
+	}
+	for _, bad := range []string{"peltr1.", "peltr1.x", token + "x", strings.Replace(token, "peltr1.", "peltr1.e", 1)} {
+		if _, err := h.Verify(bad, time.Now()); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%q: %v", bad, err)
+		}
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := ParseTokens(strings.NewReader("# token,name,role\nt1,alice,admin\nt2, bob, viewer\nt3,carol,submitter,team-a team-b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens["t1"].Role != RoleAdmin || tokens["t2"].Name != "bob" || tokens["t2"].Role != RoleViewer {
+		t.Errorf("parsed %+v", tokens)
+	}
+	if !tokens["t1"].InNamespace("team-a") || !tokens["t3"].InNamespace("team-b") || tokens["t3"].InNamespace("default") {
+		t.Errorf("namespaces %+v", tokens)
+	}
+	for _, bad := range []string{"t1,alice\n", "t1,alice,admin,a,b\n", "t1,alice,root\n", "t1,alice,admin\nt1,bob,viewer\n"} {
+		if _, err := ParseTokens(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	h := HMACTokens{Secret: []byte("0123456789abcdef")}
+	signed, _ := h.Sign(Identity{Name: "ci", Role: RoleViewer}, time.Hour)
+	chain := Chain{h, StaticTokens{"t1": {Name: "alice", Role: RoleAdmin}}}
+
+	for token, want := range map[string]string{"t1": "alice", signed: "ci", "": ""} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		id, ok, err := chain.Authenticate(req)
+		if err != nil || ok != (want != "") || id.Name != want {
+			t.Errorf("%q: %+v %v %v", token, id, ok, err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer t2")
+	if _, _, err := chain.Authenticate(req); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown token: %v", err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workers.csv")
+	if err := os.WriteFile(path, []byte("fleet-a,aaaaaaaaaaaaaaaa\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := []byte("challenge")
+	proof := WorkerProof([]byte("aaaaaaaaaaaaaaaa"), challenge, "w1")
+	if err := k.VerifyProof("fleet-a", challenge, "w1", proof); err != nil {
+		t.Errorf("proof: %v", err)
+	}
+	if err := k.VerifyProof("fleet-a", []byte("other"), "w1", proof); !errors.Is(err, ErrBadProof) {
+		t.Errorf("proof of another challenge: %v", err)
+	}
+	if err := k.VerifyProof("fleet-a", challenge, "w2", proof); !errors.Is(err, ErrBadProof) {
+		t.Errorf("proof of another worker: %v", err)
+	}
+	if err := k.VerifyToken("fleet-a", "aaaaaaaaaaaaaaaa"); err != nil {
+		t.Errorf("token: %v", err)
+	}
+
+	// rotate: fleet-b is added, then fleet-a revoked
+	os.WriteFile(path, []byte("fleet-a,aaaaaaaaaaaaaaaa\nfleet-b,bbbbbbbbbbbbbbbb\n"), 0o600)
+	if changed, err := k.Reload(); !changed || err != nil || k.Len() != 2 {
+		t.Errorf("reload: %v %v %d", changed, err, k.Len())
+	}
+	os.WriteFile(path, []byte("fleet-b,bbbbbbbbbbbbbbbb\n"), 0o600)
+	k.Reload()
+	if err := k.VerifyProof("fleet-a", challenge, "w1", proof); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("revoked key: %v", err)
+	}
+
+	// a broken file keeps the keys
+	os.WriteFile(path, []byte("fleet-c,short\n"), 0o600)
+	if _, err := k.Reload(); err == nil || k.Len() != 1 {
+		t.Errorf("broken file: %v %d", err, k.Len())
+	}
+}
@@ -0,0 +1,36 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ClientCerts identifies callers by the client certificate they presented
+// over TLS, verified against the client CA of the server's TLS config. The
+// caller's name is the certificate's common name, its role the first
+// organization of the certificate that names a role, and its namespaces the
+// organizational units, if any.
+type ClientCerts struct{}
+
+func (ClientCerts) Authenticate(req *http.Request) (Identity, bool, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return Identity{}, false, nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return Identity{}, false, fmt.Errorf("%w: client certificate has no common name", ErrInvalidCredentials)
+	}
+	for _, org := range cert.Subject.Organization {
+		if role, err := ParseRole(org); err == nil {
+			return Identity{Name: cert.Subject.CommonName, Role: role, Method: "mtls", Namespaces: cert.Subject.OrganizationalUnit}, true, nil
+		}
+	}
+	// a known caller without a role
+	return Identity{Name: cert.Subject.CommonName, Role: RoleNone, Method: "mtls"}, true, nil
+}
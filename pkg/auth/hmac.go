@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// hmacPrefix marks signed tokens
+const hmacPrefix = "peltr1."
+
+// claims of a signed token, Exp is a unix time
+type claims struct {
+	Sub  string   `json:"sub"`
+	Role Role     `json:"role"`
+	NS   []string `json:"ns,omitempty"`
+	Exp  int64    `json:"exp"`
+}
+
+// HMACTokens are bearer tokens signed with a secret the servers share, they
+// carry the caller's name, role and expiry so the servers don't need to
+// list them
+type HMACTokens struct {
+	Secret []byte
+	// Method the identities are recorded as having authenticated with,
+	// "hmac" if empty
+	Method string
+}
+
+// ReadSecretFile reads a secret to sign tokens with, trailing newlines
+// aren't part of it
+func ReadSecretFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimRight(b, "\r\n")
+	if len(b) < 16 {
+		return nil, fmt.Errorf("secret in %s must be at least 16 bytes", path)
+	}
+	return b, nil
+}
+
+// Sign returns a token for the identity's name, role and namespaces that
+// expires after the ttl
+func (h HMACTokens) Sign(id Identity, ttl time.Duration) (string, error) {
+	if len(h.Secret) == 0 {
+		return "", errors.New("no secret to sign with")
+	}
+	if id.Name == "" || id.Role == RoleNone {
+		return "", errors.New("a token needs a name and a role")
+	}
+	payload, err := json.Marshal(claims{Sub: id.Name, Role: id.Role, NS: id.Namespaces, Exp: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	body := hmacPrefix + base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + base64.RawURLEncoding.EncodeToString(h.mac(body)), nil
+}
+
+// Verify returns the identity the token was signed for
+func (h HMACTokens) Verify(token string, now time.Time) (Identity, error) {
+	if !strings.HasPrefix(token, hmacPrefix) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	i := strings.LastIndexByte(token, '.')
+	if i < len(hmacPrefix) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	body, sig := token[:i], token[i+1:]
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, h.mac(body)) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(body, hmacPrefix))
+	if err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	if now.Unix() >= c.Exp {
+		return Identity{}, fmt.Errorf("%w: token of %s expired", ErrInvalidCredentials, c.Sub)
+	}
+	method := h.Method
+	if method == "" {
+		method = "hmac"
+	}
+	return Identity{Name: c.Sub, Role: c.Role, Method: method, Namespaces: c.NS}, nil
+}
+
+func (h HMACTokens) mac(body string) []byte {
+	m := hmac.New(sha256.New, h.Secret)
+	m.Write([]byte(body))
+	return m.Sum(nil)
+}
+
+func (h HMACTokens) Authenticate(req *http.Request) (Identity, bool, error) {
+	token, ok := BearerToken(req)
+	if !ok || !strings.HasPrefix(token, hmacPrefix) {
+		return Identity{}, false, nil
+	}
+	id, err := h.Verify(token, time.Now())
+	return id, err == nil, err
+}
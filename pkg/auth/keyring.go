@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keyring is the named secrets workers enroll with, read from a CSV file of
+// name,secret lines. The file is read again when it changes, so credentials
+// are rotated by listing the new one next to the old until every worker has
+// it.
+type Keyring struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	size    int64
+	keys    map[string][]byte
+}
+
+// LoadKeyring reads the keyring file
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if _, err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the file again if it changed since it was read, it returns
+// true if it did. A file that fails to parse leaves the keys as they were.
+func (k *Keyring) Reload() (bool, error) {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return false, err
+	}
+	k.mu.RLock()
+	unchanged := info.ModTime().Equal(k.modTime) && info.Size() == k.size && k.keys != nil
+	k.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	f, err := os.Open(k.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	keys, err := ParseKeys(f)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", k.path, err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.modTime = info.ModTime()
+	k.size = info.Size()
+	return true, nil
+}
+
+// Len is the number of keys
+func (k *Keyring) Len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.keys)
+}
+
+// Secret of the named key
+func (k *Keyring) Secret(name string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	secret, ok := k.keys[name]
+	return secret, ok
+}
+
+// ParseKeys reads name,secret lines, lines starting with # are comments
+func ParseKeys(r io.Reader) (map[string][]byte, error) {
+	c := csv.NewReader(r)
+	c.Comment = '#'
+	c.FieldsPerRecord = 2
+	c.TrimLeadingSpace = true
+	records, err := c.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte)
+	for i, rec := range records {
+		name, secret := strings.TrimSpace(rec[0]), strings.TrimSpace(rec[1])
+		if name == "" {
+			return nil, fmt.Errorf("line %d: name is required", i+1)
+		}
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("line %d: secret of %s must be at least 16 bytes", i+1, name)
+		}
+		if _, ok := keys[name]; ok {
+			return nil, fmt.Errorf("line %d: %s is listed twice", i+1, name)
+		}
+		keys[name] = []byte(secret)
+	}
+	return keys, nil
+}
+
+var (
+	ErrUnknownKey = errors.New("unknown credential")
+	ErrBadProof   = errors.New("credential doesn't match")
+)
+
+// WorkerProof is the worker's answer to the server's challenge, it binds
+// the worker's ID to the connection so it can't be replayed
+func WorkerProof(secret, challenge []byte, workerID string) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write(challenge)
+	m.Write([]byte(workerID))
+	return m.Sum(nil)
+}
+
+// VerifyProof checks the worker answered the challenge with the named key
+func (k *Keyring) VerifyProof(name string, challenge []byte, workerID string, proof []byte) error {
+	secret, ok := k.Secret(name)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, name)
+	}
+	if !hmac.Equal(proof, WorkerProof(secret, challenge, workerID)) {
+		return fmt.Errorf("%w %q", ErrBadProof, name)
+	}
+	return nil
+}
+
+// VerifyToken checks the worker sent the named key's secret as is
+func (k *Keyring) VerifyToken(name, token string) error {
+	secret, ok := k.Secret(name)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, name)
+	}
+	if subtle.ConstantTimeCompare(secret, []byte(token)) != 1 {
+		return fmt.Errorf("%w %q", ErrBadProof, name)
+	}
+	return nil
+}
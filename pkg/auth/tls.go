@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyPair is a certificate and its key read from PEM files. The files are
+// read again when they change, so a renewed certificate is served without a
+// restart.
+type KeyPair struct {
+	mu       sync.RWMutex
+	certFile string
+	keyFile  string
+	// modTimes of the certificate and the key when they were read
+	modTimes [2]time.Time
+	cert     *tls.Certificate
+}
+
+// LoadKeyPair reads the certificate and the key
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	kp := &KeyPair{certFile: certFile, keyFile: keyFile}
+	if _, err := kp.Reload(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// Reload reads the files again if either changed since they were read, it
+// returns true if they did. A certificate that fails to load, i.e. one
+// written before its key, leaves the pair as it was until the next reload.
+func (kp *KeyPair) Reload() (bool, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{kp.certFile, kp.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	kp.mu.RLock()
+	unchanged := modTimes == kp.modTimes && kp.cert != nil
+	kp.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", kp.certFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", kp.certFile, err)
+	}
+
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	kp.cert = &cert
+	kp.modTimes = modTimes
+	return true, nil
+}
+
+// Leaf is the certificate as it was last read
+func (kp *KeyPair) Leaf() *x509.Certificate {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return kp.cert.Leaf
+}
+
+// GetCertificate serves the pair, for tls.Config.GetCertificate
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return kp.cert, nil
+}
+
+// GetClientCertificate presents the pair, for
+// tls.Config.GetClientCertificate
+func (kp *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return kp.cert, nil
+}
+
+// LoadCertPool reads the PEM certificates of a CA
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// CertificatePin is the base64 SHA-256 of the certificate's public key, it
+// stays the same when a certificate is renewed with the same key
+func CertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// VerifyPins returns a tls.Config.VerifyConnection that only accepts a peer
+// whose certificate has one of the pins, as made by CertificatePin. Listing
+// the next key's pin next to the current one lets the peer rotate its key.
+func VerifyPins(pins []string) (func(tls.ConnectionState) error, error) {
+	want := [][]byte{}
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("pin %q isn't a base64 SHA-256", pin)
+		}
+		want = append(want, b)
+	}
+	if len(want) == 0 {
+		return nil, errors.New("no pins to verify with")
+	}
+
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("peer presented no certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+		sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		for _, pin := range want {
+			if subtle.ConstantTimeCompare(pin, sum[:]) == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate of %s doesn't match a pin, its pin is %s", leaf.Subject.CommonName, CertificatePin(leaf))
+	}, nil
+}
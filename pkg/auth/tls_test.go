@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for the name with a new key
+func writeCert(t *testing.T, certFile, keyFile, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "a.peltr")
+	kp, err := LoadKeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := kp.Reload(); changed || err != nil {
+		t.Errorf("unchanged files reloaded %v %v", changed, err)
+	}
+
+	// a certificate written before its key keeps the old pair
+	os.WriteFile(certFile, []byte("garbage"), 0o600)
+	os.Chtimes(certFile, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	if _, err := kp.Reload(); err == nil {
+		t.Error("reloaded a bad certificate")
+	}
+	if cert, _ := kp.GetCertificate(nil); cert.Leaf.Subject.CommonName != "a.peltr" {
+		t.Errorf("serving %s", cert.Leaf.Subject.CommonName)
+	}
+
+	writeCert(t, certFile, keyFile, "b.peltr")
+	os.Chtimes(certFile, time.Now().Add(2*time.Second), time.Now().Add(2*time.Second))
+	if changed, err := kp.Reload(); !changed || err != nil {
+		t.Errorf("renewed files not reloaded %v %v", changed, err)
+	}
+	if cert, _ := kp.GetClientCertificate(nil); cert.Leaf.Subject.CommonName != "b.peltr" {
+		t.Errorf("presenting %s", cert.Leaf.Subject.CommonName)
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	dir := t.TempDir()
+	a := writeCert(t, filepath.Join(dir, "a.pem"), filepath.Join(dir, "a.key"), "a.peltr")
+	b := writeCert(t, filepath.Join(dir, "b.pem"), filepath.Join(dir, "b.key"), "b.peltr")
+
+	verify, err := VerifyPins([]string{"sha256/" + CertificatePin(a)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{a}}); err != nil {
+		t.Errorf("pinned certificate: %v", err)
+	}
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{b}}); err == nil {
+		t.Error("accepted a certificate that isn't pinned")
+	}
+	if err := verify(tls.ConnectionState{}); err == nil {
+		t.Error("accepted no certificate")
+	}
+	if _, err := VerifyPins([]string{"abc"}); err == nil {
+		t.Error("accepted a pin that isn't a SHA-256")
+	}
+}
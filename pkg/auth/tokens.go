@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// StaticTokens are bearer tokens from config, each of a name, a role and
+// optionally the namespaces the role applies in
+type StaticTokens map[string]Identity
+
+// LoadTokenFile reads a CSV file of token,name,role[,namespaces] lines,
+// lines starting with # are comments
+func LoadTokenFile(path string) (StaticTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTokens(f)
+}
+
+// ParseTokens reads token,name,role[,namespaces] lines, the namespaces are
+// separated by spaces
+func ParseTokens(r io.Reader) (StaticTokens, error) {
+	c := csv.NewReader(r)
+	c.Comment = '#'
+	c.FieldsPerRecord = -1
+	c.TrimLeadingSpace = true
+	records, err := c.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := StaticTokens{}
+	for i, rec := range records {
+		if len(rec) != 3 && len(rec) != 4 {
+			return nil, fmt.Errorf("line %d: want token,name,role[,namespaces], got %d fields", i+1, len(rec))
+		}
+		token, name := strings.TrimSpace(rec[0]), strings.TrimSpace(rec[1])
+		if token == "" || name == "" {
+			return nil, fmt.Errorf("line %d: token and name are required", i+1)
+		}
+		role, err := ParseRole(strings.TrimSpace(rec[2]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if _, ok := tokens[token]; ok {
+			return nil, fmt.Errorf("line %d: token of %s is listed twice", i+1, name)
+		}
+		id := Identity{Name: name, Role: role, Method: "token"}
+		if len(rec) == 4 {
+			id.Namespaces = ParseNamespaces(rec[3])
+		}
+		tokens[token] = id
+	}
+	return tokens, nil
+}
+
+func (t StaticTokens) Authenticate(req *http.Request) (Identity, bool, error) {
+	bearer, ok := BearerToken(req)
+	// signed tokens are left to HMACTokens
+	if !ok || strings.HasPrefix(bearer, hmacPrefix) {
+		return Identity{}, false, nil
+	}
+	for token, id := range t {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(bearer)) == 1 {
+			return id, true, nil
+		}
+	}
+	return Identity{}, false, ErrInvalidCredentials
+}
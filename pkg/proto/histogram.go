@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+var (
+	// HISTOGRAM_GROWTH is the ratio between bucket bounds, ~5% error
+	HISTOGRAM_GROWTH = 1.05
+)
+
+// Histogram counts latencies in exponentially sized buckets, histograms
+// from many workers are merged by adding the bucket counts.
+type Histogram struct {
+	// [bucket]count, bucket i holds latencies up to GROWTH^i microseconds
+	Counts map[int]uint64
+	Total  uint64
+	Sum    time.Duration
+	Min    time.Duration
+	Max    time.Duration
+}
+
+func NewHistogram() Histogram {
+	return Histogram{Counts: make(map[int]uint64)}
+}
+
+func bucket(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log(us) / math.Log(HISTOGRAM_GROWTH)))
+}
+
+func bucketBound(i int) time.Duration {
+	return time.Duration(math.Pow(HISTOGRAM_GROWTH, float64(i)) * float64(time.Microsecond))
+}
+
+// Observe adds the latency to the histogram
+func (h *Histogram) Observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make(map[int]uint64)
+	}
+	if h.Total == 0 || d < h.Min {
+		h.Min = d
+	}
+	if d > h.Max {
+		h.Max = d
+	}
+	h.Counts[bucket(d)] += 1
+	h.Total += 1
+	h.Sum += d
+}
+
+// Merge adds the counts of o to the histogram
+func (h *Histogram) Merge(o Histogram) {
+	if o.Total == 0 {
+		return
+	}
+	if h.Counts == nil {
+		h.Counts = make(map[int]uint64)
+	}
+	if h.Total == 0 || o.Min < h.Min {
+		h.Min = o.Min
+	}
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+	for k, v := range o.Counts {
+		h.Counts[k] += v
+	}
+	h.Total += o.Total
+	h.Sum += o.Sum
+}
+
+// Mean latency of the observations
+func (h Histogram) Mean() time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Total)
+}
+
+// Quantile returns the upper bound of the bucket holding the q quantile,
+// clamped to the observed min and max.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+
+	buckets := make([]int, 0, len(h.Counts))
+	for k := range h.Counts {
+		buckets = append(buckets, k)
+	}
+	sort.Ints(buckets)
+
+	rank := uint64(math.Ceil(q * float64(h.Total)))
+	seen := uint64(0)
+	for _, b := range buckets {
+		seen += h.Counts[b]
+		if seen >= rank {
+			d := bucketBound(b)
+			if d > h.Max {
+				return h.Max
+			}
+			if d < h.Min {
+				return h.Min
+			}
+			return d
+		}
+	}
+
+	return h.Max
+}
+
+// Copy returns a deep copy of the histogram
+func (h Histogram) Copy() Histogram {
+	c := h
+	c.Counts = make(map[int]uint64, len(h.Counts))
+	for k, v := range h.Counts {
+		c.Counts[k] = v
+	}
+	return c
+}
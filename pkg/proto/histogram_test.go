@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"testing"
+	"time"
+)
+
+func within(t *testing.T, got, want time.Duration) {
+	t.Helper()
+	diff := float64(got-want) / float64(want)
+	if diff < -0.05 || diff > 0.05 {
+		t.Errorf("got %s, want %s ±5%%", got, want)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := NewHistogram()
+	for i := 1; i <= 100; i++ {
+		h.Observe(time.Duration(i) * time.Millisecond)
+	}
+
+	if h.Total != 100 {
+		t.Errorf("got total %d, want 100", h.Total)
+	}
+	within(t, h.Quantile(0.5), 50*time.Millisecond)
+	within(t, h.Quantile(0.99), 99*time.Millisecond)
+	if h.Quantile(1) != 100*time.Millisecond {
+		t.Errorf("got max %s, want 100ms", h.Quantile(1))
+	}
+	if h.Mean() != 50500*time.Microsecond {
+		t.Errorf("got mean %s, want 50.5ms", h.Mean())
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a := NewHistogram()
+	b := NewHistogram()
+	for i := 1; i <= 50; i++ {
+		a.Observe(time.Duration(i) * time.Millisecond)
+		b.Observe(time.Duration(i+50) * time.Millisecond)
+	}
+
+	var merged Histogram
+	merged.Merge(a)
+	merged.Merge(b)
+
+	if merged.Total != 100 {
+		t.Errorf("got total %d, want 100", merged.Total)
+	}
+	if merged.Min != time.Millisecond || merged.Max != 100*time.Millisecond {
+		t.Errorf("got min %s max %s, want 1ms and 100ms", merged.Min, merged.Max)
+	}
+	within(t, merged.Quantile(0.9), 90*time.Millisecond)
+}
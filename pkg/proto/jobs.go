@@ -6,6 +6,22 @@
 
 package proto
 
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// DEFAULT_RATE is used when a job doesn't set a rate, req/s
+	DEFAULT_RATE = 100
+	// MAX_RATE is the highest rate a job may ask for, req/s
+	MAX_RATE = 1000000
+	// MAX_CONCURRENCY is the most requests a job may have in flight
+	MAX_CONCURRENCY = 100000
+)
+
 type Job struct {
 	ID          string `json:"id"`
 	URL         string `json:"url"`
@@ -13,4 +29,205 @@ type Job struct {
 	Concurrency int    `json:"concurrency"`
 	Duration    int    `json:"duration"`
 	Rate        int    `json:"rate"`
+	Paused      bool   `json:"paused,omitempty"`
+	// Workers to shard the job across
+	Workers int `json:"workers,omitempty"`
+	// Spread shards the job across every eligible worker
+	Spread bool `json:"spread,omitempty"`
+	// Parent is the ID of the job a shard was split from
+	Parent string `json:"parent,omitempty"`
+	Shard  int    `json:"shard,omitempty"`
+
+	// Selector is the labels a worker must have to run the job
+	Selector map[string]string `json:"selector,omitempty"`
+	// AntiAffinity is the IDs of jobs the job won't share a worker with,
+	// a job can list its own ID to keep its shards on separate workers
+	AntiAffinity []string `json:"antiAffinity,omitempty"`
+	// SpreadBy is a worker label to place one shard per label value on,
+	// i.e. zone
+	SpreadBy string `json:"spreadBy,omitempty"`
+
+	// Priority orders the job queue, higher runs first
+	Priority int `json:"priority,omitempty"`
+	// Owner is the team or user the job is queued for, owners of the same
+	// priority share the queue by their weight
+	Owner string `json:"owner,omitempty"`
+	// SubmittedBy is the caller that submitted the job, set by the server
+	SubmittedBy string `json:"submittedBy,omitempty"`
+	// Namespace the job belongs to, its quotas apply to the job
+	Namespace string `json:"namespace,omitempty"`
+
+	// StartAt is when the worker starts the job in the server's time, the
+	// shards of a job are given the same start to run together
+	StartAt *time.Time `json:"startAt,omitempty"`
+}
+
+// Matches reports if the labels have every label of the job's selector
+func (j Job) Matches(labels map[string]string) bool {
+	for k, v := range j.Selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Group is the ID of the job a shard belongs to, or the job's own ID
+func (j Job) Group() string {
+	if j.Parent != "" {
+		return j.Parent
+	}
+	return j.ID
+}
+
+// EffectiveRate is the rate the job runs at, req/s
+func (j Job) EffectiveRate() int {
+	if j.Rate <= 0 {
+		return DEFAULT_RATE
+	}
+	return j.Rate
+}
+
+// Host is the lowercased host the job sends requests to, without the port
+func (j Job) Host() string {
+	u, err := url.Parse(j.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// VUs is the number of concurrent requests the job makes
+func (j Job) VUs() int {
+	if j.Concurrency <= 0 {
+		return 1
+	}
+	return j.Concurrency
+}
+
+// Sharded reports if the job is split across workers
+func (j Job) Sharded() bool {
+	return j.Spread || j.Workers > 1
+}
+
+// Split shards the job into n jobs dividing Req, Rate and Concurrency. No
+// more shards are made than the job has requests or req/s, so every shard
+// sends at least one request at a rate of at least 1.
+func (j Job) Split(n int) []Job {
+	if n > j.Req {
+		n = j.Req
+	}
+	if rate := j.EffectiveRate(); n > rate {
+		n = rate
+	}
+	if n < 1 {
+		n = 1
+	}
+	shards := make([]Job, n)
+	for i := range shards {
+		shard := j
+		shard.ID = fmt.Sprintf("%s.%d", j.ID, i)
+		shard.Parent = j.ID
+		shard.Shard = i
+		shard.Workers = 0
+		shard.Spread = false
+		shard.Req = Share(j.Req, n, i)
+		shard.Rate = Share(j.EffectiveRate(), n, i)
+		if j.Concurrency > 0 {
+			shard.Concurrency = (j.Concurrency + n - 1) / n
+		}
+		shards[i] = shard
+	}
+	return shards
+}
+
+// Share is the i-th of n parts of total, the remainder going to the first
+func Share(total, n, i int) int {
+	part := total / n
+	if i < total%n {
+		part += 1
+	}
+	return part
+}
+
+// JobUpdate changes a job on the fly, nil fields are left as they are
+type JobUpdate struct {
+	ID          string `json:"id"`
+	Rate        *int   `json:"rate,omitempty"`
+	Concurrency *int   `json:"concurrency,omitempty"`
+	Paused      *bool  `json:"paused,omitempty"`
+}
+
+// Apply the update to the job settings
+func (u JobUpdate) Apply(j *Job) {
+	if u.Rate != nil {
+		j.Rate = *u.Rate
+	}
+	if u.Concurrency != nil {
+		j.Concurrency = *u.Concurrency
+	}
+	if u.Paused != nil {
+		j.Paused = *u.Paused
+	}
+}
+
+// Settings returns an update carrying all of the job's tunable settings.
+// Updates are sent to workers this way as gob doesn't transmit zero values.
+func (j Job) Settings() JobUpdate {
+	return JobUpdate{
+		ID:          j.ID,
+		Rate:        &j.Rate,
+		Concurrency: &j.Concurrency,
+		Paused:      &j.Paused,
+	}
+}
+
+// JobEvent is a timestamped entry in a job's result timeline
+type JobEvent struct {
+	At          time.Time `json:"at"`
+	Event       string    `json:"event"`
+	Rate        int       `json:"rate"`
+	Concurrency int       `json:"concurrency"`
+	Paused      bool      `json:"paused"`
+}
+
+// JobResult is a worker's cumulative results for a job
+type JobResult struct {
+	// [StatusCode]count, failed requests are counted under 0
+	Codes map[int]int
+	// [ErrorKind]count
+	Errors   map[string]int
+	Latency  Histogram
+	Requests int
+	Start    time.Time
+	End      time.Time
+	Done     bool
+	// Failure is why the worker gave up on the job, i.e. a denied target
+	Failure  string
+	Timeline []JobEvent
+}
+
+func NewJobResult() JobResult {
+	return JobResult{
+		Codes:   make(map[int]int),
+		Errors:  make(map[string]int),
+		Latency: NewHistogram(),
+	}
+}
+
+// Copy returns a deep copy of the result
+func (r JobResult) Copy() JobResult {
+	c := r
+	c.Codes = make(map[int]int, len(r.Codes))
+	for k, v := range r.Codes {
+		c.Codes[k] = v
+	}
+	c.Errors = make(map[string]int, len(r.Errors))
+	for k, v := range r.Errors {
+		c.Errors[k] = v
+	}
+	c.Latency = r.Latency.Copy()
+	c.Timeline = make([]JobEvent, len(r.Timeline))
+	copy(c.Timeline, r.Timeline)
+	return c
 }
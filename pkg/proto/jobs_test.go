@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import "testing"
+
+func TestJobSplit(t *testing.T) {
+	job := Job{ID: "foo", Req: 10, Rate: 7, Concurrency: 5, Workers: 3}
+	shards := job.Split(3)
+
+	if len(shards) != 3 {
+		t.Fatalf("got %d shards, want 3", len(shards))
+	}
+
+	req, rate := 0, 0
+	for i, shard := range shards {
+		if shard.Parent != "foo" || shard.Shard != i || shard.Sharded() {
+			t.Errorf("shard %d: got %+v", i, shard)
+		}
+		if shard.Concurrency != 2 {
+			t.Errorf("shard %d: got concurrency %d, want 2", i, shard.Concurrency)
+		}
+		req += shard.Req
+		rate += shard.Rate
+	}
+	if req != job.Req || rate != job.Rate {
+		t.Errorf("got req %d rate %d, want %d and %d", req, rate, job.Req, job.Rate)
+	}
+	if shards[0].ID == shards[1].ID {
+		t.Errorf("shard IDs are not unique")
+	}
+
+	// the default rate is divided, and no shard is left without requests
+	// or a rate
+	for _, tc := range []struct {
+		job    Job
+		shards int
+		rate   int
+	}{
+		{Job{ID: "default", Req: 10, Workers: 4}, 4, DEFAULT_RATE},
+		{Job{ID: "slow", Req: 10, Rate: 2, Workers: 4}, 2, 2},
+		{Job{ID: "few", Req: 3, Rate: 10, Workers: 4}, 3, 10},
+	} {
+		shards := tc.job.Split(tc.job.Workers)
+		if len(shards) != tc.shards {
+			t.Errorf("%s: got %d shards, want %d", tc.job.ID, len(shards), tc.shards)
+		}
+		rate := 0
+		for _, shard := range shards {
+			if shard.Rate < 1 || shard.Req < 1 {
+				t.Errorf("%s: shard %d got rate %d req %d", tc.job.ID, shard.Shard, shard.Rate, shard.Req)
+			}
+			rate += shard.Rate
+		}
+		if rate != tc.rate {
+			t.Errorf("%s: got rate %d, want %d", tc.job.ID, rate, tc.rate)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"io"
+	"time"
 )
 
 type MessageType uint8
@@ -22,6 +23,9 @@ const (
 	MessageTypeAlive
 	MessageTypeStatus
 	MessageTypeAccept
+	MessageTypeCancel
+	MessageTypeUpdate
+	MessageTypeReject
 )
 
 // The Message type wraps all messages sent between workers and servers
@@ -73,13 +77,49 @@ type ProtocolObject interface {
 }
 
 type (
+	Hello struct {
+		// Challenge the worker answers with a proof of its credential
+		Challenge []byte
+	}
+
 	Identify struct {
-		ID       string
+		ID string
+		// Capacity is the number of jobs the worker runs at once
 		Capacity uint
+		// MaxRate is the total req/s the worker can send, 0 is unlimited
+		MaxRate uint
+		// MaxConcurrency is the total concurrent requests, 0 is unlimited
+		MaxConcurrency uint
+		// Labels describe where the worker runs, i.e. zone, region, network
+		Labels map[string]string
+
+		// Credential is the name of the key the worker enrolls with, Proof
+		// the HMAC of the hello's challenge and the worker's ID with it.
+		// Token is the key's secret itself, if the server allows it.
+		Credential string
+		Proof      []byte
+		Token      string
+	}
+
+	// Reject tells the worker why the server won't take it before closing
+	// the connection
+	Reject struct {
+		Reason string
 	}
 
 	Assign struct {
 		Jobs []Job `json:"jobs"`
+		// Targets is the server's policy of the hosts jobs may send to,
+		// the worker checks it again before dialing
+		Targets TargetPolicy `json:"targets"`
+	}
+
+	Alive struct {
+		// Sent is the server's time when the ping was sent
+		Sent time.Time
+		// Offset is the server's estimate of the worker's clock ahead of
+		// its own, the worker uses it to translate server times
+		Offset time.Duration
 	}
 
 	Status struct {
@@ -87,8 +127,26 @@ type (
 		JobQueue []Job
 		// ActiveJobs are the jobs currently being worked
 		ActiveJobs []Job
-		// [JobID]: [StatusCode]count
-		Results map[string]map[int]int
+		// [JobID]: cumulative results of every active job
+		Results map[string]JobResult
+
+		// Ping is the Sent time of the alive the status answers, with the
+		// worker's time it was received and the status replied
+		Ping     time.Time
+		Received time.Time
+		Replied  time.Time
+	}
+
+	Cancel struct {
+		// JobIDs the worker should stop, queued or running
+		JobIDs []string
+		// Reason is recorded in the job's timeline, i.e. cancel or preempt
+		Reason string
+	}
+
+	Update struct {
+		// Jobs with the settings to apply
+		Jobs []Job
 	}
 )
 
@@ -102,6 +160,21 @@ func encode(obj interface{}) ([]byte, error) {
 	return encoded.Bytes(), nil
 }
 
+func (hello *Hello) Encode() (Message, error) {
+	data, err := encode(hello)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MessageTypeHello, Data: data}, nil
+}
+
+func (hello *Hello) Decode(m Message) error {
+	buf := bytes.NewBuffer(m.Data)
+	dec := gob.NewDecoder(buf)
+	err := dec.Decode(hello)
+	return err
+}
+
 func (id *Identify) Encode() (Message, error) {
 	data, err := encode(id)
 	if err != nil {
@@ -132,12 +205,27 @@ func (assign *Assign) Decode(m Message) error {
 	return err
 }
 
+func (alive *Alive) Encode() (Message, error) {
+	data, err := encode(alive)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MessageTypeAlive, Data: data}, nil
+}
+
+func (alive *Alive) Decode(m Message) error {
+	buf := bytes.NewBuffer(m.Data)
+	dec := gob.NewDecoder(buf)
+	err := dec.Decode(alive)
+	return err
+}
+
 func (status *Status) Encode() (Message, error) {
 	data, err := encode(status)
 	if err != nil {
 		return Message{}, err
 	}
-	return Message{Type: MessageTypeAssign, Data: data}, nil
+	return Message{Type: MessageTypeStatus, Data: data}, nil
 }
 
 func (status *Status) Decode(m Message) error {
@@ -146,3 +234,48 @@ func (status *Status) Decode(m Message) error {
 	err := dec.Decode(status)
 	return err
 }
+
+func (cancel *Cancel) Encode() (Message, error) {
+	data, err := encode(cancel)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MessageTypeCancel, Data: data}, nil
+}
+
+func (cancel *Cancel) Decode(m Message) error {
+	buf := bytes.NewBuffer(m.Data)
+	dec := gob.NewDecoder(buf)
+	err := dec.Decode(cancel)
+	return err
+}
+
+func (update *Update) Encode() (Message, error) {
+	data, err := encode(update)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MessageTypeUpdate, Data: data}, nil
+}
+
+func (update *Update) Decode(m Message) error {
+	buf := bytes.NewBuffer(m.Data)
+	dec := gob.NewDecoder(buf)
+	err := dec.Decode(update)
+	return err
+}
+
+func (reject *Reject) Encode() (Message, error) {
+	data, err := encode(reject)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MessageTypeReject, Data: data}, nil
+}
+
+func (reject *Reject) Decode(m Message) error {
+	buf := bytes.NewBuffer(m.Data)
+	dec := gob.NewDecoder(buf)
+	err := dec.Decode(reject)
+	return err
+}
@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMessageReadWrite(t *testing.T) {
@@ -35,6 +36,7 @@ func TestIdentifyEncodeDecode(t *testing.T) {
 	identify := Identify{
 		ID:       "foo",
 		Capacity: 4,
+		Labels:   map[string]string{"zone": "us-east-1a"},
 	}
 	message, err := identify.Encode()
 	if err != nil {
@@ -52,3 +54,71 @@ func TestIdentifyEncodeDecode(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCancelEncodeDecode(t *testing.T) {
+	cancel := Cancel{
+		JobIDs: []string{"foo", "bar"},
+		Reason: "preempt",
+	}
+	message, err := cancel.Encode()
+	if err != nil {
+		t.Fail()
+	}
+	if message.Type != MessageTypeCancel {
+		t.Fail()
+	}
+	var cancel2 Cancel
+	err = cancel2.Decode(message)
+	if err != nil {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(cancel, cancel2) {
+		t.Fail()
+	}
+}
+
+func TestUpdateEncodeDecode(t *testing.T) {
+	update := Update{
+		Jobs: []Job{
+			{ID: "foo", Rate: 50},
+			{ID: "bar", Paused: true},
+		},
+	}
+	message, err := update.Encode()
+	if err != nil {
+		t.Fail()
+	}
+	if message.Type != MessageTypeUpdate {
+		t.Fail()
+	}
+	var update2 Update
+	err = update2.Decode(message)
+	if err != nil {
+		t.Fail()
+	}
+	if !reflect.DeepEqual(update, update2) {
+		t.Fail()
+	}
+}
+
+func TestAliveEncodeDecode(t *testing.T) {
+	alive := Alive{
+		Sent:   time.Now(),
+		Offset: -1500 * time.Millisecond,
+	}
+	message, err := alive.Encode()
+	if err != nil {
+		t.Fail()
+	}
+	if message.Type != MessageTypeAlive {
+		t.Fail()
+	}
+	var alive2 Alive
+	err = alive2.Decode(message)
+	if err != nil {
+		t.Fail()
+	}
+	if !alive.Sent.Equal(alive2.Sent) || alive.Offset != alive2.Offset {
+		t.Fail()
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrTargetDenied is wrapped by the errors of targets the policy denies
+var ErrTargetDenied = errors.New("target denied")
+
+// TargetPolicy is the hosts jobs may send requests to. Each rule is a host,
+// a *.domain pattern that matches its subdomains, or a CIDR of addresses.
+// A denied target is never sent to, and with allow rules only the targets
+// they match are.
+type TargetPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+// Empty reports if the policy allows every target
+func (p TargetPolicy) Empty() bool {
+	return len(p.Allow) == 0 && len(p.Deny) == 0
+}
+
+// Validate checks every rule is a host, a pattern or a CIDR
+func (p TargetPolicy) Validate() error {
+	for _, rule := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if strings.Contains(rule, "/") {
+			if _, _, err := net.ParseCIDR(rule); err != nil {
+				return fmt.Errorf("target rule %q: %w", rule, err)
+			}
+			continue
+		}
+		host := strings.TrimPrefix(rule, "*.")
+		if host == "" || strings.ContainsAny(host, "*:/ ") {
+			return fmt.Errorf("target rule %q isn't a host, *.domain or CIDR", rule)
+		}
+	}
+	return nil
+}
+
+// Check returns why the policy denies the host, if it does. ip is an
+// address the host resolved to, nil before it is resolved; a host that is
+// an address is checked as one. A host only allowed by a CIDR is allowed
+// until it is resolved, its addresses are checked when it is dialed.
+func (p TargetPolicy) Check(host string, ip net.IP) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if addr := net.ParseIP(host); addr != nil {
+		ip = addr
+	}
+	for _, rule := range p.Deny {
+		if matchTarget(rule, host, ip) {
+			return fmt.Errorf("%w: %s matches %s", ErrTargetDenied, target(host, ip), rule)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+
+	cidrs := false
+	for _, rule := range p.Allow {
+		if matchTarget(rule, host, ip) {
+			return nil
+		}
+		cidrs = cidrs || strings.Contains(rule, "/")
+	}
+	if ip == nil && cidrs {
+		return nil
+	}
+	return fmt.Errorf("%w: %s isn't allowed", ErrTargetDenied, target(host, ip))
+}
+
+// matchTarget reports if the rule matches the host's name, or the address
+// it resolved to
+func matchTarget(rule, host string, ip net.IP) bool {
+	if strings.Contains(rule, "/") {
+		_, cidr, err := net.ParseCIDR(rule)
+		return err == nil && ip != nil && cidr.Contains(ip)
+	}
+	return MatchHost(rule, host)
+}
+
+// MatchHost reports if the host is the one of the pattern, or with a
+// *.domain pattern, one of its subdomains
+func MatchHost(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if suffix := strings.TrimPrefix(pattern, "*"); suffix != pattern {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return pattern == host
+}
+
+func target(host string, ip net.IP) string {
+	if ip == nil || ip.String() == host {
+		return host
+	}
+	return fmt.Sprintf("%s (%s)", host, ip)
+}
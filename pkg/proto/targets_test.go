@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package proto
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTargetPolicy(t *testing.T) {
+	p := TargetPolicy{
+		Allow: []string{"*.staging.example.com", "api.example.com", "10.0.0.0/8"},
+		Deny:  []string{"db.staging.example.com", "10.1.0.0/16"},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		host    string
+		ip      string
+		allowed bool
+	}{
+		{"web.staging.example.com", "", true},
+		{"WEB.Staging.example.com.", "", true},
+		{"staging.example.com", "192.0.2.1", false},
+		{"api.example.com", "", true},
+		{"db.staging.example.com", "", false},
+		{"evil.com", "", true}, // allowed until it resolves
+		{"evil.com", "93.184.216.34", false},
+		{"internal.corp", "10.2.3.4", true},
+		{"web.staging.example.com", "10.1.2.3", false},
+		{"10.2.3.4", "", true},
+		{"10.1.2.3", "", false},
+	} {
+		err := p.Check(tc.host, net.ParseIP(tc.ip))
+		if (err == nil) != tc.allowed {
+			t.Errorf("%s %s: allowed %v, want %v: %v", tc.host, tc.ip, err == nil, tc.allowed, err)
+		}
+		if err != nil && !errors.Is(err, ErrTargetDenied) {
+			t.Errorf("%s: %v isn't ErrTargetDenied", tc.host, err)
+		}
+	}
+
+	// without CIDRs a name must be allowed before it resolves
+	p = TargetPolicy{Allow: []string{"localhost"}}
+	if err := p.Check("example.com", nil); err == nil {
+		t.Error("example.com allowed")
+	}
+	if err := (TargetPolicy{}).Check("example.com", nil); err != nil {
+		t.Errorf("empty policy: %v", err)
+	}
+
+	for _, rule := range []string{"10.0.0.0/33", "*", "a.*.com", "host:80"} {
+		if err := (TargetPolicy{Deny: []string{rule}}).Validate(); err == nil {
+			t.Errorf("rule %q accepted", rule)
+		}
+	}
+}
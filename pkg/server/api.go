@@ -0,0 +1,703 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/google/uuid"
+)
+
+const (
+	// API_PREFIX is the path the versioned API is served under
+	API_PREFIX = "/api/v1"
+	// maxBodySize of API requests, bytes
+	maxBodySize = 1 << 20
+)
+
+// Codes of API errors
+const (
+	ErrCodeInvalidJSON          = "invalid_json"
+	ErrCodeInvalidField         = "invalid_field"
+	ErrCodeNotFound             = "not_found"
+	ErrCodeConflict             = "conflict"
+	ErrCodeIdempotencyConflict  = "idempotency_conflict"
+	ErrCodeMethodNotAllowed     = "method_not_allowed"
+	ErrCodeNotAcceptable        = "not_acceptable"
+	ErrCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrCodeUnauthorized         = "unauthorized"
+	ErrCodeForbidden            = "forbidden"
+	ErrCodeTargetDenied         = "target_denied"
+	ErrCodeHostRateExceeded     = "host_rate_exceeded"
+	ErrCodeNoLeader             = "no_leader"
+	ErrCodeInternal             = "internal"
+)
+
+// APIError is the body of a failed API request, Field is the request field
+// at fault, i.e. job.url
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func apiError(status int, code, format string, args ...interface{}) *APIError {
+	return &APIError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func fieldError(field, format string, args ...interface{}) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: ErrCodeInvalidField, Message: fmt.Sprintf(format, args...), Field: field}
+}
+
+// apiHandler serves a route with the parameters of its path
+type apiHandler func(rw http.ResponseWriter, req *http.Request, params map[string]string)
+
+// apiRoute is a method and a path of the API, {name} segments of the path
+// are parameters. Routes respond with JSON unless they produce another
+// media type, and serve callers with at least the route's role.
+type apiRoute struct {
+	method   string
+	pattern  []string
+	produces string
+	role     auth.Role
+	handle   apiHandler
+}
+
+// apiRouter routes API requests by method and path and only speaks JSON
+type apiRouter struct {
+	routes []apiRoute
+}
+
+func (a *apiRouter) add(method, pattern string, role auth.Role, h apiHandler) {
+	a.addProducing(method, pattern, "application/json", role, h)
+}
+
+func (a *apiRouter) addProducing(method, pattern, produces string, role auth.Role, h apiHandler) {
+	a.routes = append(a.routes, apiRoute{method: method, pattern: splitPath(pattern), produces: produces, role: role, handle: h})
+}
+
+func (a *apiRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	segments := splitPath(strings.TrimPrefix(req.URL.EscapedPath(), API_PREFIX))
+	allowed := []string{}
+	for _, route := range a.routes {
+		params, ok := matchPath(route.pattern, segments)
+		if !ok {
+			continue
+		}
+		if route.method == req.Method {
+			if err := authorize(req, route.role); err != nil {
+				writeError(rw, err)
+				return
+			}
+			if !accepts(req.Header.Get("Accept"), route.produces) {
+				writeError(rw, apiError(http.StatusNotAcceptable, ErrCodeNotAcceptable, "responses are %s", route.produces))
+				return
+			}
+			route.handle(rw, req, params)
+			return
+		}
+		allowed = append(allowed, route.method)
+	}
+
+	if len(allowed) > 0 {
+		rw.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(rw, apiError(http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "%s is not allowed on %s", req.Method, req.URL.Path))
+		return
+	}
+	writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "no route for %s", req.URL.Path))
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func matchPath(pattern, segments []string) (map[string]string, bool) {
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, p := range pattern {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			v, err := url.PathUnescape(segments[i])
+			if err != nil || v == "" {
+				return nil, false
+			}
+			params[p[1:len(p)-1]] = v
+			continue
+		}
+		if p != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// accepts reports if the Accept header allows a response of the media
+// type, no header accepts anything
+func accepts(accept, produces string) bool {
+	if accept == "" {
+		return true
+	}
+	kind, _, _ := strings.Cut(produces, "/")
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case produces, kind + "/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		b, _ = json.Marshal(map[string]*APIError{"error": apiError(status, ErrCodeInternal, "encoding the response: %s", err)})
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(status)
+	rw.Write(append(b, '\n'))
+}
+
+func writeError(rw http.ResponseWriter, err *APIError) {
+	writeJSON(rw, err.Status, map[string]*APIError{"error": err})
+}
+
+// emptyBody reports if the request has no body, a body is left to be read
+func emptyBody(req *http.Request) bool {
+	br := bufio.NewReader(req.Body)
+	if _, err := br.Peek(1); err == io.EOF {
+		return true
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, req.Body}
+	return false
+}
+
+// decodeJSON reads the JSON body into v, fields v doesn't have are an error
+func decodeJSON(rw http.ResponseWriter, req *http.Request, v interface{}) *APIError {
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType != "application/json" {
+			return apiError(http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, "request body must be application/json, not %s", ct)
+		}
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("body must be a single JSON object")
+	}
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == io.EOF:
+		return apiError(http.StatusBadRequest, ErrCodeInvalidJSON, "request body is empty")
+	case errors.As(err, &typeErr):
+		return fieldError(typeErr.Field, "%s must be a %s", typeErr.Field, typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return fieldError(field, "unknown field %s", field)
+	}
+	return apiError(http.StatusBadRequest, ErrCodeInvalidJSON, "invalid JSON: %s", err)
+}
+
+// validateJob checks the job as submitted, field names are under prefix
+func validateJob(j proto.Job, prefix string) *APIError {
+	if j.ID != "" && strings.ContainsAny(j.ID, "/ \t\n") {
+		return fieldError(prefix+"id", "id must have no spaces or slashes")
+	}
+	if j.URL == "" {
+		return fieldError(prefix+"url", "url is required")
+	}
+	u, err := url.ParseRequestURI(j.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fieldError(prefix+"url", "url must be an absolute http or https URL")
+	}
+	if j.Req < 1 {
+		return fieldError(prefix+"req", "req must be at least 1")
+	}
+	for _, f := range []struct {
+		name  string
+		value int
+	}{{"rate", j.Rate}, {"concurrency", j.Concurrency}, {"duration", j.Duration}, {"workers", j.Workers}} {
+		if f.value < 0 {
+			return fieldError(prefix+f.name, "%s must not be negative", f.name)
+		}
+	}
+	if j.Workers > j.Req {
+		return fieldError(prefix+"workers", "workers must be at most req")
+	}
+	if err := validateLimits(j.Rate, j.Concurrency, prefix); err != nil {
+		return err
+	}
+	if j.Parent != "" || j.Shard != 0 {
+		return fieldError(prefix+"parent", "parent and shard are set by the server")
+	}
+	return nil
+}
+
+// validateLimits checks the rate and concurrency are within what a worker
+// can run
+func validateLimits(rate, concurrency int, prefix string) *APIError {
+	if rate > proto.MAX_RATE {
+		return fieldError(prefix+"rate", "rate must be at most %d", proto.MAX_RATE)
+	}
+	if concurrency > proto.MAX_CONCURRENCY {
+		return fieldError(prefix+"concurrency", "concurrency must be at most %d", proto.MAX_CONCURRENCY)
+	}
+	return nil
+}
+
+// validateUpdate checks the settings a job update changes
+func validateUpdate(u proto.JobUpdate) *APIError {
+	rate, concurrency := 0, 0
+	if u.Rate != nil {
+		rate = *u.Rate
+	}
+	if u.Concurrency != nil {
+		concurrency = *u.Concurrency
+	}
+	if rate < 0 {
+		return fieldError("rate", "rate must not be negative")
+	}
+	if concurrency < 0 {
+		return fieldError("concurrency", "concurrency must not be negative")
+	}
+	return validateLimits(rate, concurrency, "")
+}
+
+// APIHandler serves the versioned API under API_PREFIX
+func (r *runtime) APIHandler() http.Handler {
+	a := &apiRouter{}
+	a.add(http.MethodGet, "/jobs", auth.RoleViewer, r.apiListJobs)
+	a.add(http.MethodPost, "/jobs", auth.RoleSubmitter, r.apiCreateJob)
+	a.add(http.MethodGet, "/jobs/{id}", auth.RoleViewer, r.apiGetJob)
+	a.add(http.MethodPatch, "/jobs/{id}", auth.RoleSubmitter, r.apiUpdateJob)
+	a.add(http.MethodDelete, "/jobs/{id}", auth.RoleSubmitter, r.apiCancelJob)
+	a.add(http.MethodGet, "/jobs/{id}/report", auth.RoleViewer, r.apiJobReport)
+	a.addProducing(http.MethodGet, "/jobs/{id}/events", "text/event-stream", auth.RoleViewer, r.apiJobEvents)
+	a.add(http.MethodGet, "/workers", auth.RoleViewer, r.apiListWorkers)
+	a.add(http.MethodGet, "/namespaces", auth.RoleViewer, r.apiListNamespaces)
+	a.add(http.MethodGet, "/schedules", auth.RoleViewer, r.apiListSchedules)
+	a.add(http.MethodPost, "/schedules", auth.RoleSubmitter, r.apiCreateSchedule)
+	a.add(http.MethodGet, "/schedules/{id}", auth.RoleViewer, r.apiGetSchedule)
+	a.add(http.MethodPatch, "/schedules/{id}", auth.RoleSubmitter, r.apiUpdateSchedule)
+	a.add(http.MethodDelete, "/schedules/{id}", auth.RoleSubmitter, r.apiDeleteSchedule)
+	a.add(http.MethodGet, "/suites", auth.RoleViewer, r.apiListSuites)
+	a.add(http.MethodPost, "/suites", auth.RoleSubmitter, r.apiCreateSuite)
+	a.add(http.MethodGet, "/suites/{id}", auth.RoleViewer, r.apiGetSuite)
+	a.add(http.MethodDelete, "/suites/{id}", auth.RoleSubmitter, r.apiCancelSuite)
+	a.add(http.MethodGet, "/stop", auth.RoleViewer, r.apiStopStatus)
+	a.add(http.MethodPost, "/stop", auth.RoleAdmin, r.apiStopAll)
+	a.add(http.MethodDelete, "/stop", auth.RoleAdmin, r.apiResume)
+	a.add(http.MethodGet, "/leader", auth.RoleViewer, r.apiLeader)
+	return r.Authenticate(a.ServeHTTP)
+}
+
+func (r *runtime) apiListJobs(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	states := []JobState{}
+	for _, v := range req.URL.Query()["state"] {
+		for _, state := range strings.Split(v, ",") {
+			if _, ok := jobStateOrder[JobState(state)]; !ok {
+				writeError(rw, fieldError("state", "unknown job state %q", state))
+				return
+			}
+			states = append(states, JobState(state))
+		}
+	}
+	writeJSON(rw, http.StatusOK, visibleJobs(req, r.ListJobs(states...)))
+}
+
+func (r *runtime) apiCreateJob(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	var j proto.Job
+	if err := decodeJSON(rw, req, &j); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if err := validateJob(j, ""); err != nil {
+		writeError(rw, err)
+		return
+	}
+	ns, apiErr := submitNamespace(req, j.Namespace, "namespace")
+	if apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	j.Namespace = ns
+	if err := r.fitsQuota(j, ""); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if err := r.checkTarget(j, ""); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if err := r.fitsHostRate(j, ""); err != nil {
+		writeError(rw, err)
+		return
+	}
+	j.SubmittedBy = r.submitter(req)
+	key := req.Header.Get("Idempotency-Key")
+	if len(key) > 255 {
+		writeError(rw, fieldError("Idempotency-Key", "Idempotency-Key must be at most 255 characters"))
+		return
+	}
+
+	id, repeat, err := r.SubmitJob(j, key)
+	switch {
+	case errors.Is(err, ErrIdempotencyConflict):
+		writeError(rw, apiError(http.StatusConflict, ErrCodeIdempotencyConflict, "Idempotency-Key %s was used for a different payload", key))
+		return
+	case errors.Is(err, ErrJobExists):
+		writeError(rw, apiError(http.StatusConflict, ErrCodeConflict, "job %s exists", id))
+		return
+	case err != nil:
+		writeError(rw, apiError(http.StatusInternalServerError, ErrCodeInternal, "%s", err))
+		return
+	}
+
+	js, _ := r.GetJob(id)
+	rw.Header().Set("Location", API_PREFIX+"/jobs/"+url.PathEscape(id))
+	if repeat {
+		// the job of the first submission
+		rw.Header().Set("Idempotent-Replayed", "true")
+		writeJSON(rw, http.StatusOK, js)
+		return
+	}
+	writeJSON(rw, http.StatusCreated, js)
+}
+
+func (r *runtime) apiGetJob(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	js, ok := r.visibleJob(req, params["id"])
+	if !ok {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "job %s not found", params["id"]))
+		return
+	}
+	writeJSON(rw, http.StatusOK, js)
+}
+
+func (r *runtime) apiUpdateJob(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	var u proto.JobUpdate
+	if err := decodeJSON(rw, req, &u); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if err := validateUpdate(u); err != nil {
+		writeError(rw, err)
+		return
+	}
+	u.ID = params["id"]
+	if err := r.mayChangeJob(req, u.ID); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if err := r.fitsUpdate(u); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	if !r.UpdateJob(u) {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "job %s not found or finished", u.ID))
+		return
+	}
+	js, _ := r.GetJob(u.ID)
+	writeJSON(rw, http.StatusOK, js)
+}
+
+func (r *runtime) apiCancelJob(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	if err := r.mayChangeJob(req, params["id"]); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if !r.CancelJob(params["id"]) {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "job %s not found or finished", params["id"]))
+		return
+	}
+	js, _ := r.GetJob(params["id"])
+	writeJSON(rw, http.StatusAccepted, js)
+}
+
+func (r *runtime) apiJobReport(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	_, visible := r.visibleJob(req, params["id"])
+	report, ok := r.JobReport(params["id"])
+	if !ok || !visible {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "job %s not found", params["id"]))
+		return
+	}
+	writeJSON(rw, http.StatusOK, report)
+}
+
+func (r *runtime) apiListWorkers(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	writeJSON(rw, http.StatusOK, r.ListWorkers())
+}
+
+func (r *runtime) apiListNamespaces(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	filter := inNamespaces(req)
+	namespaces := []NamespaceStatus{}
+	for _, ns := range r.ListNamespaces() {
+		if filter(ns.Name) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	writeJSON(rw, http.StatusOK, namespaces)
+}
+
+func (r *runtime) apiListSchedules(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	writeJSON(rw, http.StatusOK, visibleSchedules(req, r.ListSchedules()))
+}
+
+func (r *runtime) apiCreateSchedule(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	var spec ScheduleSpec
+	if err := decodeJSON(rw, req, &spec); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if spec.ID == "" {
+		spec.ID = uuid.NewString()
+	}
+	// the job ID is set for each run
+	spec.Job.ID = ""
+	if err := validateJob(spec.Job, "job."); err != nil {
+		writeError(rw, err)
+		return
+	}
+	ns, apiErr := submitNamespace(req, spec.Job.Namespace, "job.namespace")
+	if apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	spec.Job.Namespace = ns
+	if err := r.fitsQuota(spec.Job, "job."); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if err := r.checkTarget(spec.Job, "job."); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if err := r.fitsHostRate(spec.Job, "job."); err != nil {
+		writeError(rw, err)
+		return
+	}
+	spec.Job.SubmittedBy = r.submitter(req)
+
+	s, err := NewSchedule(spec.ID, spec.Cron, spec.Job, spec.Suspended)
+	if err != nil {
+		writeError(rw, fieldError("cron", "%s", err))
+		return
+	}
+	if !r.AddSchedule(s) {
+		writeError(rw, apiError(http.StatusConflict, ErrCodeConflict, "schedule %s exists", s.ID))
+		return
+	}
+	status, _ := r.GetSchedule(s.ID)
+	rw.Header().Set("Location", API_PREFIX+"/schedules/"+url.PathEscape(s.ID))
+	writeJSON(rw, http.StatusCreated, status)
+}
+
+func (r *runtime) apiGetSchedule(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	s, ok := r.GetSchedule(params["id"])
+	if !ok || !visible(req, s.Job.Namespace) {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "schedule %s not found", params["id"]))
+		return
+	}
+	writeJSON(rw, http.StatusOK, s)
+}
+
+func (r *runtime) apiUpdateSchedule(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	var u ScheduleUpdate
+	if err := decodeJSON(rw, req, &u); err != nil {
+		writeError(rw, err)
+		return
+	}
+	u.ID = params["id"]
+	if err := r.mayChangeSchedule(req, u.ID); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	ok, err := r.UpdateSchedule(u)
+	if !ok {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "schedule %s not found", u.ID))
+		return
+	}
+	if err != nil {
+		writeError(rw, fieldError("cron", "%s", err))
+		return
+	}
+	s, _ := r.GetSchedule(u.ID)
+	writeJSON(rw, http.StatusOK, s)
+}
+
+func (r *runtime) apiDeleteSchedule(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	if err := r.mayChangeSchedule(req, params["id"]); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if !r.DeleteSchedule(params["id"]) {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "schedule %s not found", params["id"]))
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (r *runtime) apiListSuites(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	writeJSON(rw, http.StatusOK, visibleSuites(req, r.ListSuites()))
+}
+
+func (r *runtime) apiCreateSuite(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	var spec SuiteSpec
+	if err := decodeJSON(rw, req, &spec); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if spec.ID == "" {
+		spec.ID = uuid.NewString()
+	}
+	ns, apiErr := submitNamespace(req, spec.Namespace, "namespace")
+	if apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	spec.Namespace = ns
+	for _, phase := range []struct {
+		name  string
+		steps []SuiteStep
+	}{{"setup", spec.Setup}, {"steps", spec.Steps}, {"teardown", spec.Teardown}} {
+		for i, step := range phase.steps {
+			// the job ID is set from the suite and step
+			step.Job.ID = ""
+			prefix := fmt.Sprintf("%s[%d].job.", phase.name, i)
+			if err := validateJob(step.Job, prefix); err != nil {
+				writeError(rw, err)
+				return
+			}
+			if step.Job.Namespace != "" && step.Job.Namespace != ns {
+				writeError(rw, fieldError(prefix+"namespace", "steps are in the suite's namespace %s", ns))
+				return
+			}
+			step.Job.Namespace = ns
+			if err := r.fitsQuota(step.Job, prefix); err != nil {
+				writeError(rw, err)
+				return
+			}
+			if err := r.checkTarget(step.Job, prefix); err != nil {
+				writeError(rw, err)
+				return
+			}
+			if err := r.fitsHostRate(step.Job, prefix); err != nil {
+				writeError(rw, err)
+				return
+			}
+		}
+	}
+
+	s, err := NewSuite(spec)
+	if err != nil {
+		writeError(rw, fieldError("steps", "%s", err))
+		return
+	}
+	s.submittedBy(r.submitter(req))
+	if !r.AddSuite(s) {
+		writeError(rw, apiError(http.StatusConflict, ErrCodeConflict, "suite %s exists", s.ID))
+		return
+	}
+	status, _ := r.GetSuite(s.ID)
+	rw.Header().Set("Location", API_PREFIX+"/suites/"+url.PathEscape(s.ID))
+	writeJSON(rw, http.StatusCreated, status)
+}
+
+func (r *runtime) apiGetSuite(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	s, ok := r.GetSuite(params["id"])
+	if !ok || !visible(req, s.Namespace) {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "suite %s not found", params["id"]))
+		return
+	}
+	writeJSON(rw, http.StatusOK, s)
+}
+
+func (r *runtime) apiCancelSuite(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	if err := r.mayChangeSuite(req, params["id"]); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if !r.CancelSuite(params["id"]) {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "suite %s not found", params["id"]))
+		return
+	}
+	s, _ := r.GetSuite(params["id"])
+	writeJSON(rw, http.StatusAccepted, s)
+}
+
+func (r *runtime) apiStopStatus(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	writeJSON(rw, http.StatusOK, r.StopStatus())
+}
+
+func (r *runtime) apiStopAll(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	if err := mayStop(req); err != nil {
+		writeError(rw, err)
+		return
+	}
+	// the reason is optional, a stop doesn't need a body
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if !emptyBody(req) {
+		if err := decodeJSON(rw, req, &body); err != nil {
+			writeError(rw, err)
+			return
+		}
+	}
+	writeJSON(rw, http.StatusOK, r.StopAll(r.stopCaller(req), body.Reason))
+}
+
+func (r *runtime) apiResume(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	if err := mayStop(req); err != nil {
+		writeError(rw, err)
+		return
+	}
+	stop, ok := r.Resume(r.stopCaller(req))
+	if !ok {
+		writeError(rw, apiError(http.StatusConflict, ErrCodeConflict, "the scheduler isn't stopped"))
+		return
+	}
+	writeJSON(rw, http.StatusOK, stop)
+}
+
+func (r *runtime) apiLeader(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	writeJSON(rw, http.StatusOK, r.LeaderStatus())
+}
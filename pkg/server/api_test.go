@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/rs/zerolog"
+)
+
+func apiRequest(h http.Handler, method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestAPIErrors(t *testing.T) {
+	api := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).APIHandler()
+
+	for name, tc := range map[string]struct {
+		method, path, body string
+		header             map[string]string
+		status             int
+		code, field        string
+	}{
+		"missing url":     {"POST", "/api/v1/jobs", `{"req": 10}`, nil, 400, ErrCodeInvalidField, "url"},
+		"negative req":    {"POST", "/api/v1/jobs", `{"url": "http://localhost", "req": -1}`, nil, 400, ErrCodeInvalidField, "req"},
+		"unknown field":   {"POST", "/api/v1/jobs", `{"url": "http://localhost", "req": 1, "reqs": 2}`, nil, 400, ErrCodeInvalidField, "reqs"},
+		"wrong type":      {"POST", "/api/v1/jobs", `{"url": "http://localhost", "req": "1"}`, nil, 400, ErrCodeInvalidField, "req"},
+		"invalid json":    {"POST", "/api/v1/jobs", `{"url"`, nil, 400, ErrCodeInvalidJSON, ""},
+		"empty body":      {"POST", "/api/v1/jobs", ``, nil, 400, ErrCodeInvalidJSON, ""},
+		"media type":      {"POST", "/api/v1/jobs", `{}`, map[string]string{"Content-Type": "text/plain"}, 415, ErrCodeUnsupportedMediaType, ""},
+		"not acceptable":  {"GET", "/api/v1/jobs", ``, map[string]string{"Accept": "text/html"}, 406, ErrCodeNotAcceptable, ""},
+		"unknown job":     {"GET", "/api/v1/jobs/a", ``, nil, 404, ErrCodeNotFound, ""},
+		"unknown route":   {"GET", "/api/v1/nope", ``, nil, 404, ErrCodeNotFound, ""},
+		"method":          {"PUT", "/api/v1/jobs/a", ``, nil, 405, ErrCodeMethodNotAllowed, ""},
+		"step job":        {"POST", "/api/v1/suites", `{"steps": [{"name": "a", "job": {"req": 1}}]}`, nil, 400, ErrCodeInvalidField, "steps[0].job.url"},
+		"schedule cron":   {"POST", "/api/v1/schedules", `{"cron": "* *", "job": {"url": "http://localhost", "req": 1}}`, nil, 400, ErrCodeInvalidField, "cron"},
+		"negative update": {"PATCH", "/api/v1/jobs/a", `{"rate": -1}`, nil, 400, ErrCodeInvalidField, "rate"},
+	} {
+		rw := apiRequest(api, tc.method, tc.path, tc.body, tc.header)
+		var body struct {
+			Error APIError `json:"error"`
+		}
+		json.Unmarshal(rw.Body.Bytes(), &body)
+		if rw.Code != tc.status || body.Error.Code != tc.code || body.Error.Field != tc.field {
+			t.Errorf("%s: %d %s, expected %d %s %s", name, rw.Code, rw.Body.String(), tc.status, tc.code, tc.field)
+		}
+	}
+}
+
+func TestAPICreateJob(t *testing.T) {
+	api := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).APIHandler()
+
+	rw := apiRequest(api, "POST", "/api/v1/jobs", `{"id": "a", "url": "http://localhost", "req": 10}`, map[string]string{"Content-Type": "application/json"})
+	if rw.Code != http.StatusCreated || rw.Header().Get("Location") != "/api/v1/jobs/a" {
+		t.Fatalf("%d %v %s", rw.Code, rw.Header(), rw.Body.String())
+	}
+	var js JobStatus
+	if err := json.Unmarshal(rw.Body.Bytes(), &js); err != nil || js.Job.ID != "a" || js.State != JobStateQueued {
+		t.Errorf("created %s, %v", rw.Body.String(), err)
+	}
+
+	rw = apiRequest(api, "POST", "/api/v1/jobs", `{"id": "a", "url": "http://localhost", "req": 20}`, nil)
+	if rw.Code != http.StatusConflict {
+		t.Errorf("duplicate job %d %s", rw.Code, rw.Body.String())
+	}
+	rw = apiRequest(api, "GET", "/api/v1/jobs/a", ``, map[string]string{"Accept": "text/html, application/json;q=0.9"})
+	if rw.Code != http.StatusOK {
+		t.Errorf("get job %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestAPIIdempotentCreate(t *testing.T) {
+	api := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).APIHandler()
+	key := map[string]string{"Idempotency-Key": "k1"}
+
+	first := apiRequest(api, "POST", "/api/v1/jobs", `{"url": "http://localhost", "req": 10}`, key)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("%d %s", first.Code, first.Body.String())
+	}
+	repeat := apiRequest(api, "POST", "/api/v1/jobs", `{"url": "http://localhost", "req": 10}`, key)
+	if repeat.Code != http.StatusOK || repeat.Header().Get("Location") != first.Header().Get("Location") || repeat.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("repeat %d %v, first at %s", repeat.Code, repeat.Header(), first.Header().Get("Location"))
+	}
+	rw := apiRequest(api, "POST", "/api/v1/jobs", `{"url": "http://localhost", "req": 11}`, key)
+	if rw.Code != http.StatusConflict || !strings.Contains(rw.Body.String(), ErrCodeIdempotencyConflict) {
+		t.Errorf("different job under the key %d %s", rw.Code, rw.Body.String())
+	}
+	if id := strings.TrimPrefix(first.Header().Get("Location"), API_PREFIX+"/jobs/"); strings.Contains(rw.Body.String(), id) {
+		t.Errorf("conflict shows the key's job %s", rw.Body.String())
+	}
+	// keys are scoped to the namespace
+	if rw = apiRequest(api, "POST", "/api/v1/jobs", `{"url": "http://localhost", "req": 11, "namespace": "other"}`, key); rw.Code != http.StatusCreated {
+		t.Errorf("key in another namespace %d %s", rw.Code, rw.Body.String())
+	}
+
+	// without a key, the client's job ID identifies the submission
+	apiRequest(api, "POST", "/api/v1/jobs", `{"id": "b", "url": "http://localhost", "req": 10}`, nil)
+	if rw = apiRequest(api, "POST", "/api/v1/jobs", `{"id": "b", "url": "http://localhost", "req": 10}`, nil); rw.Code != http.StatusOK {
+		t.Errorf("repeat of job b %d %s", rw.Code, rw.Body.String())
+	}
+
+	// a repeat after the window is a new submission
+	window := IDEMPOTENCY_WINDOW
+	IDEMPOTENCY_WINDOW = 0
+	defer func() { IDEMPOTENCY_WINDOW = window }()
+	if rw = apiRequest(api, "POST", "/api/v1/jobs", `{"url": "http://localhost", "req": 10}`, key); rw.Code != http.StatusCreated {
+		t.Errorf("repeat after the window %d %s", rw.Code, rw.Body.String())
+	}
+	if rw = apiRequest(api, "POST", "/api/v1/jobs", `{"id": "b", "url": "http://localhost", "req": 10}`, nil); rw.Code != http.StatusConflict {
+		t.Errorf("repeat of job b after the window %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestAPIAuthorization(t *testing.T) {
+	tokens := auth.StaticTokens{
+		"v": {Name: "vera", Role: auth.RoleViewer},
+		"s": {Name: "sam", Role: auth.RoleSubmitter},
+		"o": {Name: "olu", Role: auth.RoleSubmitter},
+		"a": {Name: "ada", Role: auth.RoleAdmin},
+	}
+	api := NewRuntime(testMetrics{}, zerolog.Nop(), Config{Auth: tokens}).APIHandler()
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	// in order, the job is submitted before it is changed
+	for _, tc := range []struct {
+		name, method, path, body string
+		header                   map[string]string
+		status                   int
+	}{
+		{"no token", "GET", "/api/v1/jobs", ``, nil, 401},
+		{"unknown token", "GET", "/api/v1/jobs", ``, bearer("x"), 401},
+		{"viewer reads", "GET", "/api/v1/jobs", ``, bearer("v"), 200},
+		{"viewer submits", "POST", "/api/v1/jobs", `{"url": "http://localhost", "req": 1}`, bearer("v"), 403},
+		{"submitter", "POST", "/api/v1/jobs", `{"id": "a", "url": "http://localhost", "req": 1}`, bearer("s"), 201},
+		{"other submitter", "DELETE", "/api/v1/jobs/a", ``, bearer("o"), 403},
+		{"owner", "PATCH", "/api/v1/jobs/a", `{"rate": 5}`, bearer("s"), 200},
+		{"admin", "DELETE", "/api/v1/jobs/a", ``, bearer("a"), 202},
+	} {
+		rw := apiRequest(api, tc.method, tc.path, tc.body, tc.header)
+		if rw.Code != tc.status {
+			t.Errorf("%s: %d %s, expected %d", tc.name, rw.Code, rw.Body.String(), tc.status)
+		}
+	}
+
+	rw := apiRequest(api, "GET", "/api/v1/jobs/a", ``, bearer("v"))
+	var js JobStatus
+	if err := json.Unmarshal(rw.Body.Bytes(), &js); err != nil || js.Job.SubmittedBy != "sam" {
+		t.Errorf("job submitted by %q, %v", js.Job.SubmittedBy, err)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/google/uuid"
+)
+
+const (
+	// identityHeader carries the caller's identity from a follower to the
+	// leader, signed with the secret the servers share in the store
+	identityHeader = "X-Peltr-Identity"
+	// peerSecretLease holds the shared secret, it never expires
+	peerSecretLease = "peer-secret"
+	peerSecretTTL   = 100 * 365 * 24 * time.Hour
+	// forwardedIdentityTTL is how long a forwarded identity is valid
+	forwardedIdentityTTL = time.Minute
+)
+
+// errNoPeers is a forwarded identity sent to a server without a store,
+// there are no other servers to forward it
+var errNoPeers = fmt.Errorf("%w: no servers share a store with this one", auth.ErrInvalidCredentials)
+
+// Authenticate identifies the caller of the request and passes it on with
+// the identity in its context. Invalid credentials are rejected, a request
+// without any is passed on without a role. Every caller is an admin when
+// the server has no authenticator.
+func (r *runtime) Authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		id, err := r.identify(req)
+		if err != nil {
+			r.unauthorized(rw, req, err)
+			return
+		}
+		h(rw, req.WithContext(auth.WithIdentity(req.Context(), id)))
+	}
+}
+
+// identify authenticates the caller, by the identity a follower forwarded
+// or by its credentials
+func (r *runtime) identify(req *http.Request) (auth.Identity, error) {
+	if r.config.Auth == nil {
+		return auth.Anonymous, nil
+	}
+	if token := req.Header.Get(identityHeader); token != "" {
+		return r.verifyForwarded(token)
+	}
+	id, _, err := r.config.Auth.Authenticate(req)
+	return id, err
+}
+
+func (r *runtime) unauthorized(rw http.ResponseWriter, req *http.Request, err error) {
+	r.log.Debug().Err(err).Str("remote", req.RemoteAddr).Msg("authentication failed")
+	rw.Header().Set("WWW-Authenticate", `Bearer realm="peltr"`)
+	writeError(rw, apiError(http.StatusUnauthorized, ErrCodeUnauthorized, "%s", err))
+}
+
+// Authorize serves the request if the caller reads with at least the
+// viewer role, or changes something with at least the submitter role
+func (r *runtime) Authorize(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		role := auth.RoleSubmitter
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			role = auth.RoleViewer
+		}
+		if err := authorize(req, role); err != nil {
+			writeError(rw, err)
+			return
+		}
+		h(rw, req)
+	}
+}
+
+// authorize checks the caller has the role
+func authorize(req *http.Request, role auth.Role) *APIError {
+	id := auth.FromContext(req.Context())
+	if id.Role >= role {
+		return nil
+	}
+	if id.Name == "" {
+		return apiError(http.StatusUnauthorized, ErrCodeUnauthorized, "authentication required")
+	}
+	return apiError(http.StatusForbidden, ErrCodeForbidden, "%s is a %s, %s %s needs the %s role", id.Name, id.Role, req.Method, req.URL.Path, role)
+}
+
+// mayChange checks the caller may change or cancel what the submitter
+// submitted: admins may change anything, others only their own
+func mayChange(req *http.Request, kind, resource, submitter string) *APIError {
+	id := auth.FromContext(req.Context())
+	if id.Role >= auth.RoleAdmin || (id.Role >= auth.RoleSubmitter && id.Name == submitter) {
+		return nil
+	}
+	return apiError(http.StatusForbidden, ErrCodeForbidden, "%s %s was submitted by %s, only they or an admin may change it", kind, resource, submitter)
+}
+
+// submitter is the name jobs are recorded as submitted by, none when
+// authentication is off
+func (r *runtime) submitter(req *http.Request) string {
+	if r.config.Auth == nil {
+		return ""
+	}
+	return auth.FromContext(req.Context()).Name
+}
+
+// forwardIdentity authenticates the caller and signs its identity for the
+// leader, the leader can't see the caller's client certificate
+func (r *runtime) forwardIdentity(req *http.Request) error {
+	if r.config.Auth == nil {
+		return nil
+	}
+	id, err := r.identify(req)
+	req.Header.Del(identityHeader)
+	if err != nil || id.Role == auth.RoleNone {
+		return err
+	}
+	secret, err := r.peerSecret()
+	if err != nil {
+		return err
+	}
+	token, err := auth.HMACTokens{Secret: secret}.Sign(id, forwardedIdentityTTL)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(identityHeader, token)
+	return nil
+}
+
+func (r *runtime) verifyForwarded(token string) (auth.Identity, error) {
+	secret, err := r.peerSecret()
+	if err != nil {
+		return auth.Identity{}, err
+	}
+	return auth.HMACTokens{Secret: secret, Method: "forwarded"}.Verify(token, time.Now())
+}
+
+// peerSecret is the secret the servers sharing the store sign forwarded
+// identities with, the first server to ask for it creates it
+func (r *runtime) peerSecret() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.secret != nil {
+		return r.secret, nil
+	}
+	if r.store == nil {
+		return nil, errNoPeers
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	// a holder of its own takes the lease only if nobody has it
+	lease, err := r.store.Acquire(peerSecretLease, uuid.NewString(), secret, peerSecretTTL)
+	if err != nil {
+		return nil, err
+	}
+	r.secret = lease.Value
+	return r.secret, nil
+}
+
+// mayChangeJob checks the caller may change the job, a job that doesn't
+// exist is left to the handler. A job in a namespace the caller can't see
+// is not found.
+func (r *runtime) mayChangeJob(req *http.Request, id string) *APIError {
+	js, ok := r.GetJob(id)
+	if !ok {
+		return nil
+	}
+	if !visible(req, js.Job.Namespace) {
+		return apiError(http.StatusNotFound, ErrCodeNotFound, "job %s not found", id)
+	}
+	return mayChange(req, "job", id, js.Job.SubmittedBy)
+}
+
+func (r *runtime) mayChangeSchedule(req *http.Request, id string) *APIError {
+	s, ok := r.GetSchedule(id)
+	if !ok {
+		return nil
+	}
+	if !visible(req, s.Job.Namespace) {
+		return apiError(http.StatusNotFound, ErrCodeNotFound, "schedule %s not found", id)
+	}
+	return mayChange(req, "schedule", id, s.Job.SubmittedBy)
+}
+
+func (r *runtime) mayChangeSuite(req *http.Request, id string) *APIError {
+	s, ok := r.GetSuite(id)
+	if !ok {
+		return nil
+	}
+	if !visible(req, s.Namespace) {
+		return apiError(http.StatusNotFound, ErrCodeNotFound, "suite %s not found", id)
+	}
+	return mayChange(req, "suite", id, s.SubmittedBy)
+}
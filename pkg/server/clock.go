@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+var (
+	// CLOCK_SAMPLES is the number of pings the clock offset of a worker is
+	// estimated from
+	CLOCK_SAMPLES = 8
+)
+
+// clockSample is a ping's measure of the worker's clock ahead of the
+// server's, and the round trip time of the ping
+type clockSample struct {
+	offset time.Duration
+	rtt    time.Duration
+}
+
+// measureClock estimates the offset from the server's send and arrive times
+// and the worker's receive and reply times, assuming the network delay is
+// the same each way
+func measureClock(sent, received, replied, arrived time.Time) clockSample {
+	return clockSample{
+		offset: (received.Sub(sent) + replied.Sub(arrived)) / 2,
+		rtt:    arrived.Sub(sent) - replied.Sub(received),
+	}
+}
+
+// syncClock records the ping answered by the status. The offset is taken
+// from the recent ping with the shortest round trip, as it had the least
+// room for the delays to differ.
+func (wc *WorkerConnection) syncClock(status proto.Status, arrived time.Time) {
+	if status.Ping.IsZero() {
+		return
+	}
+
+	wc.clock = append(wc.clock, measureClock(status.Ping, status.Received, status.Replied, arrived))
+	if len(wc.clock) > CLOCK_SAMPLES {
+		wc.clock = wc.clock[len(wc.clock)-CLOCK_SAMPLES:]
+	}
+
+	best := wc.clock[0]
+	for _, sample := range wc.clock[1:] {
+		if sample.rtt < best.rtt {
+			best = sample
+		}
+	}
+	wc.mu.Lock()
+	wc.Offset = best.offset
+	wc.RTT = best.rtt
+	wc.mu.Unlock()
+}
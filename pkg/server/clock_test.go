@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+func TestMeasureClock(t *testing.T) {
+	// the worker's clock is 5s ahead, 10ms each way and 2ms on the worker
+	sent := time.Now()
+	received := sent.Add(5*time.Second + 10*time.Millisecond)
+	replied := received.Add(2 * time.Millisecond)
+	arrived := sent.Add(22 * time.Millisecond)
+
+	sample := measureClock(sent, received, replied, arrived)
+	if sample.offset != 5*time.Second {
+		t.Errorf("offset %s, expected 5s", sample.offset)
+	}
+	if sample.rtt != 20*time.Millisecond {
+		t.Errorf("rtt %s, expected 20ms", sample.rtt)
+	}
+}
+
+func TestSyncClockShortestRoundTrip(t *testing.T) {
+	wc := &WorkerConnection{}
+	sent := time.Now()
+	wc.clock = []clockSample{
+		{offset: 3 * time.Second, rtt: 50 * time.Millisecond},
+		{offset: 2 * time.Second, rtt: 5 * time.Millisecond},
+		{offset: 4 * time.Second, rtt: 80 * time.Millisecond},
+	}
+	status := proto.Status{Ping: sent, Received: sent, Replied: sent}
+	wc.syncClock(status, sent.Add(40*time.Millisecond))
+
+	if wc.Offset != 2*time.Second || wc.RTT != 5*time.Millisecond {
+		t.Errorf("offset %s rtt %s, expected 2s 5ms", wc.Offset, wc.RTT)
+	}
+}
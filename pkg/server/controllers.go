@@ -10,16 +10,32 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/google/uuid"
 )
 
 func (r *runtime) HandleJob(rw http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
+	switch req.Method {
+	case http.MethodGet:
+		if _, sub := jobPath(req.URL.Path); sub == "report" {
+			r.handleJobReport(rw, req)
+			return
+		}
+		r.handleGetJob(rw, req)
+	case http.MethodPost:
+		r.handleCreateJob(rw, req)
+	case http.MethodPatch:
+		r.handleUpdateJob(rw, req)
+	case http.MethodDelete:
+		r.handleCancelJob(rw, req)
+	default:
 		rw.WriteHeader(http.StatusMethodNotAllowed)
-		return
 	}
+}
 
+func (r *runtime) handleCreateJob(rw http.ResponseWriter, req *http.Request) {
 	b, err := io.ReadAll(req.Body)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
@@ -33,8 +49,157 @@ func (r *runtime) HandleJob(rw http.ResponseWriter, req *http.Request) {
 		rw.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	ns, apiErr := submitNamespace(req, j.Namespace, "namespace")
+	if apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	j.Namespace = ns
+	if apiErr := r.fitsQuota(j, ""); apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	if apiErr := r.checkTarget(j, ""); apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	if apiErr := r.fitsHostRate(j, ""); apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	j.SubmittedBy = r.submitter(req)
+	// a repeat of an earlier submission is answered like the first
+	_, _, err = r.SubmitJob(j, req.Header.Get("Idempotency-Key"))
+	if err != nil {
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+}
+
+func (r *runtime) handleGetJob(rw http.ResponseWriter, req *http.Request) {
+	id := jobIDFromPath(req.URL.Path)
+	if id == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	js, ok := r.visibleJob(req, id)
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(js)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = rw.Write(b)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (r *runtime) handleCancelJob(rw http.ResponseWriter, req *http.Request) {
+	id := jobIDFromPath(req.URL.Path)
+	if id == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := r.mayChangeJob(req, id); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if !r.CancelJob(id) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (r *runtime) handleUpdateJob(rw http.ResponseWriter, req *http.Request) {
+	id := jobIDFromPath(req.URL.Path)
+	if id == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	r.JobQueue = append(r.JobQueue, j)
+	var u proto.JobUpdate
+	err = json.Unmarshal(b, &u)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if validateUpdate(u) != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	u.ID = id
+	if err := r.mayChangeJob(req, id); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if err := r.fitsUpdate(u); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	if !r.UpdateJob(u) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (r *runtime) handleJobReport(rw http.ResponseWriter, req *http.Request) {
+	id, _ := jobPath(req.URL.Path)
+	if id == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	_, visible := r.visibleJob(req, id)
+	report, ok := r.JobReport(id)
+	if !ok || !visible {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_, err = rw.Write(b)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// jobIDFromPath returns the {id} of a /job/{id} path
+func jobIDFromPath(path string) string {
+	id, _ := jobPath(path)
+	return id
+}
+
+// jobPath splits a /job/{id}/{sub} path
+func jobPath(path string) (string, string) {
+	id, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(path, "/job"), "/"), "/")
+	return id, sub
 }
 
 func (r *runtime) HandleListJobQueue(rw http.ResponseWriter, req *http.Request) {
@@ -43,7 +208,19 @@ func (r *runtime) HandleListJobQueue(rw http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	b, err := json.Marshal(r.JobQueue)
+	// ?state=queued,running or repeated state params
+	states := []JobState{}
+	for _, v := range req.URL.Query()["state"] {
+		for _, state := range strings.Split(v, ",") {
+			if _, ok := jobStateOrder[JobState(state)]; !ok {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			states = append(states, JobState(state))
+		}
+	}
+
+	b, err := json.Marshal(visibleJobs(req, r.ListJobs(states...)))
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
@@ -62,7 +239,334 @@ func (r *runtime) HandleListWorkers(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	b, err := json.Marshal(r.Workers)
+	b, err := json.Marshal(r.ListWorkers())
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = rw.Write(b)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (r *runtime) HandleSchedule(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		r.handleGetSchedule(rw, req)
+	case http.MethodPost:
+		r.handleCreateSchedule(rw, req)
+	case http.MethodPatch:
+		r.handleUpdateSchedule(rw, req)
+	case http.MethodDelete:
+		r.handleDeleteSchedule(rw, req)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *runtime) handleCreateSchedule(rw http.ResponseWriter, req *http.Request) {
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var body ScheduleSpec
+	err = json.Unmarshal(b, &body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body.ID == "" {
+		body.ID = uuid.NewString()
+	}
+	ns, apiErr := submitNamespace(req, body.Job.Namespace, "job.namespace")
+	if apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	body.Job.Namespace = ns
+	if apiErr := r.fitsQuota(body.Job, "job."); apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	if apiErr := r.checkTarget(body.Job, "job."); apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	if apiErr := r.fitsHostRate(body.Job, "job."); apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	body.Job.SubmittedBy = r.submitter(req)
+
+	s, err := NewSchedule(body.ID, body.Cron, body.Job, body.Suspended)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if !r.AddSchedule(s) {
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+func (r *runtime) handleGetSchedule(rw http.ResponseWriter, req *http.Request) {
+	id := schedulePath(req.URL.Path)
+	if id == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s, ok := r.GetSchedule(id)
+	if !ok || !visible(req, s.Job.Namespace) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = rw.Write(b)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (r *runtime) handleUpdateSchedule(rw http.ResponseWriter, req *http.Request) {
+	id := schedulePath(req.URL.Path)
+	if id == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var u ScheduleUpdate
+	err = json.Unmarshal(b, &u)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	u.ID = id
+	if err := r.mayChangeSchedule(req, id); err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	ok, err := r.UpdateSchedule(u)
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (r *runtime) handleDeleteSchedule(rw http.ResponseWriter, req *http.Request) {
+	id := schedulePath(req.URL.Path)
+	if id == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := r.mayChangeSchedule(req, id); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if !r.DeleteSchedule(id) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// schedulePath returns the {id} of a /schedule/{id} path
+func schedulePath(path string) string {
+	return strings.Trim(strings.TrimPrefix(path, "/schedule"), "/")
+}
+
+func (r *runtime) HandleListSchedules(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.Marshal(visibleSchedules(req, r.ListSchedules()))
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = rw.Write(b)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (r *runtime) HandleSuite(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		r.handleGetSuite(rw, req)
+	case http.MethodPost:
+		r.handleCreateSuite(rw, req)
+	case http.MethodDelete:
+		r.handleCancelSuite(rw, req)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *runtime) handleCreateSuite(rw http.ResponseWriter, req *http.Request) {
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var spec SuiteSpec
+	err = json.Unmarshal(b, &spec)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if spec.ID == "" {
+		spec.ID = uuid.NewString()
+	}
+	ns, apiErr := submitNamespace(req, spec.Namespace, "namespace")
+	if apiErr != nil {
+		writeError(rw, apiErr)
+		return
+	}
+	spec.Namespace = ns
+	for _, steps := range [][]SuiteStep{spec.Setup, spec.Steps, spec.Teardown} {
+		for _, step := range steps {
+			step.Job.Namespace = ns
+			if apiErr := r.fitsQuota(step.Job, ""); apiErr != nil {
+				writeError(rw, apiErr)
+				return
+			}
+			if apiErr := r.checkTarget(step.Job, ""); apiErr != nil {
+				writeError(rw, apiErr)
+				return
+			}
+			if apiErr := r.fitsHostRate(step.Job, ""); apiErr != nil {
+				writeError(rw, apiErr)
+				return
+			}
+		}
+	}
+
+	s, err := NewSuite(spec)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	s.submittedBy(r.submitter(req))
+	if !r.AddSuite(s) {
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+func (r *runtime) handleGetSuite(rw http.ResponseWriter, req *http.Request) {
+	id := suitePath(req.URL.Path)
+	if id == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s, ok := r.GetSuite(id)
+	if !ok || !visible(req, s.Namespace) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = rw.Write(b)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (r *runtime) handleCancelSuite(rw http.ResponseWriter, req *http.Request) {
+	id := suitePath(req.URL.Path)
+	if id == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := r.mayChangeSuite(req, id); err != nil {
+		writeError(rw, err)
+		return
+	}
+	if !r.CancelSuite(id) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// suitePath returns the {id} of a /suite/{id} path
+func suitePath(path string) string {
+	return strings.Trim(strings.TrimPrefix(path, "/suite"), "/")
+}
+
+func (r *runtime) HandleListSuites(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.Marshal(visibleSuites(req, r.ListSuites()))
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = rw.Write(b)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (r *runtime) HandleLeader(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.Marshal(r.LeaderStatus())
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// a wednesday
+	from := time.Date(2022, 6, 1, 10, 30, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2022, 6, 1, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2022, 6, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2022, 6, 2, 2, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2022, 6, 1, 11, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2022, 6, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2022, 6, 2, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// day of month or day of week when both are set
+		{"0 0 15 * 5", time.Date(2022, 6, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+	} {
+		cron, err := parseCron(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %s", tc.expr, err)
+			continue
+		}
+		if next := cron.Next(from); !next.Equal(tc.next) {
+			t.Errorf("%s: next %s, expected %s", tc.expr, next, tc.next)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+
+	cron, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := cron.Next(time.Now()); !next.IsZero() {
+		t.Errorf("february 30th: next %s, expected never", next)
+	}
+}
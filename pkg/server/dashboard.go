@@ -0,0 +1,31 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// DASHBOARD_PREFIX is where the dashboard is served
+const DASHBOARD_PREFIX = "/dashboard/"
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// DashboardHandler serves the dashboard, a page over the API listing the
+// workers and the job queue, charting running jobs from their events and
+// submitting and cancelling jobs. Any server can serve it, followers proxy
+// the API calls it makes to the leader.
+func DashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix(DASHBOARD_PREFIX, http.FileServer(http.FS(files)))
+}
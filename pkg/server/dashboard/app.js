@@ -0,0 +1,324 @@
+// peltr dashboard, refreshes from the API and charts running jobs from their
+// event streams
+"use strict";
+
+const API = "/api/v1";
+const REFRESH_MS = 2000;
+// points kept per chart, one per progress event
+const POINTS = 120;
+const ACTIVE = ["assigned", "accepted", "running"];
+const FINISHED = ["completed", "failed", "cancelled"];
+
+// charts of the running jobs by ID
+const charts = new Map();
+
+// headers of every API call, with the token the user signed in with. Client
+// certificates need no token, the browser presents them.
+function headers(accept) {
+  const h = { Accept: accept };
+  const token = localStorage.getItem("peltr.token");
+  if (token) h.Authorization = "Bearer " + token;
+  return h;
+}
+
+async function api(method, path, body) {
+  const opts = { method, headers: headers("application/json") };
+  if (body !== undefined) {
+    opts.headers["Content-Type"] = "application/json";
+    opts.body = JSON.stringify(body);
+  }
+  const resp = await fetch(API + path, opts);
+  const text = await resp.text();
+  const data = text ? JSON.parse(text) : null;
+  if (!resp.ok) {
+    const e = data && data.error;
+    throw new Error(e ? e.message : resp.statusText);
+  }
+  return data;
+}
+
+function showError(err) {
+  document.getElementById("error").textContent = err ? String(err.message || err) : "";
+}
+
+function cell(tr, text, cls) {
+  const td = document.createElement("td");
+  td.textContent = text === undefined || text === null ? "" : text;
+  if (cls) td.className = cls;
+  tr.appendChild(td);
+  return td;
+}
+
+function ago(t) {
+  const s = Math.round((Date.now() - new Date(t).getTime()) / 1000);
+  if (s < 60) return s + "s ago";
+  if (s < 3600) return Math.round(s / 60) + "m ago";
+  return Math.round(s / 3600) + "h ago";
+}
+
+function cancelButton(id) {
+  const b = document.createElement("button");
+  b.textContent = "Cancel";
+  b.onclick = () => cancel(id);
+  return b;
+}
+
+async function cancel(id) {
+  if (!confirm("Cancel job " + id + "?")) return;
+  try {
+    await api("DELETE", "/jobs/" + encodeURIComponent(id));
+    showError(null);
+    refresh();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+function renderWorkers(workers) {
+  const tbody = document.getElementById("workers");
+  tbody.replaceChildren();
+  workers.sort((a, b) => a.id.localeCompare(b.id));
+  for (const w of workers) {
+    const tr = document.createElement("tr");
+    cell(tr, w.id);
+    cell(tr, w.remote);
+    cell(tr, w.state);
+    cell(tr, w.load.jobs + " / " + (w.capacity || "∞"));
+    cell(tr, w.load.rate + " / " + (w.maxRate || "∞"));
+    cell(tr, w.load.concurrency + " / " + (w.maxConcurrency || "∞"));
+    cell(tr, Object.entries(w.labels || {}).map(([k, v]) => k + "=" + v).join(", "));
+    cell(tr, ago(w.lastSeen));
+    tbody.appendChild(tr);
+  }
+}
+
+function renderQueue(jobs) {
+  const tbody = document.getElementById("queue");
+  tbody.replaceChildren();
+  const queued = jobs.filter((js) => js.state === "queued");
+  queued.sort((a, b) => (a.position || 0) - (b.position || 0));
+  for (const js of queued) {
+    const tr = document.createElement("tr");
+    cell(tr, js.position);
+    cell(tr, js.job.id);
+    cell(tr, js.job.url, "url");
+    cell(tr, js.state);
+    cell(tr, js.job.req);
+    cell(tr, js.job.rate);
+    cell(tr, js.job.namespace || "default");
+    cell(tr, js.job.owner);
+    cell(tr, ago(js.created));
+    cell(tr, "").appendChild(cancelButton(js.job.id));
+    tbody.appendChild(tr);
+  }
+}
+
+function renderFinished(jobs) {
+  const tbody = document.getElementById("finished");
+  tbody.replaceChildren();
+  const finished = jobs.filter((js) => FINISHED.includes(js.state));
+  finished.sort((a, b) => new Date(b.updated) - new Date(a.updated));
+  for (const js of finished.slice(0, 20)) {
+    const tr = document.createElement("tr");
+    cell(tr, js.job.id);
+    cell(tr, js.job.url, "url");
+    cell(tr, js.state, "state-" + js.state);
+    cell(tr, js.reason);
+    cell(tr, js.job.req);
+    cell(tr, ago(js.updated));
+    tbody.appendChild(tr);
+  }
+}
+
+// follow starts a chart for the job fed by its event stream
+function follow(js) {
+  const id = js.job.id;
+  const el = document.getElementById("chart").content.firstElementChild.cloneNode(true);
+  const link = el.querySelector(".id");
+  link.textContent = id;
+  link.href = API + "/jobs/" + encodeURIComponent(id) + "/report";
+  el.querySelector(".url").textContent = js.job.url;
+  el.querySelector(".cancel").onclick = () => cancel(id);
+  document.getElementById("running").appendChild(el);
+
+  const chart = { el, points: [], stream: null };
+  charts.set(id, chart);
+
+  const controller = new AbortController();
+  chart.stream = controller;
+  stream(API + "/jobs/" + encodeURIComponent(id) + "/events", controller.signal, (event, data) => {
+    // the stream closes after the end event
+    if (event !== "progress") return;
+    const p = JSON.parse(data);
+    chart.points.push({ rps: p.rps, p99: p.latencyMs.p99 });
+    if (chart.points.length > POINTS) chart.points.shift();
+    el.querySelector(".stats").textContent =
+      p.state + " · " + p.requests + "/" + js.job.req + " requests · " + p.errors + " errors · " +
+      p.rps.toFixed(1) + " req/s · p50 " + p.latencyMs.p50.toFixed(1) + "ms · p99 " + p.latencyMs.p99.toFixed(1) + "ms";
+    draw(el.querySelector("canvas"), chart.points);
+  })
+    .catch(() => {})
+    // the job finished, is gone or the server went away, the next refresh
+    // picks it up again if it is still running
+    .then(() => {
+      if (charts.get(id) === chart) unfollow(id);
+    });
+}
+
+// stream reads the server-sent events of the URL until it ends or is
+// aborted, EventSource can't send the token
+async function stream(url, signal, onEvent) {
+  const resp = await fetch(url, { headers: headers("text/event-stream"), signal });
+  if (!resp.ok) throw new Error(resp.statusText);
+  const reader = resp.body.getReader();
+  const decoder = new TextDecoder();
+  let buf = "";
+  for (;;) {
+    const { done, value } = await reader.read();
+    if (done) return;
+    buf += decoder.decode(value, { stream: true });
+    let i;
+    while ((i = buf.indexOf("\n\n")) >= 0) {
+      let event = "message";
+      let data = "";
+      for (const line of buf.slice(0, i).split("\n")) {
+        if (line.startsWith("event: ")) event = line.slice(7);
+        else if (line.startsWith("data: ")) data += line.slice(6);
+      }
+      buf = buf.slice(i + 2);
+      onEvent(event, data);
+    }
+  }
+}
+
+function unfollow(id) {
+  const chart = charts.get(id);
+  if (!chart) return;
+  chart.stream.abort();
+  chart.el.remove();
+  charts.delete(id);
+}
+
+// draw plots the request rate and, on its own scale, the p99 latency
+function draw(canvas, points) {
+  const ctx = canvas.getContext("2d");
+  const w = canvas.width;
+  const h = canvas.height;
+  ctx.clearRect(0, 0, w, h);
+
+  const series = [
+    { key: "rps", color: "#2a6fdb", label: "req/s" },
+    { key: "p99", color: "#d9822b", label: "p99 ms" },
+  ];
+  series.forEach((s, n) => {
+    const top = Math.max(1, ...points.map((p) => p[s.key]));
+    ctx.strokeStyle = s.color;
+    ctx.lineWidth = 1.5;
+    ctx.beginPath();
+    points.forEach((p, i) => {
+      const x = (i / (POINTS - 1)) * w;
+      const y = h - (p[s.key] / top) * (h - 14);
+      if (i === 0) ctx.moveTo(x, y);
+      else ctx.lineTo(x, y);
+    });
+    ctx.stroke();
+    ctx.fillStyle = s.color;
+    ctx.font = "11px sans-serif";
+    ctx.fillText(s.label + " (max " + top.toFixed(1) + ")", 4 + n * 140, 11);
+  });
+}
+
+function renderRunning(jobs) {
+  const active = jobs.filter((js) => ACTIVE.includes(js.state));
+  for (const js of active) {
+    if (!charts.has(js.job.id)) follow(js);
+  }
+  for (const id of charts.keys()) {
+    if (!active.some((js) => js.job.id === id)) unfollow(id);
+  }
+  document.getElementById("running-empty").hidden = charts.size > 0;
+}
+
+function renderStop(stop) {
+  document.getElementById("stopped").hidden = !stop.stopped;
+  document.getElementById("stop").hidden = stop.stopped;
+  if (!stop.stopped) return;
+  let text = "Emergency stop by " + stop.by + ", " + ago(stop.at);
+  if (stop.reason) text += ": " + stop.reason;
+  document.getElementById("stopped-text").textContent = text + ". No jobs start until resumed.";
+}
+
+async function refresh() {
+  try {
+    const [workers, jobs, leader, stop] = await Promise.all([
+      api("GET", "/workers"),
+      api("GET", "/jobs"),
+      api("GET", "/leader"),
+      api("GET", "/stop"),
+    ]);
+    renderWorkers(workers);
+    renderQueue(jobs);
+    renderRunning(jobs);
+    renderFinished(jobs);
+    renderStop(stop);
+    const id = leader.leader ? leader.leader.id : leader.isLeader ? leader.id : "";
+    document.getElementById("leader").textContent = id ? "leader " + id : "no leader";
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+}
+
+document.getElementById("submit").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const form = new FormData(e.target);
+  const job = { url: form.get("url") };
+  for (const f of ["req", "rate", "concurrency", "duration", "workers", "priority"]) {
+    job[f] = Number(form.get(f)) || 0;
+  }
+  if (form.get("owner")) job.owner = form.get("owner");
+  if (form.get("namespace")) job.namespace = form.get("namespace");
+  try {
+    await api("POST", "/jobs", job);
+    showError(null);
+    refresh();
+  } catch (err) {
+    showError(err);
+  }
+});
+
+document.getElementById("stop").addEventListener("click", async () => {
+  const reason = prompt("Cancel every running job and stop the scheduler? Reason:");
+  if (reason === null) return;
+  try {
+    await api("POST", "/stop", { reason });
+    showError(null);
+    refresh();
+  } catch (err) {
+    showError(err);
+  }
+});
+
+document.getElementById("resume").addEventListener("click", async () => {
+  if (!confirm("Resume the scheduler? Queued jobs start again.")) return;
+  try {
+    await api("DELETE", "/stop");
+    showError(null);
+    refresh();
+  } catch (err) {
+    showError(err);
+  }
+});
+
+document.getElementById("auth").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const token = new FormData(e.target).get("token");
+  if (token) localStorage.setItem("peltr.token", token);
+  else localStorage.removeItem("peltr.token");
+  e.target.reset();
+  for (const id of [...charts.keys()]) unfollow(id);
+  refresh();
+});
+
+refresh();
+setInterval(refresh, REFRESH_MS);
@@ -0,0 +1,27 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	h := DashboardHandler()
+	for _, path := range []string{DASHBOARD_PREFIX, DASHBOARD_PREFIX + "app.js", DASHBOARD_PREFIX + "style.css"} {
+		rw := apiRequest(h, http.MethodGet, path, "", nil)
+		if rw.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, rw.Code)
+		}
+	}
+	rw := apiRequest(h, http.MethodGet, DASHBOARD_PREFIX, "", nil)
+	if !strings.Contains(rw.Body.String(), "app.js") {
+		t.Errorf("index doesn't load the app")
+	}
+}
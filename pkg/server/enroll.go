@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+var (
+	// CREDENTIALS_RELOAD_INTERVAL is how often the worker keyring and the
+	// control certificate are checked for changes
+	CREDENTIALS_RELOAD_INTERVAL = 10 * time.Second
+
+	errNoCredential    = errors.New("worker sent no credential")
+	errTokenNotAllowed = errors.New("worker sent its secret, the server only accepts an answer to its challenge")
+	errWorkerIDTaken   = errors.New("worker ID is connected with another credential")
+)
+
+// WorkerAuth is the credentials workers must enroll with
+type WorkerAuth struct {
+	Keyring *auth.Keyring
+	// AllowToken accepts a worker sending its key's secret instead of an
+	// answer to the challenge, anyone who can read the connection learns
+	// the secret
+	AllowToken bool
+}
+
+// verifyWorker checks the worker answered the connection's challenge with
+// a key of the keyring, and that no worker of its ID is connected with
+// another key
+func (r *runtime) verifyWorker(id proto.Identify, challenge []byte) error {
+	wa := r.config.WorkerAuth
+	var err error
+	switch {
+	case id.Credential == "":
+		err = errNoCredential
+	case len(id.Proof) > 0:
+		err = wa.Keyring.VerifyProof(id.Credential, challenge, id.ID, id.Proof)
+	case id.Token != "" && !wa.AllowToken:
+		err = errTokenNotAllowed
+	case id.Token != "":
+		err = wa.Keyring.VerifyToken(id.Credential, id.Token)
+	default:
+		err = errNoCredential
+	}
+	if err == nil && r.enrolledElsewhere(id) {
+		err = errWorkerIDTaken
+	}
+	if err != nil {
+		r.metrics.IncRejectedWorkers()
+	}
+	return err
+}
+
+// enrolledElsewhere reports if a connected worker has the ID and enrolled
+// with another credential
+func (r *runtime) enrolledElsewhere(id proto.Identify) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, wc := range r.Workers {
+		if wc.claims(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// CredentialsLoop reads the worker keyring and the control certificate
+// again when their files change, so credentials are added and revoked and
+// certificates renewed without a restart
+func (r *runtime) CredentialsLoop() {
+	if r.config.WorkerAuth == nil && r.config.ControlCert == nil {
+		return
+	}
+	ticker := time.NewTicker(CREDENTIALS_RELOAD_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		if wa := r.config.WorkerAuth; wa != nil {
+			changed, err := wa.Keyring.Reload()
+			if err != nil {
+				r.log.Error().Err(err).Msg("error reloading worker credentials, keeping the previous ones")
+			} else if changed {
+				r.log.Info().Int("credentials", wa.Keyring.Len()).Msg("reloaded worker credentials")
+			}
+		}
+		if kp := r.config.ControlCert; kp != nil {
+			changed, err := kp.Reload()
+			if err != nil {
+				r.log.Error().Err(err).Msg("error reloading the control certificate, keeping the previous one")
+			} else if changed {
+				leaf := kp.Leaf()
+				r.log.Info().Str("pin", auth.CertificatePin(leaf)).Time("notAfter", leaf.NotAfter).Msg("reloaded the control certificate")
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+// enroll connects a worker that answers the hello's challenge with the
+// secret, and returns the server's reply to its identify
+func enroll(t *testing.T, r *runtime, id proto.Identify, secret string) proto.Message {
+	server, worker := net.Pipe()
+	defer worker.Close()
+	wc := r.AddWorker(server)
+	go wc.Handle()
+	worker.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var m proto.Message
+	if err := m.Read(worker); err != nil || m.Type != proto.MessageTypeHello {
+		t.Fatalf("hello %v %v", m.Type, err)
+	}
+	var hello proto.Hello
+	if err := hello.Decode(m); err != nil || len(hello.Challenge) == 0 {
+		t.Fatalf("challenge %v %v", hello.Challenge, err)
+	}
+	if secret != "" {
+		id.Proof = auth.WorkerProof([]byte(secret), hello.Challenge, id.ID)
+	}
+	m, err := id.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write(worker); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Read(worker); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestWorkerEnrollment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workers.csv")
+	os.WriteFile(path, []byte("fleet,0123456789abcdef\nspare,00112233445566778899\n"), 0o600)
+	keyring, err := auth.LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{WorkerAuth: &WorkerAuth{Keyring: keyring}}).(*runtime)
+
+	if m := enroll(t, r, proto.Identify{ID: "w1", Capacity: 1, Credential: "fleet"}, "0123456789abcdef"); m.Type != proto.MessageTypeAlive {
+		t.Errorf("enrolled worker got %v", m.Type)
+	}
+	for name, tc := range map[string]struct {
+		id     proto.Identify
+		secret string
+	}{
+		"no credential":   {proto.Identify{ID: "w2"}, ""},
+		"wrong secret":    {proto.Identify{ID: "w3", Credential: "fleet"}, "fedcba9876543210"},
+		"unknown key":     {proto.Identify{ID: "w4", Credential: "other"}, "0123456789abcdef"},
+		"token by policy": {proto.Identify{ID: "w5", Credential: "fleet", Token: "0123456789abcdef"}, ""},
+	} {
+		m := enroll(t, r, tc.id, tc.secret)
+		var reject proto.Reject
+		if m.Type != proto.MessageTypeReject || reject.Decode(m) != nil || reject.Reason == "" {
+			t.Errorf("%s: got %v", name, m.Type)
+		}
+	}
+
+	r.config.WorkerAuth.AllowToken = true
+	if m := enroll(t, r, proto.Identify{ID: "w6", Credential: "fleet", Token: "0123456789abcdef"}, ""); m.Type != proto.MessageTypeAlive {
+		t.Errorf("worker sending its token got %v", m.Type)
+	}
+
+	// a connected worker's ID can't be taken with another key
+	testWorker(r, "w7").credential = "fleet"
+	if m := enroll(t, r, proto.Identify{ID: "w7", Credential: "spare"}, "00112233445566778899"); m.Type != proto.MessageTypeReject {
+		t.Errorf("w7 with another key got %v", m.Type)
+	}
+	if m := enroll(t, r, proto.Identify{ID: "w7", Credential: "fleet"}, "0123456789abcdef"); m.Type != proto.MessageTypeAlive {
+		t.Errorf("w7 with its own key got %v", m.Type)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// EVENTS_INTERVAL is how often progress is sent to a job's event stream
+	EVENTS_INTERVAL = 1 * time.Second
+)
+
+// JobStateEvent is a transition of the job
+type JobStateEvent struct {
+	ID       string    `json:"id"`
+	State    JobState  `json:"state"`
+	Reason   string    `json:"reason,omitempty"`
+	WorkerID string    `json:"workerID,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// JobProgress is a snapshot of the results the workers running the job
+// reported so far
+type JobProgress struct {
+	ID       string      `json:"id"`
+	State    JobState    `json:"state"`
+	At       time.Time   `json:"at"`
+	Requests int         `json:"requests"`
+	Errors   int         `json:"errors"`
+	Codes    map[int]int `json:"codes"`
+	// RPS is the throughput since the last progress, Throughput since the
+	// job started
+	RPS        float64       `json:"rps"`
+	Throughput float64       `json:"throughput"`
+	LatencyMs  LatencyReport `json:"latencyMs"`
+	Elapsed    float64       `json:"elapsedSeconds"`
+}
+
+// NewJobProgress summarises the report, the rate is measured since the
+// last progress if there is one
+func NewJobProgress(report JobReport, last *JobProgress, now time.Time) JobProgress {
+	p := JobProgress{
+		ID:         report.ID,
+		State:      report.State,
+		At:         now,
+		Requests:   report.Requests,
+		Codes:      report.Codes,
+		Throughput: report.Throughput,
+		LatencyMs:  report.LatencyMs,
+		Elapsed:    report.Duration,
+	}
+	for _, n := range report.Errors {
+		p.Errors += n
+	}
+	if last != nil && now.After(last.At) {
+		p.RPS = float64(p.Requests-last.Requests) / now.Sub(last.At).Seconds()
+	}
+	return p
+}
+
+// watchJob subscribes to the transitions of the job until stop is called
+func (r *runtime) watchJob(id string) (<-chan JobStateEvent, func(), bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.Jobs[id]; !ok {
+		return nil, nil, false
+	}
+	ch := make(chan JobStateEvent, 16)
+	r.watchers[id] = append(r.watchers[id], ch)
+
+	stop := func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for i, w := range r.watchers[id] {
+			if w == ch {
+				r.watchers[id] = append(r.watchers[id][:i], r.watchers[id][i+1:]...)
+				break
+			}
+		}
+		if len(r.watchers[id]) == 0 {
+			delete(r.watchers, id)
+		}
+	}
+	return ch, stop, true
+}
+
+// notify sends the transition to the job's watchers, a watcher too slow to
+// take it misses it and finds the job's state on its next tick
+func (r *runtime) notify(js *JobStatus, workerID string) {
+	ev := JobStateEvent{ID: js.Job.ID, State: js.State, Reason: js.Reason, WorkerID: workerID, At: js.Updated}
+	for _, ch := range r.watchers[js.Job.ID] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// apiJobEvents streams the job's transitions and its progress every
+// EVENTS_INTERVAL as Server-Sent Events, until the job finishes
+func (r *runtime) apiJobEvents(rw http.ResponseWriter, req *http.Request, params map[string]string) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeError(rw, apiError(http.StatusInternalServerError, ErrCodeInternal, "streaming is not supported"))
+		return
+	}
+	id := params["id"]
+	if _, ok := r.visibleJob(req, id); !ok {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "job %s not found", id))
+		return
+	}
+	events, stop, ok := r.watchJob(id)
+	if !ok {
+		writeError(rw, apiError(http.StatusNotFound, ErrCodeNotFound, "job %s not found", id))
+		return
+	}
+	defer stop()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+
+	send := func(event string, v interface{}) {
+		b, _ := json.Marshal(v)
+		fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event, b)
+		flusher.Flush()
+	}
+	var last *JobProgress
+	// progress returns false once the job is gone, i.e. after the server
+	// stepped down as leader
+	progress := func() bool {
+		report, ok := r.JobReport(id)
+		if !ok {
+			return false
+		}
+		p := NewJobProgress(report, last, time.Now())
+		last = &p
+		send("progress", p)
+		return true
+	}
+	finish := func() {
+		progress()
+		send("end", struct{}{})
+	}
+
+	js, _ := r.GetJob(id)
+	send("state", JobStateEvent{ID: id, State: js.State, Reason: js.Reason, At: js.Updated})
+	if js.State.Terminal() {
+		finish()
+		return
+	}
+	progress()
+
+	ticker := time.NewTicker(EVENTS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case ev := <-events:
+			send("state", ev)
+			if ev.State.Terminal() {
+				finish()
+				return
+			}
+		case <-ticker.C:
+			// the job's end may have been missed with the watcher full
+			if js, ok := r.GetJob(id); ok && js.State.Terminal() {
+				send("state", JobStateEvent{ID: id, State: js.State, Reason: js.Reason, At: js.Updated})
+				finish()
+				return
+			}
+			if !progress() {
+				return
+			}
+		}
+	}
+}
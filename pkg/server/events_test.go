@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+func TestNewJobProgress(t *testing.T) {
+	now := time.Now()
+	report := JobReport{
+		ID:       "a",
+		State:    JobStateRunning,
+		Requests: 30,
+		Errors:   map[string]int{"timeout": 2, "refused": 1},
+	}
+
+	first := NewJobProgress(report, nil, now)
+	if first.Errors != 3 {
+		t.Errorf("errors = %d, want 3", first.Errors)
+	}
+	if first.RPS != 0 {
+		t.Errorf("rps without a previous progress = %v, want 0", first.RPS)
+	}
+
+	report.Requests = 50
+	next := NewJobProgress(report, &first, now.Add(2*time.Second))
+	if next.RPS != 10 {
+		t.Errorf("rps = %v, want 10", next.RPS)
+	}
+}
+
+func TestJobEventsMissedEnd(t *testing.T) {
+	interval := EVENTS_INTERVAL
+	EVENTS_INTERVAL = 10 * time.Millisecond
+	defer func() { EVENTS_INTERVAL = interval }()
+
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).(*runtime)
+	r.AddJob(proto.Job{ID: "a", URL: "http://localhost", Req: 10})
+	srv := httptest.NewServer(r.APIHandler())
+	defer srv.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(srv.URL + "/api/v1/jobs/a/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || lines.Text() != "event: state" {
+		t.Fatalf("first line %q", lines.Text())
+	}
+
+	// the job ends without its watchers hearing of it
+	r.mu.Lock()
+	r.Jobs["a"].State = JobStateCancelled
+	r.mu.Unlock()
+
+	var event, state string
+	for lines.Scan() {
+		switch line := lines.Text(); {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "state":
+			state = line
+		}
+	}
+	if event != "end" || !strings.Contains(state, `"state":"cancelled"`) {
+		t.Errorf("stream ended on %q after state %s, err %v", event, state, lines.Err())
+	}
+}
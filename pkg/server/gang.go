@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+// gangPlacement is the worker each shard of a gang is placed on, and the
+// time the shards start at. workers is nil when the gang doesn't fit.
+type gangPlacement struct {
+	workers map[string]*WorkerConnection
+	start   time.Time
+}
+
+// gangs returns the queued shards of each sharded job that has not started,
+// in queue order. A shard requeued after preemption restarts on its own as
+// its siblings are already running.
+func (r *runtime) gangs() map[string][]proto.Job {
+	queued := make(map[string][]proto.Job)
+	for _, job := range r.JobQueue {
+		if job.Parent == "" {
+			continue
+		}
+		if js, ok := r.Jobs[job.ID]; ok && len(js.runs) > 0 {
+			continue
+		}
+		queued[job.Parent] = append(queued[job.Parent], job)
+	}
+
+	gangs := make(map[string][]proto.Job)
+	for parent, shards := range queued {
+		if js, ok := r.Jobs[parent]; ok && len(js.Shards) == len(shards) && len(shards) > 1 {
+			gangs[parent] = shards
+		}
+	}
+	return gangs
+}
+
+// placeGang places every shard of the job or none of them. The loads are
+// only updated when all the shards fit.
+func (r *runtime) placeGang(loads map[*WorkerConnection]Load, usage namespaceUsages, parent string, shards []proto.Job) *gangPlacement {
+	trial := make(map[*WorkerConnection]Load, len(loads))
+	for wc, load := range loads {
+		trial[wc] = load
+	}
+	pending := make(map[*WorkerConnection][]proto.Job)
+	workers := make(map[string]*WorkerConnection, len(shards))
+
+	for _, shard := range shards {
+		wc, reason := r.pickWorker(trial, usage, pending, shard)
+		if wc == nil {
+			r.waitingGang(parent, shards, fmt.Sprintf("waiting for %d workers to start together, shard %s: %s", len(shards), shard.ID, reason))
+			return &gangPlacement{}
+		}
+		trial[wc] = trial[wc].Add(shard)
+		pending[wc] = append(pending[wc], shard)
+		workers[shard.ID] = wc
+	}
+
+	for wc, load := range trial {
+		loads[wc] = load
+	}
+	// the job may ask for a later start
+	start := time.Now().Add(GANG_START_DELAY)
+	if at := shards[0].StartAt; at != nil && at.After(start) {
+		start = *at
+	}
+	r.log.Info().Str("jobID", parent).Int("shards", len(shards)).Time("startAt", start).Msg("gang placed")
+
+	return &gangPlacement{workers: workers, start: start}
+}
+
+// waitingGang records why the gang is still queued on the job and its shards
+func (r *runtime) waitingGang(parent string, shards []proto.Job, reason string) {
+	for _, shard := range shards {
+		if js, ok := r.Jobs[shard.ID]; ok {
+			js.Reason = reason
+		}
+	}
+	js, ok := r.Jobs[parent]
+	if !ok || js.Reason == reason {
+		return
+	}
+	js.Reason = reason
+	r.log.Debug().Str("jobID", parent).Str("reason", reason).Msg("gang unschedulable")
+}
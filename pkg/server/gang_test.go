@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+func TestGangScheduling(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).(*runtime)
+	workers := []*WorkerConnection{}
+	for _, id := range []string{"w1", "w2"} {
+		wc := testWorker(r, id)
+		wc.Capacity = 1
+		workers = append(workers, wc)
+	}
+	r.AddJob(proto.Job{ID: "g", URL: "http://localhost", Req: 30, Workers: 3})
+
+	// too few workers for every shard, none is placed
+	r.mu.Lock()
+	r.schedule()
+	r.mu.Unlock()
+	for _, wc := range workers {
+		if len(wc.Jobs()) != 0 {
+			t.Errorf("%s got %v before the gang fits", wc.ID, ids(wc.Jobs()))
+		}
+	}
+	if js, _ := r.GetJob("g"); js.State != JobStateQueued || !strings.HasPrefix(js.Reason, "waiting for 3 workers") {
+		t.Errorf("gang %s %q", js.State, js.Reason)
+	}
+
+	wc := testWorker(r, "w3")
+	wc.Capacity = 1
+	workers = append(workers, wc)
+	r.mu.Lock()
+	r.schedule()
+	r.mu.Unlock()
+
+	var start *proto.Job
+	for _, wc := range workers {
+		jobs := wc.Jobs()
+		if len(jobs) != 1 {
+			t.Fatalf("%s got %v", wc.ID, ids(jobs))
+		}
+		if jobs[0].StartAt == nil {
+			t.Fatalf("%s has no start", jobs[0].ID)
+		}
+		if start == nil {
+			start = &jobs[0]
+		} else if !jobs[0].StartAt.Equal(*start.StartAt) {
+			t.Errorf("%s starts at %s, %s at %s", jobs[0].ID, jobs[0].StartAt, start.ID, start.StartAt)
+		}
+	}
+}
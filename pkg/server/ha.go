@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+var (
+	// LEASE_TTL is how long the leader holds the lease without renewing
+	// it, a follower takes over once it expires. The lease is renewed
+	// three times per TTL.
+	LEASE_TTL = 10 * time.Second
+)
+
+const (
+	leaseName = "leader"
+	// forwardedHeader marks an API request a follower proxied, so it
+	// isn't proxied again while the servers disagree on the leader
+	forwardedHeader = "X-Peltr-Forwarded"
+)
+
+// Leader is the server holding the lease and where to reach it
+type Leader struct {
+	ID      string `json:"id"`
+	API     string `json:"api"`
+	Control string `json:"control"`
+	// Expires is when the lease runs out unless it's renewed
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// LeaderStatus is this server's view of the election
+type LeaderStatus struct {
+	ID       string  `json:"id"`
+	IsLeader bool    `json:"isLeader"`
+	Leader   *Leader `json:"leader,omitempty"`
+}
+
+// ElectionLoop campaigns for the lease on the store until the server is
+// closed. Servers without a store are always the leader.
+func (r *runtime) ElectionLoop() {
+	if r.store == nil {
+		return
+	}
+	for !r.closing() {
+		r.campaign()
+		time.Sleep(LEASE_TTL / 3)
+	}
+}
+
+// campaign takes or renews the lease. The server leads while it holds the
+// lease and follows the holder otherwise.
+func (r *runtime) campaign() {
+	value, err := json.Marshal(Leader{ID: r.config.ID, API: r.config.API, Control: r.config.Control})
+	if err != nil {
+		r.log.Error().Err(err).Msg("error encoding the lease")
+		return
+	}
+	lease, err := r.store.Acquire(leaseName, r.config.ID, value, LEASE_TTL)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	if err != nil {
+		r.log.Error().Err(err).Msg("error acquiring the lease")
+		// the lease runs out while the store can't be reached
+		if r.leader && !time.Now().Before(r.lease.Expires) {
+			r.stepDown("lease expired")
+		}
+		return
+	}
+	r.lease = lease
+
+	won := lease.Holder == r.config.ID
+	switch {
+	case won && !r.leader:
+		r.lead()
+	case !won && r.leader:
+		r.stepDown("lease taken by " + lease.Holder)
+	}
+}
+
+// lead loads the state the previous leader left in the store
+func (r *runtime) lead() {
+	r.reset()
+	err := r.restore()
+	if err != nil {
+		r.log.Error().Err(err).Msg("error restoring from the store, giving up the lease")
+		r.reset()
+		r.store.Release(leaseName, r.config.ID)
+		return
+	}
+	r.leader = true
+	r.log.Info().Str("id", r.config.ID).Msg("elected leader")
+}
+
+// stepDown drops the state and the workers of a leader that lost the
+// lease, the workers reconnect to the new leader
+func (r *runtime) stepDown(reason string) {
+	r.leader = false
+	workers := r.Workers
+	r.reset()
+	for _, wc := range workers {
+		wc.Conn.Close()
+	}
+	r.log.Warn().Str("id", r.config.ID).Str("reason", reason).Msg("stepped down as leader")
+}
+
+// reset empties the state kept for the leader
+func (r *runtime) reset() {
+	r.Workers = []*WorkerConnection{}
+	r.JobQueue = []proto.Job{}
+	r.AssignedJobs = []proto.Job{}
+	r.Jobs = make(map[string]*JobStatus)
+	r.served = make(map[string]int)
+	r.Schedules = make(map[string]*Schedule)
+	r.Suites = make(map[string]*Suite)
+	r.submissions = make(map[string]*submission)
+	r.watchers = make(map[string][]chan JobStateEvent)
+	r.orphans = make(map[string]orphan)
+	r.stop = Stop{}
+}
+
+// currentLeader returns the holder of the lease, nil when it's expired
+func (r *runtime) currentLeader() *Leader {
+	if !r.lease.Held(time.Now()) {
+		return nil
+	}
+	var leader Leader
+	if err := json.Unmarshal(r.lease.Value, &leader); err != nil {
+		return nil
+	}
+	expires := r.lease.Expires
+	leader.Expires = &expires
+	return &leader
+}
+
+func (r *runtime) closing() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// proxyWorker relays the connection of a worker that reached a follower to
+// the leader. TLS is passed through, the worker's handshake is with the
+// leader.
+func (r *runtime) proxyWorker(conn net.Conn) {
+	defer conn.Close()
+
+	r.mu.Lock()
+	leader := r.currentLeader()
+	r.mu.Unlock()
+	if leader == nil || leader.Control == "" {
+		r.log.Warn().Str("remote", conn.RemoteAddr().String()).Msg("no leader to relay the worker to")
+		return
+	}
+
+	upstream, err := net.Dial("tcp", leader.Control)
+	if err != nil {
+		r.log.Error().Err(err).Str("leader", leader.Control).Msg("error dialing the leader")
+		return
+	}
+	defer upstream.Close()
+	r.log.Info().Str("remote", conn.RemoteAddr().String()).Str("leader", leader.Control).Msg("relaying worker to the leader")
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Lead serves the API request on the leader, followers proxy it to the
+// leader as they don't keep any state
+func (r *runtime) Lead(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		leading := r.leader
+		leader := r.currentLeader()
+		r.mu.Unlock()
+
+		if leading {
+			h(rw, req)
+			return
+		}
+		if leader == nil || leader.API == "" || req.Header.Get(forwardedHeader) != "" {
+			rw.Header().Set("Retry-After", "1")
+			writeError(rw, apiError(http.StatusServiceUnavailable, ErrCodeNoLeader, "no leader elected"))
+			return
+		}
+
+		if err := r.forwardIdentity(req); errors.Is(err, auth.ErrInvalidCredentials) {
+			r.unauthorized(rw, req, err)
+			return
+		} else if err != nil {
+			writeError(rw, apiError(http.StatusInternalServerError, ErrCodeInternal, "forwarding to the leader: %s", err))
+			return
+		}
+		target := &url.URL{Scheme: "http", Host: leader.API}
+		if r.config.LeaderTLS != nil {
+			target.Scheme = "https"
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		if r.leaderTransport != nil {
+			proxy.Transport = r.leaderTransport
+		}
+		req.Header.Set(forwardedHeader, r.config.ID)
+		proxy.ServeHTTP(rw, req)
+	}
+}
+
+// LeaderStatus describes the election as seen by this server
+func (r *runtime) LeaderStatus() LeaderStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := LeaderStatus{ID: r.config.ID, IsLeader: r.leader, Leader: r.currentLeader()}
+	if r.store == nil {
+		status.Leader = &Leader{ID: r.config.ID, API: r.config.API, Control: r.config.Control}
+	}
+	return status
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/gideonw/peltr/pkg/store"
+	"github.com/rs/zerolog"
+)
+
+type testMetrics struct{}
+
+func (testMetrics) IncConnections()     {}
+func (testMetrics) IncRejectedWorkers() {}
+
+// testServer is a server on the shared store at path
+func testServer(t *testing.T, path, id string) *runtime {
+	s, err := store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return NewRuntime(testMetrics{}, zerolog.Nop(), Config{Store: s, ID: id, API: id + ":8010"}).(*runtime)
+}
+
+func TestLeaderFailover(t *testing.T) {
+	ttl := LEASE_TTL
+	LEASE_TTL = 200 * time.Millisecond
+	defer func() { LEASE_TTL = ttl }()
+
+	path := filepath.Join(t.TempDir(), "peltr.db")
+	a := testServer(t, path, "a")
+	b := testServer(t, path, "b")
+
+	a.campaign()
+	b.campaign()
+	if !a.leader || b.leader {
+		t.Fatalf("a leader %v, b leader %v", a.leader, b.leader)
+	}
+	if leader := b.LeaderStatus().Leader; leader == nil || leader.ID != "a" || leader.API != "a:8010" {
+		t.Errorf("b follows %+v", leader)
+	}
+	a.AddJob(proto.Job{ID: "queued", Req: 10})
+
+	// a stops renewing the lease, b takes over once it expires
+	time.Sleep(LEASE_TTL)
+	b.campaign()
+	if !b.leader {
+		t.Fatal("b didn't take over the expired lease")
+	}
+	if js, ok := b.GetJob("queued"); !ok || js.State != JobStateQueued {
+		t.Errorf("b restored %+v, %v", js, ok)
+	}
+
+	// a finds out it lost the lease and drops its state
+	a.campaign()
+	if a.leader {
+		t.Fatal("a still leads")
+	}
+	if _, ok := a.GetJob("queued"); ok {
+		t.Error("a kept its jobs after stepping down")
+	}
+	a.AddJob(proto.Job{ID: "stale"})
+	b.AddJob(proto.Job{ID: "next"})
+
+	// b hands over when closed
+	b.Close()
+	a.campaign()
+	if !a.leader {
+		t.Fatal("a didn't take over the released lease")
+	}
+	if _, ok := a.GetJob("next"); !ok {
+		t.Error("a didn't restore the job b queued")
+	}
+	if _, ok := a.GetJob("stale"); ok {
+		t.Error("a follower wrote to the store")
+	}
+}
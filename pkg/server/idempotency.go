@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/google/uuid"
+)
+
+var (
+	// IDEMPOTENCY_WINDOW is how long a submission is remembered, a repeat
+	// within it returns the job of the first submission
+	IDEMPOTENCY_WINDOW = 24 * time.Hour
+
+	ErrJobExists = errors.New("job exists")
+	// ErrIdempotencyConflict is a repeat of a submission with a different
+	// job
+	ErrIdempotencyConflict = errors.New("idempotency key was used for a different job")
+)
+
+const bucketSubmissions = "submissions"
+
+// submission is a job as first submitted, by its idempotency key or job ID
+type submission struct {
+	JobID  string    `json:"jobID"`
+	Digest string    `json:"digest"`
+	At     time.Time `json:"at"`
+}
+
+// SubmitJob queues the job unless it repeats an earlier submission with
+// the same idempotency key, or the same job ID, within IDEMPOTENCY_WINDOW.
+// A repeat returns the ID of the job first queued and true. The same key
+// or ID with a different job is an error. Keys are the submitter's own,
+// within the job's namespace.
+func (r *runtime) SubmitJob(j proto.Job, key string) (string, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.pruneSubmissions(now)
+	digest, err := digestJob(j)
+	if err != nil {
+		return "", false, err
+	}
+
+	if key != "" {
+		key = "key:" + namespaceOf(j) + "/" + j.SubmittedBy + "/" + key
+		if s, ok := r.submissions[key]; ok {
+			if s.Digest != digest {
+				return "", false, ErrIdempotencyConflict
+			}
+			return s.JobID, true, nil
+		}
+	}
+	if j.ID == "" {
+		j.ID = uuid.NewString()
+	} else if s, ok := r.submissions["id:"+j.ID]; ok && s.Digest == digest {
+		return s.JobID, true, nil
+	}
+
+	if !r.addJob(j) {
+		return j.ID, false, ErrJobExists
+	}
+	s := &submission{JobID: j.ID, Digest: digest, At: now}
+	r.remember("id:"+j.ID, s)
+	if key != "" {
+		r.remember(key, s)
+	}
+	return j.ID, false, nil
+}
+
+func (r *runtime) remember(key string, s *submission) {
+	r.submissions[key] = s
+	r.save(bucketSubmissions, key, s)
+}
+
+// pruneSubmissions forgets the submissions older than the window
+func (r *runtime) pruneSubmissions(now time.Time) {
+	for key, s := range r.submissions {
+		if now.Sub(s.At) > IDEMPOTENCY_WINDOW {
+			delete(r.submissions, key)
+			r.forget(bucketSubmissions, key)
+		}
+	}
+}
+
+// digestJob identifies the job as submitted
+func digestJob(j proto.Job) (string, error) {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (r *runtime) restoreSubmissions() error {
+	records, err := r.store.Load(bucketSubmissions)
+	if err != nil {
+		return err
+	}
+	for key, b := range records {
+		var s submission
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		r.submissions[key] = &s
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+type JobState string
+
+const (
+	JobStateQueued    JobState = "queued"
+	JobStateAssigned  JobState = "assigned"
+	JobStateAccepted  JobState = "accepted"
+	JobStateRunning   JobState = "running"
+	JobStateCompleted JobState = "completed"
+	JobStateFailed    JobState = "failed"
+	JobStateCancelled JobState = "cancelled"
+)
+
+// order of the states, a job only moves forward through them
+var jobStateOrder = map[JobState]int{
+	JobStateQueued:    0,
+	JobStateAssigned:  1,
+	JobStateAccepted:  2,
+	JobStateRunning:   3,
+	JobStateCompleted: 4,
+	JobStateFailed:    4,
+	JobStateCancelled: 4,
+}
+
+// Terminal reports if the job will not change state again
+func (s JobState) Terminal() bool {
+	return jobStateOrder[s] == jobStateOrder[JobStateCompleted]
+}
+
+// JobTracker receives the job state changes and results observed by a
+// worker connection
+type JobTracker interface {
+	TransitionJob(id, workerID string, state JobState, reason string)
+	ReportResult(id, workerID string, result proto.JobResult)
+	ReclaimJob(id, workerID, credential string) bool
+	OrphanJob(id, workerID string)
+}
+
+// JobTransition is an entry in the job's state history
+type JobTransition struct {
+	State    JobState  `json:"state"`
+	At       time.Time `json:"at"`
+	WorkerID string    `json:"workerID,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// JobStatus tracks a job through its lifecycle
+type JobStatus struct {
+	Job       proto.Job       `json:"job"`
+	State     JobState        `json:"state"`
+	Reason    string          `json:"reason,omitempty"`
+	WorkerIDs []string        `json:"workerIDs"`
+	Created   time.Time       `json:"created"`
+	Updated   time.Time       `json:"updated"`
+	History   []JobTransition `json:"history"`
+	// Shards are the IDs of the jobs a sharded job was split into
+	Shards []string `json:"shards,omitempty"`
+	// Position in the job queue while queued, 1 is next
+	Position int `json:"position,omitempty"`
+
+	// runs of the job, a preempted job runs again once resumed
+	runs []jobRun
+}
+
+// jobRun is the job running on a worker and its latest cumulative result
+type jobRun struct {
+	workerID string
+	// credential the worker enrolled with
+	credential string
+	result     proto.JobResult
+	reported   bool
+}
+
+func NewJobStatus(j proto.Job) *JobStatus {
+	now := time.Now()
+	return &JobStatus{
+		Job:       j,
+		State:     JobStateQueued,
+		WorkerIDs: []string{},
+		Created:   now,
+		Updated:   now,
+		History:   []JobTransition{{State: JobStateQueued, At: now}},
+	}
+}
+
+// Transition moves the job to the state, it returns false when the job has
+// already reached or passed the state.
+func (js *JobStatus) Transition(state JobState, workerID, reason string) bool {
+	if js.State.Terminal() || jobStateOrder[state] <= jobStateOrder[js.State] {
+		return false
+	}
+
+	now := time.Now()
+	js.State = state
+	js.Reason = reason
+	js.Updated = now
+	js.History = append(js.History, JobTransition{State: state, At: now, WorkerID: workerID, Reason: reason})
+	if workerID != "" && !contains(js.WorkerIDs, workerID) {
+		js.WorkerIDs = append(js.WorkerIDs, workerID)
+	}
+
+	return true
+}
+
+// Requeue moves a job that was stopped on the worker back to the queue
+func (js *JobStatus) Requeue(workerID, reason string) {
+	now := time.Now()
+	js.State = JobStateQueued
+	js.Reason = reason
+	js.Updated = now
+	js.History = append(js.History, JobTransition{State: JobStateQueued, At: now, WorkerID: workerID, Reason: reason})
+}
+
+// Remaining is the number of requests the earlier runs of the job left
+func (js *JobStatus) Remaining() int {
+	remaining := js.Job.Req
+	for _, run := range js.runs {
+		remaining -= run.result.Requests
+	}
+	return remaining
+}
+
+// lastRun is the job's latest run, or none before it was assigned
+func (js *JobStatus) lastRun() jobRun {
+	if len(js.runs) == 0 {
+		return jobRun{}
+	}
+	return js.runs[len(js.runs)-1]
+}
+
+// TransitionJob records the job state change reported by a worker connection
+func (r *runtime) TransitionJob(id, workerID string, state JobState, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.transitionJob(id, workerID, state, reason)
+}
+
+func (r *runtime) transitionJob(id, workerID string, state JobState, reason string) {
+	js, ok := r.Jobs[id]
+	if !ok {
+		r.log.Warn().Str("jobID", id).Str("state", string(state)).Msg("transition for unknown job")
+		return
+	}
+	if !js.Transition(state, workerID, reason) {
+		return
+	}
+	r.saveJob(js)
+	r.notify(js, workerID)
+	if state.Terminal() {
+		r.AssignedJobs = removeJob(r.AssignedJobs, id)
+	}
+
+	r.log.Info().
+		Str("jobID", id).
+		Str("workerID", workerID).
+		Str("state", string(state)).
+		Str("reason", reason).
+		Msg("job state")
+
+	if js.Job.Parent != "" {
+		r.syncParent(js.Job.Parent)
+	}
+}
+
+// syncParent moves a sharded job to the state every shard has reached. Once
+// all shards are done the job fails if any shard failed, and is cancelled
+// if any shard was cancelled.
+func (r *runtime) syncParent(id string) {
+	js, ok := r.Jobs[id]
+	if !ok {
+		return
+	}
+
+	state := JobStateCompleted
+	reason := ""
+	for _, shardID := range js.Shards {
+		shard, ok := r.Jobs[shardID]
+		if !ok {
+			continue
+		}
+		for _, workerID := range shard.WorkerIDs {
+			if !contains(js.WorkerIDs, workerID) {
+				js.WorkerIDs = append(js.WorkerIDs, workerID)
+			}
+		}
+		switch {
+		case !shard.State.Terminal() && jobStateOrder[shard.State] < jobStateOrder[state]:
+			state = shard.State
+		case shard.State == JobStateFailed && state.Terminal():
+			state = JobStateFailed
+			reason = fmt.Sprintf("shard %s: %s", shardID, shard.Reason)
+		case shard.State == JobStateCancelled && state == JobStateCompleted:
+			state = JobStateCancelled
+			reason = shard.Reason
+		}
+	}
+	if !state.Terminal() {
+		reason = ""
+	}
+
+	if js.Transition(state, "", reason) {
+		r.saveJob(js)
+		r.notify(js, "")
+		r.log.Info().Str("jobID", id).Str("state", string(state)).Msg("sharded job state")
+	}
+}
+
+// ReportResult keeps the latest results a worker reported for its run of
+// the job
+func (r *runtime) ReportResult(id, workerID string, result proto.JobResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	js, ok := r.Jobs[id]
+	if !ok {
+		return
+	}
+	for i := len(js.runs) - 1; i >= 0; i-- {
+		if js.runs[i].workerID == workerID {
+			js.runs[i].result = result
+			js.runs[i].reported = true
+			// the final results are kept, running results are not
+			// worth a write each second
+			if result.Done {
+				r.saveJob(js)
+			}
+			return
+		}
+	}
+}
+
+// jobResults returns the latest results of every run of the job or its
+// shards
+func (r *runtime) jobResults(js *JobStatus) []proto.JobResult {
+	statuses := []*JobStatus{js}
+	if len(js.Shards) > 0 {
+		statuses = statuses[:0]
+		for _, shardID := range js.Shards {
+			if shard, ok := r.Jobs[shardID]; ok {
+				statuses = append(statuses, shard)
+			}
+		}
+	}
+
+	results := []proto.JobResult{}
+	for _, status := range statuses {
+		for _, run := range status.runs {
+			if run.reported {
+				results = append(results, run.result)
+			}
+		}
+	}
+	return results
+}
+
+// GetJob returns a copy of the job status
+func (r *runtime) GetJob(id string) (JobStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	js, ok := r.Jobs[id]
+	if !ok {
+		return JobStatus{}, false
+	}
+	status := *js
+	status.Position = r.queuePositions()[id]
+	return status, true
+}
+
+// ListJobs returns the jobs in any of the states, or all jobs if no states
+// are given, oldest first.
+func (r *runtime) ListJobs(states ...JobState) []JobStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	positions := r.queuePositions()
+	jobs := []JobStatus{}
+	for _, js := range r.Jobs {
+		// shards are listed by their job
+		if js.Job.Parent != "" {
+			continue
+		}
+		if len(states) > 0 && !containsState(states, js.State) {
+			continue
+		}
+		status := *js
+		status.Position = positions[js.Job.ID]
+		jobs = append(jobs, status)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+
+	return jobs
+}
+
+func contains(s []string, v string) bool {
+	for i := range s {
+		if s[i] == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsState(s []JobState, v JobState) bool {
+	for i := range s {
+		if s[i] == v {
+			return true
+		}
+	}
+	return false
+}
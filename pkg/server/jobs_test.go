@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"testing"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+func TestJobTransition(t *testing.T) {
+	js := NewJobStatus(proto.Job{ID: "j", Req: 10})
+	for _, state := range []JobState{JobStateAssigned, JobStateRunning, JobStateCompleted} {
+		if !js.Transition(state, "w", "") || js.State != state {
+			t.Fatalf("%s: job is %s", state, js.State)
+		}
+	}
+	if len(js.History) != 4 || len(js.WorkerIDs) != 1 {
+		t.Errorf("history %+v workers %v", js.History, js.WorkerIDs)
+	}
+
+	// states already passed and terminal states are final
+	for _, tc := range []struct {
+		from, to JobState
+	}{
+		{JobStateRunning, JobStateAssigned},
+		{JobStateRunning, JobStateRunning},
+		{JobStateCompleted, JobStateFailed},
+		{JobStateFailed, JobStateCancelled},
+		{JobStateCancelled, JobStateRunning},
+	} {
+		js := NewJobStatus(proto.Job{ID: "j", Req: 10})
+		js.State = tc.from
+		if js.Transition(tc.to, "w", "") || js.State != tc.from {
+			t.Errorf("%s moved to %s", tc.from, tc.to)
+		}
+	}
+}
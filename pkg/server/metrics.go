@@ -13,11 +13,13 @@ import (
 
 type Metrics interface {
 	IncConnections()
+	IncRejectedWorkers()
 }
 
 type metrics struct {
-	Connections prometheus.Counter
-	Jobs        prometheus.Counter
+	Connections     prometheus.Counter
+	Jobs            prometheus.Counter
+	RejectedWorkers prometheus.Counter
 }
 
 func NewMetricsStore() Metrics {
@@ -30,9 +32,17 @@ func NewMetricsStore() Metrics {
 			Name: "peltr_server_jobs",
 			Help: "The total number of jobs",
 		}),
+		RejectedWorkers: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "peltr_server_workers_rejected",
+			Help: "The total number of workers rejected for their credentials",
+		}),
 	}
 }
 
 func (m *metrics) IncConnections() {
 	m.Connections.Inc()
 }
+
+func (m *metrics) IncRejectedWorkers() {
+	m.RejectedWorkers.Inc()
+}
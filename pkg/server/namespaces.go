@@ -0,0 +1,410 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+const (
+	// DefaultNamespace is the namespace of jobs submitted without one
+	DefaultNamespace = "default"
+	// AnyNamespace is the key of the quota of namespaces without their own
+	AnyNamespace = "*"
+)
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Quota limits what the jobs of a namespace run at once and request in a
+// day, 0 is unlimited. Jobs over the quota stay queued until it allows them.
+type Quota struct {
+	// MaxJobs running at once, a sharded job counts once
+	MaxJobs int `json:"maxJobs,omitempty"`
+	// MaxRate is the total req/s of the running jobs
+	MaxRate int `json:"maxRate,omitempty"`
+	// MaxWorkers running the namespace's jobs at once
+	MaxWorkers int `json:"maxWorkers,omitempty"`
+	// DailyRequests is the requests the jobs started in a day may make,
+	// days start at midnight UTC
+	DailyRequests int `json:"dailyRequests,omitempty"`
+}
+
+// NamespaceUsage is what the jobs of a namespace run and requested today.
+// A job started today counts its req until it finishes, then the requests
+// it made.
+type NamespaceUsage struct {
+	Jobs     int `json:"jobs"`
+	Rate     int `json:"rate"`
+	Workers  int `json:"workers"`
+	Requests int `json:"requests"`
+
+	groups  map[string]bool
+	workers map[*WorkerConnection]bool
+}
+
+// NamespaceStatus is a namespace with its quota, usage and queued jobs
+type NamespaceStatus struct {
+	Name   string         `json:"name"`
+	Quota  Quota          `json:"quota"`
+	Usage  NamespaceUsage `json:"usage"`
+	Queued int            `json:"queued"`
+}
+
+// namespaceOf the job, jobs from before namespaces are in the default one
+func namespaceOf(j proto.Job) string {
+	if j.Namespace == "" {
+		return DefaultNamespace
+	}
+	return j.Namespace
+}
+
+// quota of the namespace
+func (r *runtime) quota(ns string) Quota {
+	if q, ok := r.config.Quotas[ns]; ok {
+		return q
+	}
+	return r.config.Quotas[AnyNamespace]
+}
+
+// dailyQuotas reports if any namespace has a daily request budget
+func (r *runtime) dailyQuotas() bool {
+	for _, q := range r.config.Quotas {
+		if q.DailyRequests > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type namespaceUsages map[string]*NamespaceUsage
+
+func (usage namespaceUsages) of(ns string) *NamespaceUsage {
+	u, ok := usage[ns]
+	if !ok {
+		u = &NamespaceUsage{groups: make(map[string]bool), workers: make(map[*WorkerConnection]bool)}
+		usage[ns] = u
+	}
+	return u
+}
+
+// run counts the job running on the worker
+func (u *NamespaceUsage) run(wc *WorkerConnection, job proto.Job) {
+	if !u.groups[job.Group()] {
+		u.groups[job.Group()] = true
+		u.Jobs += 1
+	}
+	if !u.workers[wc] {
+		u.workers[wc] = true
+		u.Workers += 1
+	}
+	u.Rate += job.EffectiveRate()
+}
+
+// namespaceUsage is what each namespace's jobs run on the workers, and
+// with daily, what they requested today
+func (r *runtime) namespaceUsage(now time.Time, daily bool) namespaceUsages {
+	usage := namespaceUsages{}
+	for _, wc := range r.Workers {
+		for _, job := range wc.Jobs() {
+			usage.of(namespaceOf(job)).run(wc, job)
+		}
+	}
+	if !daily {
+		return usage
+	}
+
+	y, m, d := now.UTC().Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	for _, js := range r.Jobs {
+		// a sharded job is counted by its shards
+		if len(js.Shards) > 0 || len(js.runs) == 0 {
+			continue
+		}
+		if started := js.started(); started.Before(today) {
+			continue
+		}
+		requests := js.Job.Req
+		if js.State.Terminal() {
+			requests = js.Job.Req - js.Remaining()
+		}
+		usage.of(namespaceOf(js.Job)).Requests += requests
+	}
+	return usage
+}
+
+// started is when the job was first assigned
+func (js *JobStatus) started() time.Time {
+	for _, t := range js.History {
+		if t.State == JobStateAssigned {
+			return t.At
+		}
+	}
+	return js.Created
+}
+
+// overQuota returns why the namespace can't start the jobs, a job or the
+// shards of a gang, within its quota
+func (r *runtime) overQuota(usage namespaceUsages, jobs []proto.Job) string {
+	ns := namespaceOf(jobs[0])
+	q := r.quota(ns)
+	if q == (Quota{}) {
+		return ""
+	}
+	u := usage.of(ns)
+
+	rate, requests := 0, 0
+	for _, job := range jobs {
+		rate += job.EffectiveRate()
+		if js, ok := r.Jobs[job.ID]; !ok || len(js.runs) == 0 {
+			requests += job.Req
+		}
+	}
+	switch {
+	case q.MaxJobs > 0 && !u.groups[jobs[0].Group()] && u.Jobs >= q.MaxJobs:
+		return fmt.Sprintf("namespace %s runs %d of its %d jobs", ns, u.Jobs, q.MaxJobs)
+	case q.MaxRate > 0 && u.Rate+rate > q.MaxRate:
+		return fmt.Sprintf("namespace %s runs %d of its %d req/s, the job needs %d", ns, u.Rate, q.MaxRate, rate)
+	case q.DailyRequests > 0 && requests > 0 && u.Requests+requests > q.DailyRequests:
+		return fmt.Sprintf("namespace %s requested %d of its %d requests today, the job needs %d", ns, u.Requests, q.DailyRequests, requests)
+	}
+	return ""
+}
+
+// mayUseWorker reports if the job's namespace may run it on the worker
+// within its quota of workers, counting the workers its pending jobs are
+// placed on
+func (r *runtime) mayUseWorker(usage namespaceUsages, pending map[*WorkerConnection][]proto.Job, wc *WorkerConnection, job proto.Job) bool {
+	ns := namespaceOf(job)
+	q := r.quota(ns)
+	if q.MaxWorkers == 0 {
+		return true
+	}
+	u := usage.of(ns)
+	if u.workers[wc] {
+		return true
+	}
+
+	used := u.Workers
+	for other, jobs := range pending {
+		if u.workers[other] {
+			continue
+		}
+		for _, j := range jobs {
+			if namespaceOf(j) == ns {
+				if other == wc {
+					return true
+				}
+				used += 1
+				break
+			}
+		}
+	}
+	return used < q.MaxWorkers
+}
+
+// charge counts the job the worker is assigned against its namespace's
+// usage for the rest of the scheduling pass
+func (r *runtime) charge(usage namespaceUsages, wc *WorkerConnection, job proto.Job) {
+	u := usage.of(namespaceOf(job))
+	u.run(wc, job)
+	if js, ok := r.Jobs[job.ID]; !ok || len(js.runs) == 0 {
+		u.Requests += job.Req
+	}
+}
+
+// credit uncounts the job stopped on the worker from its namespace's usage
+// for the rest of the scheduling pass
+func (r *runtime) credit(usage namespaceUsages, wc *WorkerConnection, job proto.Job) {
+	ns := namespaceOf(job)
+	u := usage.of(ns)
+	u.Rate -= job.EffectiveRate()
+	if u.groups[job.Group()] {
+		delete(u.groups, job.Group())
+		u.Jobs -= 1
+	}
+	if !u.workers[wc] {
+		return
+	}
+	for _, other := range wc.Jobs() {
+		if namespaceOf(other) == ns {
+			return
+		}
+	}
+	delete(u.workers, wc)
+	u.Workers -= 1
+}
+
+// ListNamespaces returns the namespaces with a quota or jobs, with their
+// usage
+func (r *runtime) ListNamespaces() []NamespaceStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	usage := r.namespaceUsage(time.Now(), true)
+	names := map[string]bool{DefaultNamespace: true}
+	for ns := range r.config.Quotas {
+		if ns != AnyNamespace {
+			names[ns] = true
+		}
+	}
+	for _, js := range r.Jobs {
+		names[namespaceOf(js.Job)] = true
+	}
+	queued := make(map[string]map[string]bool)
+	for _, job := range r.JobQueue {
+		ns := namespaceOf(job)
+		if queued[ns] == nil {
+			queued[ns] = make(map[string]bool)
+		}
+		queued[ns][job.Group()] = true
+	}
+
+	namespaces := []NamespaceStatus{}
+	for ns := range names {
+		namespaces = append(namespaces, NamespaceStatus{
+			Name:   ns,
+			Quota:  r.quota(ns),
+			Usage:  *usage.of(ns),
+			Queued: len(queued[ns]),
+		})
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Name < namespaces[j].Name
+	})
+	return namespaces
+}
+
+// submitNamespace is the namespace the caller submits to: the one asked
+// for, else the caller's only namespace, else the default one
+func submitNamespace(req *http.Request, ns, field string) (string, *APIError) {
+	id := auth.FromContext(req.Context())
+	if ns == "" {
+		ns = DefaultNamespace
+		if len(id.Namespaces) == 1 {
+			ns = id.Namespaces[0]
+		}
+	}
+	if !namespacePattern.MatchString(ns) {
+		return "", fieldError(field, "namespace must be lowercase letters, digits and dashes, at most 63 characters")
+	}
+	if !id.InNamespace(ns) {
+		return "", apiError(http.StatusForbidden, ErrCodeForbidden, "%s may not submit to namespace %s", id.Name, ns)
+	}
+	return ns, nil
+}
+
+// fitsQuota checks the job could ever run within its namespace's quota,
+// field names are under prefix
+func (r *runtime) fitsQuota(j proto.Job, prefix string) *APIError {
+	ns := namespaceOf(j)
+	q := r.quota(ns)
+	switch {
+	case q.MaxRate > 0 && j.EffectiveRate() > q.MaxRate:
+		return fieldError(prefix+"rate", "rate %d is over the %d req/s quota of namespace %s", j.EffectiveRate(), q.MaxRate, ns)
+	case q.DailyRequests > 0 && j.Req > q.DailyRequests:
+		return fieldError(prefix+"req", "req %d is over the %d daily requests quota of namespace %s", j.Req, q.DailyRequests, ns)
+	case q.MaxWorkers > 0 && j.Workers > q.MaxWorkers:
+		return fieldError(prefix+"workers", "workers %d is over the %d workers quota of namespace %s", j.Workers, q.MaxWorkers, ns)
+	}
+	return nil
+}
+
+// fitsRunningQuota checks a running job may change to the rate of j within
+// the rate its namespace runs at without it. Queued jobs are held by the
+// scheduler until they fit.
+func (r *runtime) fitsRunningQuota(j proto.Job) *APIError {
+	ns := namespaceOf(j)
+	if r.quota(ns).MaxRate == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	usage := r.namespaceUsage(time.Now(), false)
+	u := usage.of(ns)
+	if !u.groups[j.Group()] {
+		return nil
+	}
+	for _, wc := range r.Workers {
+		for _, job := range wc.Jobs() {
+			if job.Group() == j.Group() {
+				u.Rate -= job.EffectiveRate()
+			}
+		}
+	}
+	if reason := r.overQuota(usage, []proto.Job{j}); reason != "" {
+		return fieldError("rate", "%s", reason)
+	}
+	return nil
+}
+
+// visible reports if the caller may see what is in the namespace
+func visible(req *http.Request, ns string) bool {
+	if ns == "" {
+		ns = DefaultNamespace
+	}
+	return auth.FromContext(req.Context()).InNamespace(ns)
+}
+
+// inNamespaces returns a filter of the namespaces the caller may see and
+// asked for with ?namespace=, comma separated
+func inNamespaces(req *http.Request) func(ns string) bool {
+	asked := auth.ParseNamespaces(strings.Join(req.URL.Query()["namespace"], ","))
+	return func(ns string) bool {
+		if ns == "" {
+			ns = DefaultNamespace
+		}
+		return visible(req, ns) && (len(asked) == 0 || contains(asked, ns))
+	}
+}
+
+// visibleJob returns the job if the caller may see it
+func (r *runtime) visibleJob(req *http.Request, id string) (JobStatus, bool) {
+	js, ok := r.GetJob(id)
+	return js, ok && visible(req, js.Job.Namespace)
+}
+
+func visibleJobs(req *http.Request, jobs []JobStatus) []JobStatus {
+	filter := inNamespaces(req)
+	kept := []JobStatus{}
+	for _, js := range jobs {
+		if filter(js.Job.Namespace) {
+			kept = append(kept, js)
+		}
+	}
+	return kept
+}
+
+func visibleSchedules(req *http.Request, schedules []Schedule) []Schedule {
+	filter := inNamespaces(req)
+	kept := []Schedule{}
+	for _, s := range schedules {
+		if filter(s.Job.Namespace) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+func visibleSuites(req *http.Request, suites []Suite) []Suite {
+	filter := inNamespaces(req)
+	kept := []Suite{}
+	for _, s := range suites {
+		if filter(s.Namespace) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
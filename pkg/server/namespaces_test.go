@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+func TestNamespaceQuota(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{Quotas: map[string]Quota{
+		"jobs":       {MaxJobs: 1},
+		"rate":       {MaxRate: 100},
+		"daily":      {DailyRequests: 1000},
+		AnyNamespace: {MaxJobs: 2},
+	}}).(*runtime)
+	usage := namespaceUsages{}
+	wc := &WorkerConnection{}
+
+	for _, tc := range []struct {
+		running, next proto.Job
+	}{
+		{proto.Job{ID: "j1", Namespace: "jobs"}, proto.Job{ID: "j2", Namespace: "jobs"}},
+		{proto.Job{ID: "r1", Namespace: "rate", Rate: 80}, proto.Job{ID: "r2", Namespace: "rate", Rate: 30}},
+		{proto.Job{ID: "d1", Namespace: "daily", Req: 600}, proto.Job{ID: "d2", Namespace: "daily", Req: 500}},
+	} {
+		if reason := r.overQuota(usage, []proto.Job{tc.running}); reason != "" {
+			t.Errorf("%s held back: %s", tc.running.ID, reason)
+		}
+		r.charge(usage, wc, tc.running)
+		if reason := r.overQuota(usage, []proto.Job{tc.next}); reason == "" {
+			t.Errorf("%s allowed over the quota of %s", tc.next.ID, tc.next.Namespace)
+		}
+	}
+
+	// the shards of a running job don't count again, other namespaces get
+	// the quota of *
+	if reason := r.overQuota(usage, []proto.Job{{ID: "j1.1", Parent: "j1", Namespace: "jobs"}}); reason != "" {
+		t.Errorf("shard of a running job held back: %s", reason)
+	}
+	r.charge(usage, wc, proto.Job{ID: "o1"})
+	r.charge(usage, wc, proto.Job{ID: "o2"})
+	if reason := r.overQuota(usage, []proto.Job{{ID: "o3"}}); reason == "" {
+		t.Error("default namespace allowed over the quota of *")
+	}
+}
+
+func TestAPINamespaces(t *testing.T) {
+	tokens := auth.StaticTokens{
+		"a": {Name: "ann", Role: auth.RoleSubmitter, Namespaces: []string{"team-a"}},
+		"b": {Name: "bob", Role: auth.RoleSubmitter, Namespaces: []string{"team-b"}},
+		"x": {Name: "xan", Role: auth.RoleAdmin},
+	}
+	quotas := map[string]Quota{"team-a": {MaxRate: 100}}
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{Auth: tokens, Quotas: quotas}).(*runtime)
+	api := r.APIHandler()
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	for _, tc := range []struct {
+		name, method, path, body string
+		header                   map[string]string
+		status                   int
+	}{
+		{"own namespace", "POST", "/api/v1/jobs", `{"id": "a", "url": "http://localhost", "req": 1, "rate": 10}`, bearer("a"), 201},
+		{"other namespace", "POST", "/api/v1/jobs", `{"url": "http://localhost", "req": 1, "namespace": "team-b"}`, bearer("a"), 403},
+		{"bad namespace", "POST", "/api/v1/jobs", `{"url": "http://localhost", "req": 1, "namespace": "Team A"}`, bearer("x"), 400},
+		{"over quota", "POST", "/api/v1/jobs", `{"url": "http://localhost", "req": 1, "rate": 500}`, bearer("a"), 400},
+		{"hidden", "GET", "/api/v1/jobs/a", ``, bearer("b"), 404},
+		{"hidden cancel", "DELETE", "/api/v1/jobs/a", ``, bearer("b"), 404},
+		{"unscoped", "GET", "/api/v1/jobs/a", ``, bearer("x"), 200},
+	} {
+		rw := apiRequest(api, tc.method, tc.path, tc.body, tc.header)
+		if rw.Code != tc.status {
+			t.Errorf("%s: %d %s, expected %d", tc.name, rw.Code, rw.Body.String(), tc.status)
+		}
+	}
+
+	var jobs []JobStatus
+	rw := apiRequest(api, "GET", "/api/v1/jobs", ``, bearer("b"))
+	if err := json.Unmarshal(rw.Body.Bytes(), &jobs); err != nil || len(jobs) != 0 {
+		t.Errorf("team-b lists %s, %v", rw.Body.String(), err)
+	}
+	rw = apiRequest(api, "GET", "/api/v1/jobs?namespace=team-a", ``, bearer("x"))
+	if err := json.Unmarshal(rw.Body.Bytes(), &jobs); err != nil || len(jobs) != 1 || jobs[0].Job.Namespace != "team-a" {
+		t.Errorf("team-a lists %s, %v", rw.Body.String(), err)
+	}
+
+	// a running job's new rate counts against its namespace without its old one
+	wc := &WorkerConnection{ID: "w", cancelled: make(map[string]bool)}
+	r.Workers = append(r.Workers, wc)
+	js, _ := r.GetJob("a")
+	wc.AssignJob(js.Job)
+	wc.AssignJob(proto.Job{ID: "other", Namespace: "team-a", Rate: 60})
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"rate": 40}`, 200},
+		{`{"rate": 50}`, 400},
+		{`{"rate": 500}`, 400},
+	} {
+		rw := apiRequest(api, "PATCH", "/api/v1/jobs/a", tc.body, bearer("a"))
+		if rw.Code != tc.status {
+			t.Errorf("PATCH %s: %d %s, expected %d", tc.body, rw.Code, rw.Body.String(), tc.status)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+const (
+	bucketJobs      = "jobs"
+	bucketSchedules = "schedules"
+	bucketSuites    = "suites"
+	bucketStop      = "stop"
+)
+
+var (
+	// RECLAIM_TIMEOUT is how long jobs that were running when the server
+	// stopped, or when their worker disconnected, wait for their workers to
+	// reconnect
+	RECLAIM_TIMEOUT = 30 * time.Second
+)
+
+// orphan is a job that was running on a worker the server lost, waiting for
+// the worker to reclaim it until by. Only a worker of the same ID enrolled
+// with the same credential may reclaim it. A job left by a restart is
+// requeued if it isn't reclaimed, one left by a disconnect fails.
+type orphan struct {
+	workerID     string
+	credential   string
+	by           time.Time
+	disconnected bool
+}
+
+// jobRecord is a job status as stored
+type jobRecord struct {
+	Status JobStatus   `json:"status"`
+	Runs   []runRecord `json:"runs,omitempty"`
+}
+
+type runRecord struct {
+	WorkerID   string          `json:"workerID"`
+	Credential string          `json:"credential,omitempty"`
+	Result     proto.JobResult `json:"result"`
+	Reported   bool            `json:"reported"`
+}
+
+// suiteRecord is a suite as stored, with the jobs of its steps
+type suiteRecord struct {
+	Suite     Suite                `json:"suite"`
+	Jobs      map[string]proto.Job `json:"jobs"`
+	Cancelled bool                 `json:"cancelled"`
+}
+
+// saveJob writes the job status to the store before the change is acted on
+func (r *runtime) saveJob(js *JobStatus) {
+	rec := jobRecord{Status: *js}
+	rec.Status.Position = 0
+	for _, run := range js.runs {
+		rec.Runs = append(rec.Runs, runRecord{WorkerID: run.workerID, Credential: run.credential, Result: run.result, Reported: run.reported})
+	}
+	r.save(bucketJobs, js.Job.ID, rec)
+}
+
+func (r *runtime) saveSchedule(s *Schedule) {
+	r.save(bucketSchedules, s.ID, s)
+}
+
+func (r *runtime) saveSuite(s *Suite) {
+	rec := suiteRecord{Suite: *s, Jobs: make(map[string]proto.Job), Cancelled: s.cancelled}
+	for _, step := range s.Steps {
+		rec.Jobs[step.Name] = step.job
+	}
+	r.save(bucketSuites, s.ID, rec)
+}
+
+// save writes the record, a failed write is logged as the server carries on
+// with the state in memory. Only the leader writes.
+func (r *runtime) save(bucket, key string, v interface{}) {
+	if r.store == nil || !r.leader {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err == nil {
+		err = r.store.Put(bucket, key, b)
+	}
+	if err != nil {
+		r.log.Error().Err(err).Str("bucket", bucket).Str("key", key).Msg("error saving to the store")
+	}
+}
+
+func (r *runtime) forget(bucket, key string) {
+	if r.store == nil || !r.leader {
+		return
+	}
+	if err := r.store.Delete(bucket, key); err != nil {
+		r.log.Error().Err(err).Str("bucket", bucket).Str("key", key).Msg("error deleting from the store")
+	}
+}
+
+// restore loads the state saved in the store when the server becomes the
+// leader. Queued jobs are queued again, jobs that were assigned are left for
+// their workers to reclaim when they reconnect and are requeued if they
+// don't within RECLAIM_TIMEOUT.
+func (r *runtime) restore() error {
+	err := r.restoreJobs()
+	if err != nil {
+		return err
+	}
+	err = r.restoreSchedules()
+	if err != nil {
+		return err
+	}
+	err = r.restoreSuites()
+	if err != nil {
+		return err
+	}
+	err = r.restoreStop()
+	if err != nil {
+		return err
+	}
+	return r.restoreSubmissions()
+}
+
+func (r *runtime) restoreJobs() error {
+	records, err := r.store.Load(bucketJobs)
+	if err != nil {
+		return err
+	}
+
+	queued := []*JobStatus{}
+	for id, b := range records {
+		var rec jobRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return fmt.Errorf("job %s: %w", id, err)
+		}
+		js := rec.Status
+		for _, run := range rec.Runs {
+			js.runs = append(js.runs, jobRun{workerID: run.WorkerID, credential: run.Credential, result: run.Result, reported: run.Reported})
+		}
+		r.Jobs[id] = &js
+
+		switch {
+		case js.State.Terminal() || len(js.Shards) > 0:
+		case js.State == JobStateQueued:
+			queued = append(queued, &js)
+		default:
+			r.orphans[id] = orphan{workerID: js.lastRun().workerID, credential: js.lastRun().credential, by: time.Now().Add(RECLAIM_TIMEOUT)}
+			r.AssignedJobs = append(r.AssignedJobs, js.Job)
+		}
+	}
+
+	// the queue order is rebuilt by orderQueue, submitted order is kept
+	// for jobs of the same priority and owner
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].Created.Equal(queued[j].Created) {
+			return queued[i].Job.ID < queued[j].Job.ID
+		}
+		return queued[i].Created.Before(queued[j].Created)
+	})
+	for _, js := range queued {
+		r.JobQueue = append(r.JobQueue, js.Job)
+	}
+	r.log.Info().Int("jobs", len(r.Jobs)).Int("queued", len(r.JobQueue)).Int("reclaimable", len(r.orphans)).Msg("restored jobs")
+	return nil
+}
+
+func (r *runtime) restoreSchedules() error {
+	records, err := r.store.Load(bucketSchedules)
+	if err != nil {
+		return err
+	}
+	for id, b := range records {
+		var s Schedule
+		if err := json.Unmarshal(b, &s); err != nil {
+			return fmt.Errorf("schedule %s: %w", id, err)
+		}
+		s.cron, err = parseCron(s.Cron)
+		if err != nil {
+			return fmt.Errorf("schedule %s: %w", id, err)
+		}
+		// runs missed while the server was down are not caught up
+		s.plan(time.Now())
+		r.Schedules[id] = &s
+	}
+	r.log.Info().Int("schedules", len(r.Schedules)).Msg("restored schedules")
+	return nil
+}
+
+func (r *runtime) restoreSuites() error {
+	records, err := r.store.Load(bucketSuites)
+	if err != nil {
+		return err
+	}
+	for id, b := range records {
+		var rec suiteRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return fmt.Errorf("suite %s: %w", id, err)
+		}
+		s := rec.Suite
+		s.cancelled = rec.Cancelled
+		for i := range s.Steps {
+			s.Steps[i].job = rec.Jobs[s.Steps[i].Name]
+		}
+		r.Suites[id] = &s
+	}
+	r.log.Info().Int("suites", len(r.Suites)).Msg("restored suites")
+	return nil
+}
+
+// OrphanJob keeps a job that was running on a worker that disconnected for
+// the worker to reclaim when it reconnects
+func (r *runtime) OrphanJob(id, workerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	js, ok := r.Jobs[id]
+	if !ok || js.State.Terminal() {
+		return
+	}
+	r.orphans[id] = orphan{workerID: workerID, credential: js.lastRun().credential, by: time.Now().Add(RECLAIM_TIMEOUT), disconnected: true}
+	r.log.Info().Str("jobID", id).Str("workerID", workerID).Msg("job waiting for its worker to reconnect")
+}
+
+// ReclaimJob hands a job that was running when the server restarted, or
+// when its worker disconnected, back to the worker that reports it. It
+// returns false if the job isn't waiting on that worker, enrolled with the
+// credential it ran the job under.
+func (r *runtime) ReclaimJob(id, workerID, credential string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if o, ok := r.orphans[id]; !ok || o.workerID != workerID || o.credential != credential || r.stop.Stopped {
+		return false
+	}
+	delete(r.orphans, id)
+	r.log.Info().Str("jobID", id).Str("workerID", workerID).Msg("job reclaimed")
+	return true
+}
+
+// requeueOrphans queues the jobs left by a restart that no worker reclaimed
+// in time again, and fails those of workers that didn't reconnect
+func (r *runtime) requeueOrphans(now time.Time) {
+	for id, o := range r.orphans {
+		if now.Before(o.by) {
+			continue
+		}
+		delete(r.orphans, id)
+		js, ok := r.Jobs[id]
+		if !ok || js.State.Terminal() {
+			continue
+		}
+		if o.disconnected {
+			r.transitionJob(id, o.workerID, JobStateFailed, "worker disconnected")
+			continue
+		}
+		js.Requeue(o.workerID, "not reclaimed by its worker after a restart")
+		r.AssignedJobs = removeJob(r.AssignedJobs, id)
+		r.JobQueue = append(r.JobQueue, js.Job)
+		r.saveJob(js)
+		r.log.Info().Str("jobID", id).Str("workerID", o.workerID).Msg("requeued unclaimed job")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+// preempt frees a worker for the job by cancelling lower priority jobs on
+// it. The worker needing the fewest jobs stopped is picked, the stopped
+// jobs are credited back to their namespace's usage and returned to
+// requeue. It returns nil when no worker can be freed.
+func (r *runtime) preempt(usage namespaceUsages, job proto.Job) (*WorkerConnection, []proto.Job) {
+	var best *WorkerConnection
+	var bestVictims []proto.Job
+
+	spread := r.spreadValues(job, nil)
+	for _, wc := range r.Workers {
+		if !wc.Connected() || placeable(wc, wc.Jobs(), job, spread) != "" || !r.mayUseWorker(usage, nil, wc, job) {
+			continue
+		}
+		victims, ok := victimsFor(wc, job)
+		if !ok {
+			continue
+		}
+		if best == nil || len(victims) < len(bestVictims) {
+			best, bestVictims = wc, victims
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+
+	for _, victim := range bestVictims {
+		best.CancelJob(victim.ID, "preempt")
+		r.AssignedJobs = removeJob(r.AssignedJobs, victim.ID)
+		if js, ok := r.Jobs[victim.ID]; ok {
+			js.Requeue(best.ID, fmt.Sprintf("preempted by %s", job.ID))
+			r.saveJob(js)
+		}
+		r.log.Info().
+			Str("workerID", best.ID).
+			Str("jobID", victim.ID).
+			Str("preemptedBy", job.ID).
+			Msg("preempted job")
+	}
+	for _, victim := range bestVictims {
+		r.credit(usage, best, victim)
+	}
+	return best, bestVictims
+}
+
+// victimsFor returns the fewest lower priority jobs to stop on the worker
+// for the job to fit, lowest priority first. Shards aren't stopped, their
+// gang would run short of them.
+func victimsFor(wc *WorkerConnection, job proto.Job) ([]proto.Job, bool) {
+	jobs := wc.Jobs()
+	candidates := []proto.Job{}
+	for _, other := range jobs {
+		if other.Priority < job.Priority && other.Parent == "" {
+			candidates = append(candidates, other)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Priority < candidates[j].Priority
+	})
+
+	for n := 1; n <= len(candidates); n++ {
+		load := Load{}.Add(job)
+		for _, other := range jobs {
+			if indexJob(candidates[:n], other.ID) < 0 {
+				load = load.Add(other)
+			}
+		}
+		if _, fits := utilization(wc, load); fits {
+			return candidates[:n], true
+		}
+	}
+	return nil, false
+}
+
+// stopping returns the worker still stopping an earlier run of the job, the
+// job resumes once the run's final results are in
+func (r *runtime) stopping(id string) *WorkerConnection {
+	for _, wc := range r.Workers {
+		if wc.Connected() && wc.Cancelling(id) {
+			return wc
+		}
+	}
+	return nil
+}
+
+// resume returns the job with the requests its earlier runs left, and false
+// if the earlier runs finished the job
+func (r *runtime) resume(job proto.Job) (proto.Job, bool) {
+	js, ok := r.Jobs[job.ID]
+	if !ok || len(js.runs) == 0 {
+		return job, true
+	}
+
+	job.Req = js.Remaining()
+	if job.Req <= 0 {
+		r.transitionJob(job.ID, "", JobStateCompleted, "finished before it was preempted")
+		return job, false
+	}
+	return job, true
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+func TestPreempt(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{Preemption: true}).(*runtime)
+	pair := testWorker(r, "pair")
+	pair.MaxRate = 100
+	pair.AssignJob(proto.Job{ID: "a", Rate: 40})
+	pair.AssignJob(proto.Job{ID: "b", Rate: 40})
+	one := testWorker(r, "one")
+	one.MaxRate = 100
+	one.AssignJob(proto.Job{ID: "c", Rate: 80, Parent: "g"})
+	one.AssignJob(proto.Job{ID: "d", Rate: 10, Priority: 5})
+	job := proto.Job{ID: "j", Rate: 70, Priority: 5}
+
+	// c is a shard and d isn't lower priority, only pair can be freed
+	usage := r.namespaceUsage(time.Now(), false)
+	wc, victims := r.preempt(usage, job)
+	if wc != pair || len(victims) != 2 {
+		t.Fatalf("preempted %v on %s", ids(victims), workerID(wc))
+	}
+	if u := usage.of(DefaultNamespace); u.Rate != 90 || u.Jobs != 2 || u.Workers != 1 {
+		t.Errorf("usage after preempting %+v", *u)
+	}
+
+	// the worker needing the fewest jobs stopped is picked
+	one.CancelJob("c", "")
+	one.AssignJob(proto.Job{ID: "e", Rate: 80})
+	pair.AssignJob(proto.Job{ID: "a", Rate: 40})
+	pair.AssignJob(proto.Job{ID: "b", Rate: 40})
+	if wc, victims := r.preempt(r.namespaceUsage(time.Now(), false), job); wc != one || len(victims) != 1 || victims[0].ID != "e" {
+		t.Errorf("preempted %v on %s, want e on one", ids(victims), workerID(wc))
+	}
+}
+
+func TestPreemptRequeues(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{Preemption: true}).(*runtime)
+	wc := testWorker(r, "w")
+	wc.Capacity = 1
+	r.AddJob(proto.Job{ID: "low", URL: "http://localhost", Req: 10})
+	r.mu.Lock()
+	r.schedule()
+	r.mu.Unlock()
+
+	r.AddJob(proto.Job{ID: "high", URL: "http://localhost", Req: 10, Priority: 1})
+	r.mu.Lock()
+	r.schedule()
+	r.mu.Unlock()
+
+	if jobs := wc.Jobs(); len(jobs) != 1 || jobs[0].ID != "high" {
+		t.Errorf("w runs %v, want high", ids(jobs))
+	}
+	if queue := ids(r.JobQueue); len(queue) != 1 || queue[0] != "low" {
+		t.Errorf("queue %v, want low", queue)
+	}
+	if js, _ := r.GetJob("low"); js.State != JobStateQueued || !strings.Contains(js.Reason, "preempted by high") {
+		t.Errorf("low %s %q", js.State, js.Reason)
+	}
+}
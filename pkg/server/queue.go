@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"sort"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+// orderQueue sorts the jobs by priority, highest first. Jobs of the same
+// priority are interleaved between owners by weighted round-robin, so an
+// owner with weight 2 gets two jobs for every job of an owner with weight 1.
+// served is the number of jobs each owner had assigned so far, it carries
+// the fair share over from earlier scheduling passes.
+func orderQueue(jobs []proto.Job, weights map[string]int, served map[string]int) []proto.Job {
+	byPriority := make(map[int][]proto.Job)
+	priorities := []int{}
+	for _, job := range jobs {
+		if _, ok := byPriority[job.Priority]; !ok {
+			priorities = append(priorities, job.Priority)
+		}
+		byPriority[job.Priority] = append(byPriority[job.Priority], job)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+
+	ordered := make([]proto.Job, 0, len(jobs))
+	for _, priority := range priorities {
+		ordered = append(ordered, fairShare(byPriority[priority], weights, served)...)
+	}
+	return ordered
+}
+
+// fairShare interleaves the jobs of each owner by weight, keeping each
+// owner's jobs in their submitted order
+func fairShare(jobs []proto.Job, weights map[string]int, served map[string]int) []proto.Job {
+	owners := []string{}
+	queues := make(map[string][]proto.Job)
+	for _, job := range jobs {
+		if _, ok := queues[job.Owner]; !ok {
+			owners = append(owners, job.Owner)
+		}
+		queues[job.Owner] = append(queues[job.Owner], job)
+	}
+
+	// owners start from the least served owner waiting, so an owner that
+	// has been idle doesn't get to run a backlog ahead of everyone
+	counts := make(map[string]int, len(owners))
+	least := -1
+	for _, owner := range owners {
+		if least < 0 || served[owner] < least {
+			least = served[owner]
+		}
+	}
+	for _, owner := range owners {
+		counts[owner] = served[owner] - least
+	}
+
+	ordered := make([]proto.Job, 0, len(jobs))
+	for len(ordered) < len(jobs) {
+		next := ""
+		nextShare := 0.0
+		found := false
+		for _, owner := range owners {
+			if len(queues[owner]) == 0 {
+				continue
+			}
+			share := float64(counts[owner]+1) / float64(ownerWeight(weights, owner))
+			if !found || share < nextShare {
+				next, nextShare, found = owner, share, true
+			}
+		}
+
+		ordered = append(ordered, queues[next][0])
+		queues[next] = queues[next][1:]
+		counts[next] += 1
+	}
+	return ordered
+}
+
+func ownerWeight(weights map[string]int, owner string) int {
+	if w, ok := weights[owner]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// queuePositions returns the 1-based position of each queued job, a
+// sharded job is at the position of its first shard
+func (r *runtime) queuePositions() map[string]int {
+	positions := make(map[string]int, len(r.JobQueue))
+	for i, job := range orderQueue(r.JobQueue, r.config.OwnerWeights, r.served) {
+		positions[job.ID] = i + 1
+		if _, ok := positions[job.Parent]; job.Parent != "" && !ok {
+			positions[job.Parent] = i + 1
+		}
+	}
+	return positions
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+func ids(jobs []proto.Job) []string {
+	s := []string{}
+	for _, job := range jobs {
+		s = append(s, job.ID)
+	}
+	return s
+}
+
+func TestOrderQueuePriority(t *testing.T) {
+	jobs := []proto.Job{
+		{ID: "low", Priority: -1},
+		{ID: "normal"},
+		{ID: "high", Priority: 10},
+	}
+
+	got := ids(orderQueue(jobs, nil, map[string]int{}))
+	want := []string{"high", "normal", "low"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestOrderQueueFairShare(t *testing.T) {
+	jobs := []proto.Job{
+		{ID: "a1", Owner: "a"},
+		{ID: "a2", Owner: "a"},
+		{ID: "a3", Owner: "a"},
+		{ID: "a4", Owner: "a"},
+		{ID: "b1", Owner: "b"},
+		{ID: "b2", Owner: "b"},
+	}
+
+	got := ids(orderQueue(jobs, nil, map[string]int{}))
+	want := []string{"a1", "b1", "a2", "b2", "a3", "a4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("equal weights: got %v, want %v", got, want)
+	}
+
+	got = ids(orderQueue(jobs, map[string]int{"a": 2}, map[string]int{}))
+	want = []string{"a1", "a2", "b1", "a3", "a4", "b2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("weighted: got %v, want %v", got, want)
+	}
+
+	// a already had two jobs assigned so b goes first
+	got = ids(orderQueue(jobs, nil, map[string]int{"a": 7, "b": 5}))
+	want = []string{"b1", "b2", "a1", "a2", "a3", "a4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("served: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+// LatencyReport summarises request latencies in milliseconds
+type LatencyReport struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// JobReport merges the results of every worker that ran the job
+type JobReport struct {
+	ID       string         `json:"id"`
+	State    JobState       `json:"state"`
+	Workers  int            `json:"workers"`
+	Requests int            `json:"requests"`
+	Codes    map[int]int    `json:"codes"`
+	Errors   map[string]int `json:"errors"`
+	// LatencyMs of the successful requests
+	LatencyMs LatencyReport `json:"latencyMs"`
+	// Throughput in requests per second
+	Throughput float64          `json:"throughput"`
+	Start      time.Time        `json:"start"`
+	End        time.Time        `json:"end"`
+	Duration   float64          `json:"durationSeconds"`
+	Timeline   []proto.JobEvent `json:"timeline"`
+}
+
+// NewJobReport merges the latest result of each run of the job
+func NewJobReport(js *JobStatus, results []proto.JobResult) JobReport {
+	report := JobReport{
+		ID:       js.Job.ID,
+		State:    js.State,
+		Workers:  len(js.WorkerIDs),
+		Codes:    make(map[int]int),
+		Errors:   make(map[string]int),
+		Timeline: []proto.JobEvent{},
+	}
+
+	latency := proto.NewHistogram()
+	done := len(results) > 0
+	for _, result := range results {
+		report.Requests += result.Requests
+		for k, v := range result.Codes {
+			report.Codes[k] += v
+		}
+		for k, v := range result.Errors {
+			report.Errors[k] += v
+		}
+		latency.Merge(result.Latency)
+		report.Timeline = append(report.Timeline, result.Timeline...)
+
+		if !result.Start.IsZero() && (report.Start.IsZero() || result.Start.Before(report.Start)) {
+			report.Start = result.Start
+		}
+		if result.End.After(report.End) {
+			report.End = result.End
+		}
+		done = done && result.Done
+	}
+	sort.SliceStable(report.Timeline, func(i, j int) bool {
+		return report.Timeline[i].At.Before(report.Timeline[j].At)
+	})
+
+	report.LatencyMs = LatencyReport{
+		Min:  ms(latency.Min),
+		Mean: ms(latency.Mean()),
+		P50:  ms(latency.Quantile(0.50)),
+		P90:  ms(latency.Quantile(0.90)),
+		P95:  ms(latency.Quantile(0.95)),
+		P99:  ms(latency.Quantile(0.99)),
+		Max:  ms(latency.Max),
+	}
+
+	// running jobs are measured up to now
+	end := report.End
+	if !done && !js.State.Terminal() {
+		end = time.Now()
+	}
+	if !report.Start.IsZero() && end.After(report.Start) {
+		duration := end.Sub(report.Start)
+		report.Duration = duration.Seconds()
+		report.Throughput = float64(report.Requests) / duration.Seconds()
+	}
+
+	return report
+}
+
+// JobReport returns the merged results of the job
+func (r *runtime) JobReport(id string) (JobReport, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	js, ok := r.Jobs[id]
+	if !ok {
+		return JobReport{}, false
+	}
+	return NewJobReport(js, r.jobResults(js)), true
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
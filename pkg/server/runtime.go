@@ -7,12 +7,15 @@
 package server
 
 import (
-	"fmt"
+	"crypto/tls"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/gideonw/peltr/pkg/auth"
 	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/gideonw/peltr/pkg/store"
 	"github.com/rs/zerolog"
 )
 
@@ -20,33 +23,157 @@ type Runtime interface {
 	Listen() error
 	HandleConnections()
 	ControlLoop()
+	ElectionLoop()
 	Close()
 	AddWorker(conn net.Conn) *WorkerConnection
+	AddJob(j proto.Job) bool
+	SubmitJob(j proto.Job, key string) (string, bool, error)
+	CancelJob(id string) bool
+	UpdateJob(u proto.JobUpdate) bool
+	GetJob(id string) (JobStatus, bool)
+	ListJobs(states ...JobState) []JobStatus
+	JobReport(id string) (JobReport, bool)
+	ListWorkers() []WorkerInfo
+	ListNamespaces() []NamespaceStatus
+	StopAll(by, reason string) Stop
+	Resume(by string) (Stop, bool)
+	StopStatus() Stop
+	AddSchedule(s *Schedule) bool
+	UpdateSchedule(u ScheduleUpdate) (bool, error)
+	DeleteSchedule(id string) bool
+	GetSchedule(id string) (Schedule, bool)
+	ListSchedules() []Schedule
+	AddSuite(s *Suite) bool
+	CancelSuite(id string) bool
+	GetSuite(id string) (Suite, bool)
+	ListSuites() []Suite
+	LeaderStatus() LeaderStatus
+	Lead(h http.HandlerFunc) http.HandlerFunc
+	Authenticate(h http.HandlerFunc) http.HandlerFunc
+	Authorize(h http.HandlerFunc) http.HandlerFunc
+	CredentialsLoop()
 	HandleJob(rw http.ResponseWriter, req *http.Request)
 	HandleListJobQueue(rw http.ResponseWriter, req *http.Request)
 	HandleListWorkers(rw http.ResponseWriter, req *http.Request)
+	HandleSchedule(rw http.ResponseWriter, req *http.Request)
+	HandleListSchedules(rw http.ResponseWriter, req *http.Request)
+	HandleSuite(rw http.ResponseWriter, req *http.Request)
+	HandleListSuites(rw http.ResponseWriter, req *http.Request)
+	HandleLeader(rw http.ResponseWriter, req *http.Request)
+	APIHandler() http.Handler
+}
+
+// Config of the server runtime
+type Config struct {
+	// Port workers connect to
+	Port int
+	// OwnerWeights share the job queue between owners, owners not listed
+	// have a weight of 1
+	OwnerWeights map[string]int
+	// Quotas of each namespace, AnyNamespace is the quota of namespaces not
+	// listed. Namespaces without a quota are unlimited.
+	Quotas map[string]Quota
+	// Targets is the hosts jobs may send requests to, checked when jobs are
+	// submitted and by workers before they dial
+	Targets proto.TargetPolicy
+	// MaxHostRate is the total req/s the running jobs may send a host, 0 is
+	// unlimited. HostRates sets it for hosts and *.domain patterns.
+	MaxHostRate int
+	HostRates   map[string]int
+	// Preemption lets a job stop lower priority jobs when no worker has
+	// the capacity to run it, the stopped jobs are requeued
+	Preemption bool
+	// Store persists jobs, schedules and suites, nil keeps them in memory.
+	// Servers sharing a store elect a leader through it.
+	Store store.Store
+	// ID of the server in the leader election
+	ID string
+	// API and Control are the addresses other servers reach this one on
+	// when it leads, for the API and for workers
+	API     string
+	Control string
+	// Auth identifies API callers, nil lets anyone call the API as an
+	// admin
+	Auth auth.Authenticator
+	// WorkerAuth is the credentials workers enroll with, nil takes any
+	// worker
+	WorkerAuth *WorkerAuth
+	// ControlTLS serves the worker port over TLS, nil serves plain TCP.
+	// ControlCert is the certificate it serves, read again when its files
+	// change.
+	ControlTLS  *tls.Config
+	ControlCert *auth.KeyPair
+	// LeaderTLS proxies API requests to the leader over HTTPS, nil proxies
+	// over HTTP
+	LeaderTLS *tls.Config
 }
 
 type runtime struct {
 	metrics      Metrics
 	log          zerolog.Logger
+	mu           sync.Mutex
 	socket       *net.TCPListener
 	port         int
+	config       Config
 	Workers      []*WorkerConnection
 	JobQueue     []proto.Job
 	AssignedJobs []proto.Job
+	// Jobs by ID with their lifecycle state
+	Jobs map[string]*JobStatus
+	// [Owner]: jobs assigned, for fair sharing of the queue
+	served map[string]int
+	// Schedules by ID that queue recurring jobs
+	Schedules map[string]*Schedule
+	// Suites by ID that run their jobs in dependency order
+	Suites map[string]*Suite
+	// [key:{Namespace}/{SubmittedBy}/{Idempotency-Key} or id:{JobID}]: jobs
+	// submitted recently
+	submissions map[string]*submission
+	// [JobID]: event streams following the job
+	watchers map[string][]chan JobStateEvent
+
+	store store.Store
+	// [JobID]: jobs left by a restart or their worker disconnecting, until
+	// the worker reclaims them or their time runs out
+	orphans map[string]orphan
+	// stop is the emergency stop, the scheduler is frozen while it's on
+	stop Stop
+
+	// leader is set while the server holds the lease on the store, only
+	// the leader schedules jobs and writes to the store
+	leader bool
+	lease  store.Lease
+	closed bool
+	// secret the servers sharing the store sign forwarded identities with
+	secret []byte
+	// leaderTransport proxies to the leader over TLS
+	leaderTransport http.RoundTripper
 }
 
-func NewRuntime(m Metrics, logger zerolog.Logger, port int) Runtime {
-	return &runtime{
+func NewRuntime(m Metrics, logger zerolog.Logger, config Config) Runtime {
+	r := &runtime{
 		metrics:      m,
 		log:          logger,
 		socket:       nil,
-		port:         port,
+		port:         config.Port,
+		config:       config,
 		Workers:      []*WorkerConnection{},
 		JobQueue:     []proto.Job{},
 		AssignedJobs: []proto.Job{},
+		Jobs:         make(map[string]*JobStatus),
+		served:       make(map[string]int),
+		Schedules:    make(map[string]*Schedule),
+		Suites:       make(map[string]*Suite),
+		submissions:  make(map[string]*submission),
+		watchers:     make(map[string][]chan JobStateEvent),
+		store:        config.Store,
+		orphans:      make(map[string]orphan),
+		leader:       config.Store == nil,
+	}
+	if config.LeaderTLS != nil {
+		r.leaderTransport = &http.Transport{TLSClientConfig: config.LeaderTLS}
 	}
+	return r
 }
 
 func (r *runtime) Listen() error {
@@ -68,75 +195,238 @@ func (r *runtime) HandleConnections() {
 			r.log.Error().Err(err).Msg("error accepting connection")
 			continue
 		}
+		r.mu.Lock()
+		leader := r.leader
+		r.mu.Unlock()
+		if !leader {
+			go r.proxyWorker(conn)
+			continue
+		}
+
 		r.metrics.IncConnections()
-		wc := r.AddWorker(conn)
-		go wc.Handle()
+		go r.serveWorker(conn)
 	}
 }
 
-func (r *runtime) ControlLoop() {
-	for {
-		if len(r.JobQueue) <= 0 {
-			time.Sleep(10 * time.Millisecond)
-			continue
+// serveWorker completes the TLS handshake, when the worker port is served
+// over TLS, and handles the worker
+func (r *runtime) serveWorker(conn net.Conn) {
+	if r.config.ControlTLS != nil {
+		tlsConn := tls.Server(conn, r.config.ControlTLS)
+		tlsConn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+		if err := tlsConn.Handshake(); err != nil {
+			r.log.Warn().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("TLS handshake with worker failed")
+			conn.Close()
+			return
 		}
-
-		// Assign jobs to workers
-		for i := range r.Workers {
-			if len(r.JobQueue) == 0 {
-				break
-			}
-			if r.Workers[i].State == "alive" {
-				job := r.JobQueue[0]
-				r.Workers[i].AssignJob(job)
-				r.AssignedJobs = append(r.AssignedJobs, job)
-				r.JobQueue = r.JobQueue[1:]
-				r.log.Debug().Func(func(e *zerolog.Event) {
-					l := e.Int("jobQueue", len(r.JobQueue))
-					for i := range r.JobQueue {
-						l.Str(fmt.Sprint(i), r.JobQueue[i].ID)
-					}
-				}).Msg("jobQueue items")
-
-				r.log.Info().
-					Str("workerID", r.Workers[i].ID).
-					Str("workerState", r.Workers[i].State).
-					Str("JobID", job.ID).
-					Msg("Assigned job")
-			}
+		tlsConn.SetDeadline(time.Time{})
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			r.log.Info().Str("remote", conn.RemoteAddr().String()).Str("subject", certs[0].Subject.CommonName).Msg("worker presented a certificate")
 		}
-
-		r.Workers = shiftSlice(r.Workers)
+		conn = tlsConn
 	}
-}
 
-func shiftSlice[V *WorkerConnection](s []V) []V {
-	if len(s) <= 1 {
-		return s
-	}
-	temp := s[0]
-	ret := s[1:]
-	ret = append(ret, temp)
-	return ret
+	wc := r.AddWorker(conn)
+	wc.Handle()
 }
 
+// Close stops the server and gives up the lease if it leads
 func (r *runtime) Close() {
-	r.socket.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	if r.leader && r.store != nil {
+		r.stepDown("closed")
+		r.store.Release(leaseName, r.config.ID)
+	}
+	if r.socket != nil {
+		r.socket.Close()
+	}
 }
 
 func (r *runtime) AddWorker(conn net.Conn) *WorkerConnection {
-	wc := NewWorkerConnection(r.log, conn)
+	wc := NewWorkerConnection(r.log, conn, r)
+	if r.config.WorkerAuth != nil {
+		wc.verify = r.verifyWorker
+	}
+	wc.targets = r.config.Targets
+	r.mu.Lock()
 	r.Workers = append(r.Workers, wc)
+	r.mu.Unlock()
 
 	r.metrics.IncConnections()
 
 	return wc
 }
 
+// ListWorkers describes the connected workers
+func (r *runtime) ListWorkers() []WorkerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	workers := []WorkerInfo{}
+	for _, wc := range r.Workers {
+		workers = append(workers, wc.Info())
+	}
+	return workers
+}
+
+// AddJob queues the job, it returns false if a job with the ID exists.
+// Sharded jobs queue a shard per worker and are tracked as one job.
+func (r *runtime) AddJob(j proto.Job) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.addJob(j)
+}
+
+func (r *runtime) addJob(j proto.Job) bool {
+	if _, ok := r.Jobs[j.ID]; ok {
+		return false
+	}
+	js := NewJobStatus(j)
+	r.Jobs[j.ID] = js
+
+	if !j.Sharded() {
+		r.saveJob(js)
+		r.JobQueue = append(r.JobQueue, j)
+		r.log.Info().Str("jobID", j.ID).Msg("job queued")
+		return true
+	}
+
+	n := j.Workers
+	if j.Spread {
+		n = r.spreadCount(j)
+	}
+	for _, shard := range j.Split(n) {
+		r.Jobs[shard.ID] = NewJobStatus(shard)
+		r.saveJob(r.Jobs[shard.ID])
+		r.JobQueue = append(r.JobQueue, shard)
+		js.Shards = append(js.Shards, shard.ID)
+	}
+	r.saveJob(js)
+	r.log.Info().Str("jobID", j.ID).Int("shards", len(js.Shards)).Msg("job queued")
+
+	return true
+}
+
+// CancelJob removes a queued job or sends a cancel to the worker it was
+// assigned to. It returns false when the job is unknown.
+func (r *runtime) CancelJob(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.cancelJobAndShards(id)
+}
+
+func (r *runtime) cancelJobAndShards(id string) bool {
+	js, ok := r.Jobs[id]
+	if !ok {
+		return false
+	}
+	if len(js.Shards) == 0 {
+		return r.cancelJob(id)
+	}
+
+	cancelled := false
+	for _, shard := range js.Shards {
+		cancelled = r.cancelJob(shard) || cancelled
+	}
+	return cancelled
+}
+
+func (r *runtime) cancelJob(id string) bool {
+	if i := indexJob(r.JobQueue, id); i >= 0 {
+		r.JobQueue = append(r.JobQueue[:i], r.JobQueue[i+1:]...)
+		r.log.Info().Str("jobID", id).Msg("cancelled queued job")
+		r.transitionJob(id, "", JobStateCancelled, "cancelled while queued")
+		return true
+	}
+
+	for i := range r.Workers {
+		if r.Workers[i].HasJob(id) {
+			r.Workers[i].CancelJob(id, "cancel")
+			r.log.Info().Str("jobID", id).Str("workerID", r.Workers[i].ID).Msg("cancelled assigned job")
+			r.transitionJob(id, r.Workers[i].ID, JobStateCancelled, "cancelled by request")
+			return true
+		}
+	}
+	// the worker cancels the job it isn't given back when it reconnects
+	if o, ok := r.orphans[id]; ok {
+		delete(r.orphans, id)
+		r.AssignedJobs = removeJob(r.AssignedJobs, id)
+		r.log.Info().Str("jobID", id).Str("workerID", o.workerID).Msg("cancelled job waiting for its worker")
+		r.transitionJob(id, o.workerID, JobStateCancelled, "cancelled by request")
+		return true
+	}
+
+	return false
+}
+
+// UpdateJob applies the update to a queued job or sends it to the worker
+// the job was assigned to. It returns false when the job is unknown.
+func (r *runtime) UpdateJob(u proto.JobUpdate) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	js, ok := r.Jobs[u.ID]
+	if !ok {
+		return false
+	}
+	u.Apply(&js.Job)
+	r.saveJob(js)
+	if len(js.Shards) == 0 {
+		return r.updateJob(u)
+	}
+
+	// the new rate and concurrency are split like the job was
+	updated := false
+	for i, shard := range js.Shards {
+		su := u
+		su.ID = shard
+		if u.Rate != nil {
+			rate := proto.Share(*u.Rate, len(js.Shards), i)
+			su.Rate = &rate
+		}
+		if u.Concurrency != nil && *u.Concurrency > 0 {
+			concurrency := (*u.Concurrency + len(js.Shards) - 1) / len(js.Shards)
+			su.Concurrency = &concurrency
+		}
+		if s, ok := r.Jobs[shard]; ok {
+			su.Apply(&s.Job)
+			r.saveJob(s)
+		}
+		updated = r.updateJob(su) || updated
+	}
+	return updated
+}
+
+func (r *runtime) updateJob(u proto.JobUpdate) bool {
+	if i := indexJob(r.JobQueue, u.ID); i >= 0 {
+		u.Apply(&r.JobQueue[i])
+		r.log.Info().Str("jobID", u.ID).Msg("updated queued job")
+		return true
+	}
+
+	for i := range r.Workers {
+		if r.Workers[i].HasJob(u.ID) {
+			r.Workers[i].UpdateJob(u)
+			if j := indexJob(r.AssignedJobs, u.ID); j >= 0 {
+				u.Apply(&r.AssignedJobs[j])
+			}
+			r.log.Info().Str("jobID", u.ID).Str("workerID", r.Workers[i].ID).Msg("updated assigned job")
+			return true
+		}
+	}
+
+	return false
+}
+
 func countWorkersInState(workers []*WorkerConnection, state string) int {
 	count := 0
 	for i := range workers {
-		if workers[i].State == state {
+		if workers[i].CurrentState() == state {
 			count += 1
 		}
 	}
@@ -0,0 +1,362 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+var (
+	SCHEDULE_INTERVAL = 10 * time.Millisecond
+	// GANG_START_DELAY leaves the shards of a gang time to reach their
+	// workers before they start
+	GANG_START_DELAY = 2 * time.Second
+)
+
+// ControlLoop queues the jobs of schedules that are due and suite steps
+// that are ready, and assigns queued jobs to the least loaded worker with
+// the capacity to run them. Jobs that don't fit on any worker stay queued,
+// unless they can preempt lower priority jobs. Only the leader schedules.
+func (r *runtime) ControlLoop() {
+	for {
+		r.mu.Lock()
+		if r.leader {
+			r.requeueOrphans(time.Now())
+			r.runSchedules(time.Now())
+			r.runSuites()
+			r.schedule()
+		}
+		r.mu.Unlock()
+
+		time.Sleep(SCHEDULE_INTERVAL)
+	}
+}
+
+func (r *runtime) schedule() {
+	r.Workers = pruneWorkers(r.Workers)
+	if len(r.JobQueue) == 0 {
+		return
+	}
+	if r.stop.Stopped {
+		r.holdQueue()
+		return
+	}
+	r.JobQueue = orderQueue(r.JobQueue, r.config.OwnerWeights, r.served)
+	usage := r.namespaceUsage(time.Now(), r.dailyQuotas())
+	hosts := r.hostRates("")
+
+	// load of each worker, updated as jobs are assigned this pass
+	loads := make(map[*WorkerConnection]Load, len(r.Workers))
+	for _, wc := range r.Workers {
+		if wc.Connected() {
+			loads[wc] = wc.Load()
+		}
+	}
+
+	assigned := 0
+	gangs := r.gangs()
+	placed := make(map[string]*gangPlacement)
+	queue := r.JobQueue[:0]
+	requeued := []proto.Job{}
+	for _, job := range r.JobQueue {
+		// the shards of a gang are placed together or not at all
+		if shards, ok := gangs[job.Parent]; ok {
+			if _, ok := placed[job.Parent]; !ok {
+				if reason := r.overQuota(usage, shards); reason != "" {
+					r.waitingGang(job.Parent, shards, reason)
+					placed[job.Parent] = &gangPlacement{}
+				} else if reason := r.overHostRate(hosts, shards); reason != "" {
+					r.waitingGang(job.Parent, shards, reason)
+					placed[job.Parent] = &gangPlacement{}
+				} else {
+					placed[job.Parent] = r.placeGang(loads, usage, job.Parent, shards)
+				}
+			}
+			gang := placed[job.Parent]
+			if gang.workers == nil {
+				queue = append(queue, job)
+				continue
+			}
+			wc := gang.workers[job.ID]
+			start := gang.start
+			job.StartAt = &start
+			r.charge(usage, wc, job)
+			hosts.add(job)
+			r.assign(wc, job)
+			assigned += 1
+			continue
+		}
+
+		if wc := r.stopping(job.ID); wc != nil {
+			queue = append(queue, job)
+			r.unschedulable(job, fmt.Sprintf("stopping on worker %s", wc.ID))
+			continue
+		}
+		job, ok := r.resume(job)
+		if !ok {
+			continue
+		}
+
+		if reason := r.overQuota(usage, []proto.Job{job}); reason != "" {
+			queue = append(queue, job)
+			r.unschedulable(job, reason)
+			continue
+		}
+		if reason := r.overHostRate(hosts, []proto.Job{job}); reason != "" {
+			queue = append(queue, job)
+			r.unschedulable(job, reason)
+			continue
+		}
+
+		wc, reason := r.pickWorker(loads, usage, nil, job)
+		if wc == nil && r.config.Preemption {
+			var victims []proto.Job
+			wc, victims = r.preempt(usage, job)
+			if wc != nil {
+				requeued = append(requeued, victims...)
+				loads[wc] = wc.Load()
+			}
+		}
+		if wc == nil {
+			queue = append(queue, job)
+			r.unschedulable(job, reason)
+			continue
+		}
+
+		loads[wc] = loads[wc].Add(job)
+		r.charge(usage, wc, job)
+		hosts.add(job)
+		r.assign(wc, job)
+		assigned += 1
+	}
+	// preempted jobs resume once their workers stop them
+	for _, victim := range requeued {
+		if js, ok := r.Jobs[victim.ID]; ok {
+			queue = append(queue, js.Job)
+		}
+	}
+	r.JobQueue = queue
+	if assigned == 0 {
+		return
+	}
+
+	r.log.Debug().Func(func(e *zerolog.Event) {
+		l := e.Int("jobQueue", len(r.JobQueue))
+		for i := range r.JobQueue {
+			l.Str(fmt.Sprint(i), r.JobQueue[i].ID)
+		}
+	}).Msg("jobQueue items")
+
+	r.Workers = shiftSlice(r.Workers)
+}
+
+// assign starts a new run of the job and sends it to the worker once the
+// run is saved
+func (r *runtime) assign(wc *WorkerConnection, job proto.Job) {
+	r.served[job.Owner] += 1
+	r.AssignedJobs = append(r.AssignedJobs, job)
+	if js, ok := r.Jobs[job.ID]; ok {
+		js.runs = append(js.runs, jobRun{workerID: wc.ID, credential: wc.Credential()})
+	}
+	r.transitionJob(job.ID, wc.ID, JobStateAssigned, "")
+	wc.AssignJob(job)
+
+	load := wc.Load()
+	r.log.Info().
+		Str("workerID", wc.ID).
+		Str("workerState", wc.CurrentState()).
+		Str("JobID", job.ID).
+		Int("jobs", load.Jobs).
+		Int("rate", load.Rate).
+		Int("concurrency", load.Concurrency).
+		Msg("Assigned job")
+}
+
+// pickWorker returns the worker that would be the least utilized after
+// taking the job, or nil and the reason the job doesn't fit on any worker.
+// pending is the jobs placed on each worker that it has not been sent yet.
+func (r *runtime) pickWorker(loads map[*WorkerConnection]Load, usage namespaceUsages, pending map[*WorkerConnection][]proto.Job, job proto.Job) (*WorkerConnection, string) {
+	var best *WorkerConnection
+	var bestLoad Load
+	bestScore := 0.0
+
+	spread := r.spreadValues(job, pending)
+	rejected := make(map[string]int)
+	for _, wc := range r.Workers {
+		load, ok := loads[wc]
+		if !ok {
+			continue
+		}
+		if reason := placeable(wc, append(wc.Jobs(), pending[wc]...), job, spread); reason != "" {
+			rejected[reason] += 1
+			continue
+		}
+		if !r.mayUseWorker(usage, pending, wc, job) {
+			rejected["over the namespace's worker quota"] += 1
+			continue
+		}
+		load = load.Add(job)
+		score, fits := utilization(wc, load)
+		if !fits {
+			rejected["at capacity"] += 1
+			continue
+		}
+		if best == nil || score < bestScore || (score == bestScore && load.Jobs < bestLoad.Jobs) {
+			best, bestLoad, bestScore = wc, load, score
+		}
+	}
+
+	if best == nil {
+		return nil, unschedulableReason(len(loads), rejected)
+	}
+	return best, ""
+}
+
+// placeable checks the job's placement constraints against the worker and
+// the jobs on it, and returns why the worker can't take the job
+func placeable(wc *WorkerConnection, jobs []proto.Job, job proto.Job, spread map[string]bool) string {
+	if !job.Matches(wc.Labels) {
+		return "selector mismatch"
+	}
+
+	for _, other := range jobs {
+		if other.ID != job.ID && contains(job.AntiAffinity, other.Group()) {
+			return "anti-affinity"
+		}
+	}
+
+	if job.SpreadBy != "" && job.Parent != "" {
+		value, ok := wc.Labels[job.SpreadBy]
+		if !ok {
+			return fmt.Sprintf("no %s label", job.SpreadBy)
+		}
+		if spread[value] {
+			return fmt.Sprintf("%s already has a shard", job.SpreadBy)
+		}
+	}
+
+	return ""
+}
+
+// spreadValues returns the label values of the workers the job's sibling
+// shards are placed on
+func (r *runtime) spreadValues(job proto.Job, pending map[*WorkerConnection][]proto.Job) map[string]bool {
+	values := make(map[string]bool)
+	if job.SpreadBy == "" || job.Parent == "" {
+		return values
+	}
+	for _, wc := range r.Workers {
+		for _, other := range append(wc.Jobs(), pending[wc]...) {
+			if other.Parent == job.Parent && other.ID != job.ID {
+				values[wc.Labels[job.SpreadBy]] = true
+			}
+		}
+	}
+	return values
+}
+
+// spreadCount is the number of shards to split a spread job into, one per
+// eligible worker or one per value of the SpreadBy label
+func (r *runtime) spreadCount(job proto.Job) int {
+	values := make(map[string]bool)
+	count := 0
+	for _, wc := range r.Workers {
+		if !wc.Connected() || !job.Matches(wc.Labels) {
+			continue
+		}
+		count += 1
+		if v, ok := wc.Labels[job.SpreadBy]; ok {
+			values[v] = true
+		}
+	}
+	if job.SpreadBy != "" {
+		return len(values)
+	}
+	return count
+}
+
+// unschedulable records why the job is still queued on its status
+func (r *runtime) unschedulable(job proto.Job, reason string) {
+	js, ok := r.Jobs[job.ID]
+	if !ok || js.Reason == reason {
+		return
+	}
+	js.Reason = reason
+	r.log.Debug().Str("jobID", job.ID).Str("reason", reason).Msg("job unschedulable")
+
+	if parent, ok := r.Jobs[job.Parent]; ok && parent.State == JobStateQueued {
+		parent.Reason = fmt.Sprintf("shard %s: %s", job.ID, reason)
+	}
+}
+
+func unschedulableReason(workers int, rejected map[string]int) string {
+	if workers == 0 {
+		return "no workers connected"
+	}
+
+	reasons := make([]string, 0, len(rejected))
+	for reason, count := range rejected {
+		reasons = append(reasons, fmt.Sprintf("%d %s", count, reason))
+	}
+	sort.Strings(reasons)
+
+	return fmt.Sprintf("0/%d workers available: %s", workers, strings.Join(reasons, ", "))
+}
+
+// utilization is the highest ratio of load to the worker's limits, and if
+// the load fits within the limits. Unlimited dimensions don't count.
+func utilization(wc *WorkerConnection, load Load) (float64, bool) {
+	score := 0.0
+	fits := true
+	for _, dim := range []struct {
+		used  int
+		limit uint
+	}{
+		{load.Jobs, wc.Capacity},
+		{load.Rate, wc.MaxRate},
+		{load.Concurrency, wc.MaxConcurrency},
+	} {
+		if dim.limit == 0 {
+			continue
+		}
+		ratio := float64(dim.used) / float64(dim.limit)
+		if ratio > 1 {
+			fits = false
+		}
+		if ratio > score {
+			score = ratio
+		}
+	}
+	return score, fits
+}
+
+// pruneWorkers drops the workers whose connection closed
+func pruneWorkers(workers []*WorkerConnection) []*WorkerConnection {
+	kept := workers[:0]
+	for _, wc := range workers {
+		if wc.CurrentState() != "closed" {
+			kept = append(kept, wc)
+		}
+	}
+	return kept
+}
+
+func shiftSlice[V *WorkerConnection](s []V) []V {
+	if len(s) <= 1 {
+		return s
+	}
+	temp := s[0]
+	ret := s[1:]
+	ret = append(ret, temp)
+	return ret
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"testing"
+
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+func TestPickWorker(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).(*runtime)
+	full := testWorker(r, "full")
+	full.Capacity = 1
+	full.AssignJob(proto.Job{ID: "f1"})
+	slow := testWorker(r, "slow")
+	slow.MaxRate = 10
+	busy := testWorker(r, "busy")
+	busy.AssignJob(proto.Job{ID: "b1"})
+	busy.AssignJob(proto.Job{ID: "b2"})
+	idle := testWorker(r, "idle")
+	idle.AssignJob(proto.Job{ID: "i1"})
+
+	loads := func() map[*WorkerConnection]Load {
+		loads := make(map[*WorkerConnection]Load)
+		for _, wc := range r.Workers {
+			loads[wc] = wc.Load()
+		}
+		return loads
+	}
+	job := proto.Job{ID: "j", Rate: 50}
+
+	// workers at their capacity or rate are skipped, the least loaded of
+	// the rest is chosen
+	if wc, reason := r.pickWorker(loads(), namespaceUsages{}, nil, job); wc != idle {
+		t.Errorf("picked %s %q, want idle", workerID(wc), reason)
+	}
+	idle.AssignJob(proto.Job{ID: "i2"})
+	idle.AssignJob(proto.Job{ID: "i3"})
+	if wc, reason := r.pickWorker(loads(), namespaceUsages{}, nil, job); wc != busy {
+		t.Errorf("picked %s %q, want busy", workerID(wc), reason)
+	}
+
+	r.Workers = []*WorkerConnection{full, slow}
+	wc, reason := r.pickWorker(loads(), namespaceUsages{}, nil, job)
+	if wc != nil || reason != "0/2 workers available: 2 at capacity" {
+		t.Errorf("picked %s %q", workerID(wc), reason)
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).(*runtime)
+	x := testWorker(r, "x")
+	x.Labels = map[string]string{"zone": "x"}
+	y := testWorker(r, "y")
+	y.Labels = map[string]string{"zone": "y"}
+	y.AssignJob(proto.Job{ID: "y1"})
+	y.AssignJob(proto.Job{ID: "y2"})
+	loads := map[*WorkerConnection]Load{x: x.Load(), y: y.Load()}
+
+	if wc, reason := r.pickWorker(loads, namespaceUsages{}, nil, proto.Job{ID: "j", Selector: map[string]string{"zone": "y"}}); wc != y {
+		t.Errorf("picked %s %q, want y", workerID(wc), reason)
+	}
+	wc, reason := r.pickWorker(loads, namespaceUsages{}, nil, proto.Job{ID: "j", Selector: map[string]string{"zone": "z"}})
+	if wc != nil || reason != "0/2 workers available: 2 selector mismatch" {
+		t.Errorf("picked %s %q", workerID(wc), reason)
+	}
+
+	// x is the least loaded, but runs a job j won't share a worker with
+	x.AssignJob(proto.Job{ID: "other"})
+	loads[x] = x.Load()
+	if wc, reason := r.pickWorker(loads, namespaceUsages{}, nil, proto.Job{ID: "j", AntiAffinity: []string{"other"}}); wc != y {
+		t.Errorf("picked %s %q, want y", workerID(wc), reason)
+	}
+	if reason := placeable(x, x.Jobs(), proto.Job{ID: "j", AntiAffinity: []string{"other"}}, nil); reason != "anti-affinity" {
+		t.Errorf("x %q, want anti-affinity", reason)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).(*runtime)
+	for _, w := range []struct{ id, zone string }{{"a", "x"}, {"b", "x"}, {"c", "y"}, {"d", "z"}} {
+		testWorker(r, w.id).Labels = map[string]string{"zone": w.zone, "disk": "ssd"}
+	}
+	testWorker(r, "e").Labels = map[string]string{"zone": "w"}
+
+	if n := r.spreadCount(proto.Job{Spread: true}); n != 5 {
+		t.Errorf("spread over %d workers, want 5", n)
+	}
+	if n := r.spreadCount(proto.Job{Spread: true, SpreadBy: "zone", Selector: map[string]string{"disk": "ssd"}}); n != 3 {
+		t.Errorf("spread over %d zones, want 3", n)
+	}
+
+	r.AddJob(proto.Job{ID: "s", URL: "http://localhost", Req: 30, Spread: true, SpreadBy: "zone", Selector: map[string]string{"disk": "ssd"}})
+	r.mu.Lock()
+	r.schedule()
+	r.mu.Unlock()
+
+	// one shard per zone
+	zones := make(map[string]int)
+	for _, wc := range r.Workers {
+		for range wc.Jobs() {
+			zones[wc.Labels["zone"]] += 1
+		}
+	}
+	if len(zones) != 3 || zones["x"] != 1 || zones["y"] != 1 || zones["z"] != 1 {
+		t.Errorf("shards per zone %v", zones)
+	}
+	shard := proto.Job{ID: "s-9", Parent: "s", SpreadBy: "zone"}
+	spread := r.spreadValues(shard, nil)
+	if len(spread) != 3 {
+		t.Errorf("spread values %v", spread)
+	}
+	for _, wc := range r.Workers {
+		if reason := placeable(wc, wc.Jobs(), shard, spread); wc.ID != "e" && reason != "zone already has a shard" {
+			t.Errorf("%s %q for another shard", wc.ID, reason)
+		}
+	}
+}
+
+func workerID(wc *WorkerConnection) string {
+	if wc == nil {
+		return "none"
+	}
+	return wc.ID
+}
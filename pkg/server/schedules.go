@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+var (
+	// SCHEDULE_HISTORY is the number of runs kept per schedule
+	SCHEDULE_HISTORY = 100
+)
+
+// Schedule queues a new job from the template each time the cron
+// expression matches
+type Schedule struct {
+	ID        string    `json:"id"`
+	Cron      string    `json:"cron"`
+	Job       proto.Job `json:"job"`
+	Suspended bool      `json:"suspended"`
+	Created   time.Time `json:"created"`
+	// Next run, nil while suspended
+	Next *time.Time    `json:"next,omitempty"`
+	Runs []ScheduleRun `json:"runs"`
+
+	cron *cronSchedule
+}
+
+// ScheduleRun is a time the schedule matched and the job it queued
+type ScheduleRun struct {
+	At    time.Time `json:"at"`
+	JobID string    `json:"jobID,omitempty"`
+	State JobState  `json:"state,omitempty"`
+	// Skipped is why no job was queued
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// ScheduleSpec is a schedule as submitted
+type ScheduleSpec struct {
+	ID        string    `json:"id"`
+	Cron      string    `json:"cron"`
+	Job       proto.Job `json:"job"`
+	Suspended bool      `json:"suspended"`
+}
+
+// ScheduleUpdate suspends or resumes the schedule, or changes its cron
+// expression
+type ScheduleUpdate struct {
+	ID        string  `json:"-"`
+	Cron      *string `json:"cron"`
+	Suspended *bool   `json:"suspended"`
+}
+
+// NewSchedule parses the cron expression of the schedule
+func NewSchedule(id, expr string, job proto.Job, suspended bool) (*Schedule, error) {
+	cron, err := parseCron(expr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Schedule{
+		ID:        id,
+		Cron:      expr,
+		Job:       job,
+		Suspended: suspended,
+		Created:   time.Now(),
+		Runs:      []ScheduleRun{},
+		cron:      cron,
+	}
+	s.plan(time.Now())
+	if !s.Suspended && s.Next == nil {
+		return nil, fmt.Errorf("cron expression %q never matches", expr)
+	}
+	return s, nil
+}
+
+// plan sets the next run after t
+func (s *Schedule) plan(t time.Time) {
+	s.Next = nil
+	if s.Suspended {
+		return
+	}
+	if next := s.cron.Next(t); !next.IsZero() {
+		s.Next = &next
+	}
+}
+
+// AddSchedule stores the schedule, it returns false if a schedule with the
+// ID exists
+func (r *runtime) AddSchedule(s *Schedule) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.Schedules[s.ID]; ok {
+		return false
+	}
+	r.Schedules[s.ID] = s
+	r.saveSchedule(s)
+	r.log.Info().Str("scheduleID", s.ID).Str("cron", s.Cron).Msg("schedule added")
+	return true
+}
+
+// UpdateSchedule applies the update, it returns false when the schedule is
+// unknown and an error when the cron expression is invalid
+func (r *runtime) UpdateSchedule(u ScheduleUpdate) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.Schedules[u.ID]
+	if !ok {
+		return false, nil
+	}
+	if u.Cron != nil {
+		cron, err := parseCron(*u.Cron)
+		if err != nil {
+			return true, err
+		}
+		s.Cron = *u.Cron
+		s.cron = cron
+	}
+	if u.Suspended != nil {
+		s.Suspended = *u.Suspended
+	}
+	s.plan(time.Now())
+	r.saveSchedule(s)
+	r.log.Info().Str("scheduleID", s.ID).Str("cron", s.Cron).Bool("suspended", s.Suspended).Msg("schedule updated")
+
+	return true, nil
+}
+
+// DeleteSchedule removes the schedule, jobs it queued are left as they are
+func (r *runtime) DeleteSchedule(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.Schedules[id]; !ok {
+		return false
+	}
+	delete(r.Schedules, id)
+	r.forget(bucketSchedules, id)
+	r.log.Info().Str("scheduleID", id).Msg("schedule deleted")
+	return true
+}
+
+// GetSchedule returns a copy of the schedule with the state of its jobs
+func (r *runtime) GetSchedule(id string) (Schedule, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.Schedules[id]
+	if !ok {
+		return Schedule{}, false
+	}
+	return r.scheduleStatus(s), true
+}
+
+// ListSchedules returns the schedules, oldest first
+func (r *runtime) ListSchedules() []Schedule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	schedules := []Schedule{}
+	for _, s := range r.Schedules {
+		schedules = append(schedules, r.scheduleStatus(s))
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Created.Before(schedules[j].Created)
+	})
+	return schedules
+}
+
+func (r *runtime) scheduleStatus(s *Schedule) Schedule {
+	status := *s
+	status.Runs = make([]ScheduleRun, len(s.Runs))
+	for i, run := range s.Runs {
+		if js, ok := r.Jobs[run.JobID]; ok {
+			run.State = js.State
+		}
+		status.Runs[i] = run
+	}
+	return status
+}
+
+// runSchedules queues a job for every schedule that is due. A run is
+// skipped while the job of the previous run hasn't finished.
+func (r *runtime) runSchedules(now time.Time) {
+	for _, s := range r.Schedules {
+		if s.Next == nil || now.Before(*s.Next) {
+			continue
+		}
+		run := ScheduleRun{At: *s.Next}
+		s.plan(now)
+
+		if id := s.lastJob(); id != "" {
+			if js, ok := r.Jobs[id]; ok && !js.State.Terminal() {
+				run.Skipped = fmt.Sprintf("job %s has not finished", js.Job.ID)
+				r.log.Info().Str("scheduleID", s.ID).Str("jobID", js.Job.ID).Msg("schedule run skipped")
+				s.record(run)
+				r.saveSchedule(s)
+				continue
+			}
+		}
+
+		job := s.Job
+		job.ID = fmt.Sprintf("%s-%s", s.ID, run.At.UTC().Format("20060102T1504"))
+		if !r.addJob(job) {
+			run.Skipped = fmt.Sprintf("job %s exists", job.ID)
+		} else {
+			run.JobID = job.ID
+			r.log.Info().Str("scheduleID", s.ID).Str("jobID", job.ID).Msg("schedule run")
+		}
+		s.record(run)
+		r.saveSchedule(s)
+	}
+}
+
+// lastJob is the ID of the job the schedule last queued
+func (s *Schedule) lastJob() string {
+	for i := len(s.Runs) - 1; i >= 0; i-- {
+		if s.Runs[i].JobID != "" {
+			return s.Runs[i].JobID
+		}
+	}
+	return ""
+}
+
+func (s *Schedule) record(run ScheduleRun) {
+	s.Runs = append(s.Runs, run)
+	if len(s.Runs) > SCHEDULE_HISTORY {
+		s.Runs = s.Runs[len(s.Runs)-SCHEDULE_HISTORY:]
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/auth"
+)
+
+// Stop is the emergency stop: while it is on, every job was cancelled on
+// its worker and the scheduler starts no job until it is resumed
+type Stop struct {
+	Stopped bool       `json:"stopped"`
+	By      string     `json:"by,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+	At      *time.Time `json:"at,omitempty"`
+	// Cancelled is the jobs the stop cancelled
+	Cancelled []string `json:"cancelled,omitempty"`
+	// ResumedBy and ResumedAt are who last resumed the scheduler and when
+	ResumedBy string     `json:"resumedBy,omitempty"`
+	ResumedAt *time.Time `json:"resumedAt,omitempty"`
+}
+
+// stopReason is the reason of the jobs stopped or held by the stop
+func (s Stop) stopReason() string {
+	reason := fmt.Sprintf("emergency stop by %s", s.By)
+	if s.Reason != "" {
+		reason += ": " + s.Reason
+	}
+	return reason
+}
+
+// StopAll cancels every job assigned to a worker and freezes the scheduler
+// until Resume. Queued jobs stay queued. Stopping again cancels any job
+// that started since and keeps the first stop's caller and time.
+func (r *runtime) StopAll(by, reason string) Stop {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.stop.Stopped {
+		now := time.Now()
+		r.stop = Stop{Stopped: true, By: by, Reason: reason, At: &now, ResumedBy: r.stop.ResumedBy, ResumedAt: r.stop.ResumedAt}
+	}
+
+	cancelled := []string{}
+	for _, wc := range r.Workers {
+		for _, job := range wc.Jobs() {
+			wc.CancelJob(job.ID, "stop")
+			r.transitionJob(job.ID, wc.ID, JobStateCancelled, r.stop.stopReason())
+			cancelled = append(cancelled, job.ID)
+		}
+	}
+	// jobs waiting on their worker to reconnect after a restart are
+	// cancelled on the worker when it does
+	for id, o := range r.orphans {
+		delete(r.orphans, id)
+		r.AssignedJobs = removeJob(r.AssignedJobs, id)
+		r.transitionJob(id, o.workerID, JobStateCancelled, r.stop.stopReason())
+		cancelled = append(cancelled, id)
+	}
+	sort.Strings(cancelled)
+	r.stop.Cancelled = append(r.stop.Cancelled, cancelled...)
+	r.save(bucketStop, "stop", r.stop)
+
+	r.log.Warn().Str("by", by).Str("reason", reason).Int("cancelled", len(cancelled)).Msg("emergency stop")
+	return r.stop
+}
+
+// Resume lets the scheduler start jobs again after a stop, it returns false
+// if the scheduler wasn't stopped
+func (r *runtime) Resume(by string) (Stop, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.stop.Stopped {
+		return r.stop, false
+	}
+	now := time.Now()
+	r.stop.Stopped = false
+	r.stop.ResumedBy = by
+	r.stop.ResumedAt = &now
+	r.save(bucketStop, "stop", r.stop)
+
+	r.log.Warn().Str("by", by).Str("stoppedBy", r.stop.By).Dur("stopped", now.Sub(*r.stop.At)).Msg("resumed after emergency stop")
+	return r.stop, true
+}
+
+// StopStatus is the emergency stop as it is
+func (r *runtime) StopStatus() Stop {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stop
+}
+
+// holdQueue gives every queued job the stop as the reason it isn't started
+func (r *runtime) holdQueue() {
+	for _, job := range r.JobQueue {
+		r.unschedulable(job, r.stop.stopReason())
+	}
+}
+
+func (r *runtime) restoreStop() error {
+	records, err := r.store.Load(bucketStop)
+	if err != nil {
+		return err
+	}
+	if b, ok := records["stop"]; ok {
+		if err := json.Unmarshal(b, &r.stop); err != nil {
+			return fmt.Errorf("stop: %w", err)
+		}
+	}
+	if r.stop.Stopped {
+		r.log.Warn().Str("by", r.stop.By).Str("reason", r.stop.Reason).Msg("scheduler stays stopped")
+	}
+	return nil
+}
+
+// mayStop checks the caller is an admin of every namespace, the stop
+// applies to all of them
+func mayStop(req *http.Request) *APIError {
+	id := auth.FromContext(req.Context())
+	if len(id.Namespaces) > 0 {
+		return apiError(http.StatusForbidden, ErrCodeForbidden, "%s is an admin of namespaces %v, only admins of every namespace may stop the scheduler", id.Name, id.Namespaces)
+	}
+	return nil
+}
+
+// stopCaller is who stopped or resumed the scheduler, the caller's address
+// when callers aren't authenticated. Forwarding headers are the caller's to
+// set, so they aren't trusted.
+func (r *runtime) stopCaller(req *http.Request) string {
+	if by := r.submitter(req); by != "" {
+		return by
+	}
+	return req.RemoteAddr
+}
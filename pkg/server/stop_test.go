@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/gideonw/peltr/pkg/auth"
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+// testWorker is a connected worker at the end of a pipe nothing reads
+func testWorker(r *runtime, id string) *WorkerConnection {
+	conn, _ := net.Pipe()
+	wc := NewWorkerConnection(zerolog.Nop(), conn, r)
+	wc.ID, wc.State, wc.Capacity = id, "alive", 10
+	r.Workers = append(r.Workers, wc)
+	return wc
+}
+
+func TestStopAll(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peltr.db")
+	a := testServer(t, path, "a")
+	a.campaign()
+	wc := testWorker(a, "w")
+
+	a.AddJob(proto.Job{ID: "running", Req: 10})
+	a.mu.Lock()
+	a.schedule()
+	a.mu.Unlock()
+	if !wc.HasJob("running") {
+		t.Fatal("job not assigned")
+	}
+
+	stop := a.StopAll("ada", "incident")
+	if !stop.Stopped || stop.By != "ada" || len(stop.Cancelled) != 1 {
+		t.Errorf("stop %+v", stop)
+	}
+	if js, _ := a.GetJob("running"); js.State != JobStateCancelled || js.Reason != "emergency stop by ada: incident" {
+		t.Errorf("running job %s %q", js.State, js.Reason)
+	}
+	if wc.HasJob("running") {
+		t.Error("job kept on its worker")
+	}
+
+	// queued jobs wait, across a change of leader, until resumed
+	a.AddJob(proto.Job{ID: "queued", Req: 10})
+	a.mu.Lock()
+	a.schedule()
+	a.mu.Unlock()
+	if wc.HasJob("queued") {
+		t.Error("job started while stopped")
+	}
+	a.Close()
+
+	b := testServer(t, path, "b")
+	b.campaign()
+	if stop := b.StopStatus(); !stop.Stopped || stop.By != "ada" {
+		t.Fatalf("b restored %+v", stop)
+	}
+	wc = testWorker(b, "w")
+	if stop, ok := b.Resume("bea"); !ok || stop.Stopped || stop.ResumedBy != "bea" {
+		t.Errorf("resume %+v %v", stop, ok)
+	}
+	if _, ok := b.Resume("bea"); ok {
+		t.Error("resumed twice")
+	}
+	b.mu.Lock()
+	b.schedule()
+	b.mu.Unlock()
+	if !wc.HasJob("queued") {
+		t.Error("queued job not started after resume")
+	}
+}
+
+func TestAPIStop(t *testing.T) {
+	tokens := auth.StaticTokens{
+		"s": {Name: "sam", Role: auth.RoleSubmitter},
+		"t": {Name: "tia", Role: auth.RoleAdmin, Namespaces: []string{"team-a"}},
+		"a": {Name: "ada", Role: auth.RoleAdmin},
+	}
+	api := NewRuntime(testMetrics{}, zerolog.Nop(), Config{Auth: tokens}).APIHandler()
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	for _, tc := range []struct {
+		name, method, body string
+		token              string
+		status             int
+	}{
+		{"submitter", "POST", `{}`, "s", 403},
+		{"namespace admin", "POST", `{}`, "t", 403},
+		{"not stopped", "DELETE", ``, "a", 409},
+		{"admin", "POST", `{"reason": "incident"}`, "a", 200},
+		{"viewer reads", "GET", ``, "s", 200},
+		{"no reason", "POST", ``, "a", 200},
+		{"submitter without a body", "POST", ``, "s", 403},
+		{"resume", "DELETE", ``, "a", 200},
+	} {
+		rw := apiRequest(api, tc.method, "/api/v1/stop", tc.body, bearer(tc.token))
+		if rw.Code != tc.status {
+			t.Errorf("%s: %d %s, expected %d", tc.name, rw.Code, rw.Body.String(), tc.status)
+		}
+	}
+}
+
+func TestAPIStopCaller(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).(*runtime)
+	rw := apiRequest(r.APIHandler(), "POST", "/api/v1/stop", `{}`, map[string]string{"X-Forwarded-For": "ada"})
+	if rw.Code != 200 {
+		t.Fatalf("%d %s", rw.Code, rw.Body.String())
+	}
+	// without authentication the stop is the caller's address, whatever it
+	// claims to forward
+	if stop := r.StopStatus(); stop.By != "192.0.2.1:1234" {
+		t.Errorf("stopped by %q", stop.By)
+	}
+}
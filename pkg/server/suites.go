@@ -0,0 +1,416 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+type SuiteState string
+
+const (
+	SuiteStateRunning   SuiteState = "running"
+	SuiteStatePassed    SuiteState = "passed"
+	SuiteStateFailed    SuiteState = "failed"
+	SuiteStateCancelled SuiteState = "cancelled"
+)
+
+// Phases of a suite, setup runs before the steps and teardown runs after
+// them whatever their outcome
+const (
+	PhaseSetup    = "setup"
+	PhaseStep     = "step"
+	PhaseTeardown = "teardown"
+)
+
+// States of a step before its job is queued, a step is skipped when a step
+// it depends on didn't complete
+const (
+	StepStatePending JobState = "pending"
+	StepStateSkipped JobState = "skipped"
+)
+
+// SuiteStep is a job of the suite, it runs once the steps it comes after
+// have completed
+type SuiteStep struct {
+	Name  string    `json:"name"`
+	After []string  `json:"after,omitempty"`
+	Job   proto.Job `json:"job"`
+}
+
+// SuiteSpec is a suite as submitted
+type SuiteSpec struct {
+	ID string `json:"id"`
+	// Namespace of the suite and the jobs of its steps
+	Namespace string      `json:"namespace,omitempty"`
+	Setup     []SuiteStep `json:"setup,omitempty"`
+	Steps     []SuiteStep `json:"steps"`
+	Teardown  []SuiteStep `json:"teardown,omitempty"`
+}
+
+// StepStatus tracks a step of the suite, State is the state of its job
+// once queued
+type StepStatus struct {
+	Name   string   `json:"name"`
+	Phase  string   `json:"phase"`
+	After  []string `json:"after,omitempty"`
+	JobID  string   `json:"jobID,omitempty"`
+	State  JobState `json:"state"`
+	Reason string   `json:"reason,omitempty"`
+
+	job proto.Job
+}
+
+// Suite runs its steps in dependency order and passes if they all complete
+type Suite struct {
+	ID       string       `json:"id"`
+	State    SuiteState   `json:"state"`
+	Reason   string       `json:"reason,omitempty"`
+	Created  time.Time    `json:"created"`
+	Finished *time.Time   `json:"finished,omitempty"`
+	Steps    []StepStatus `json:"steps"`
+	// SubmittedBy is the caller that submitted the suite
+	SubmittedBy string `json:"submittedBy,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+
+	cancelled bool
+}
+
+// submittedBy records the caller as the submitter of the suite and the
+// jobs of its steps
+func (s *Suite) submittedBy(name string) {
+	s.SubmittedBy = name
+	for i := range s.Steps {
+		s.Steps[i].job.SubmittedBy = name
+	}
+}
+
+// NewSuite checks the steps of the suite form a DAG: names are unique, a
+// step only comes after steps of its own or an earlier phase, and there
+// are no cycles
+func NewSuite(spec SuiteSpec) (*Suite, error) {
+	s := &Suite{
+		ID:        spec.ID,
+		Namespace: spec.Namespace,
+		State:     SuiteStateRunning,
+		Created:   time.Now(),
+		Steps:     []StepStatus{},
+	}
+	if len(spec.Steps) == 0 {
+		return nil, fmt.Errorf("suite has no steps")
+	}
+
+	phases := make(map[string]string)
+	for _, phase := range []struct {
+		name  string
+		steps []SuiteStep
+	}{{PhaseSetup, spec.Setup}, {PhaseStep, spec.Steps}, {PhaseTeardown, spec.Teardown}} {
+		for _, step := range phase.steps {
+			if step.Name == "" || strings.ContainsAny(step.Name, "/ ") {
+				return nil, fmt.Errorf("step name %q must be set and have no spaces or slashes", step.Name)
+			}
+			if _, ok := phases[step.Name]; ok {
+				return nil, fmt.Errorf("step %s is defined twice", step.Name)
+			}
+			if step.Job.Namespace != "" && step.Job.Namespace != spec.Namespace {
+				return nil, fmt.Errorf("step %s is in namespace %s, the suite is in %q", step.Name, step.Job.Namespace, spec.Namespace)
+			}
+			step.Job.Namespace = spec.Namespace
+			phases[step.Name] = phase.name
+			s.Steps = append(s.Steps, StepStatus{
+				Name:  step.Name,
+				Phase: phase.name,
+				After: step.After,
+				State: StepStatePending,
+				job:   step.Job,
+			})
+		}
+	}
+
+	order := map[string]int{PhaseSetup: 0, PhaseStep: 1, PhaseTeardown: 2}
+	for _, step := range s.Steps {
+		for _, dep := range step.After {
+			phase, ok := phases[dep]
+			if !ok {
+				return nil, fmt.Errorf("step %s comes after unknown step %s", step.Name, dep)
+			}
+			if order[phase] > order[step.Phase] {
+				return nil, fmt.Errorf("%s step %s can't come after %s step %s", step.Phase, step.Name, phase, dep)
+			}
+		}
+	}
+	if cycle := s.cycle(); cycle != "" {
+		return nil, fmt.Errorf("steps depend on each other: %s", cycle)
+	}
+
+	return s, nil
+}
+
+// cycle returns a dependency cycle between the steps, i.e. a -> b -> a
+func (s *Suite) cycle() string {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(name string, path []string) string
+	visit = func(name string, path []string) string {
+		switch state[name] {
+		case visiting:
+			return strings.Join(append(path, name), " -> ")
+		case visited:
+			return ""
+		}
+		state[name] = visiting
+		for _, dep := range s.step(name).After {
+			if cycle := visit(dep, append(path, name)); cycle != "" {
+				return cycle
+			}
+		}
+		state[name] = visited
+		return ""
+	}
+
+	for _, step := range s.Steps {
+		if cycle := visit(step.Name, nil); cycle != "" {
+			return cycle
+		}
+	}
+	return ""
+}
+
+func (s *Suite) step(name string) *StepStatus {
+	for i := range s.Steps {
+		if s.Steps[i].Name == name {
+			return &s.Steps[i]
+		}
+	}
+	return nil
+}
+
+// done reports if the step finished, whatever its outcome
+func (step *StepStatus) done() bool {
+	return step.State == StepStateSkipped || step.State.Terminal()
+}
+
+// AddSuite queues the suite, it returns false if a suite with the ID exists
+func (r *runtime) AddSuite(s *Suite) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.Suites[s.ID]; ok {
+		return false
+	}
+	r.Suites[s.ID] = s
+	r.log.Info().Str("suiteID", s.ID).Int("steps", len(s.Steps)).Msg("suite added")
+	r.runSuite(s)
+	return true
+}
+
+// CancelSuite cancels the running steps and skips the steps that have not
+// started, the teardown still runs
+func (r *runtime) CancelSuite(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.Suites[id]
+	if !ok {
+		return false
+	}
+	if s.State != SuiteStateRunning || s.cancelled {
+		return true
+	}
+	s.cancelled = true
+	r.log.Info().Str("suiteID", id).Msg("suite cancelled")
+
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if step.Phase == PhaseTeardown || step.done() {
+			continue
+		}
+		if step.JobID == "" {
+			step.State = StepStateSkipped
+			step.Reason = "suite cancelled"
+			continue
+		}
+		r.cancelJobAndShards(step.JobID)
+	}
+	r.runSuite(s)
+	return true
+}
+
+// GetSuite returns a copy of the suite
+func (r *runtime) GetSuite(id string) (Suite, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.Suites[id]
+	if !ok {
+		return Suite{}, false
+	}
+	return r.suiteStatus(s), true
+}
+
+// ListSuites returns the suites, oldest first
+func (r *runtime) ListSuites() []Suite {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	suites := []Suite{}
+	for _, s := range r.Suites {
+		suites = append(suites, r.suiteStatus(s))
+	}
+	sort.Slice(suites, func(i, j int) bool {
+		return suites[i].Created.Before(suites[j].Created)
+	})
+	return suites
+}
+
+func (r *runtime) suiteStatus(s *Suite) Suite {
+	status := *s
+	status.Steps = make([]StepStatus, len(s.Steps))
+	copy(status.Steps, s.Steps)
+	return status
+}
+
+// runSuites moves every running suite forward
+func (r *runtime) runSuites() {
+	for _, s := range r.Suites {
+		if s.State == SuiteStateRunning {
+			r.runSuite(s)
+		}
+	}
+}
+
+// runSuite follows the jobs of the suite's steps, queues the steps that are
+// ready and skips the steps that can't run. The suite is saved when any
+// step changed.
+func (r *runtime) runSuite(s *Suite) {
+	changed := false
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		if step.JobID == "" {
+			continue
+		}
+		if js, ok := r.Jobs[step.JobID]; ok && (step.State != js.State || step.Reason != js.Reason) {
+			step.State = js.State
+			step.Reason = js.Reason
+			changed = true
+		}
+	}
+
+	for progress := true; progress; {
+		progress = false
+		for i := range s.Steps {
+			step := &s.Steps[i]
+			if step.JobID != "" || step.done() {
+				continue
+			}
+			ready, reason := s.ready(step)
+			if reason != "" {
+				step.State = StepStateSkipped
+				step.Reason = reason
+				progress = true
+				changed = true
+				continue
+			}
+			if ready {
+				r.queueStep(s, step)
+				changed = true
+			}
+		}
+	}
+
+	done := true
+	for i := range s.Steps {
+		done = done && s.Steps[i].done()
+	}
+	if done {
+		r.finishSuite(s)
+	}
+	if changed || done {
+		r.saveSuite(s)
+	}
+}
+
+// ready reports if the step can be queued, or the reason it never will be
+func (s *Suite) ready(step *StepStatus) (bool, string) {
+	deps := append([]string{}, step.After...)
+	if step.Phase == PhaseStep {
+		for _, other := range s.Steps {
+			if other.Phase == PhaseSetup {
+				deps = append(deps, other.Name)
+			}
+		}
+	}
+	if step.Phase == PhaseTeardown {
+		// teardown runs once the other phases are done, whatever happened
+		for _, other := range s.Steps {
+			if other.Phase != PhaseTeardown && !other.done() {
+				return false, ""
+			}
+		}
+		for _, dep := range step.After {
+			if !s.step(dep).done() {
+				return false, ""
+			}
+		}
+		return true, ""
+	}
+	if s.cancelled {
+		return false, "suite cancelled"
+	}
+
+	for _, dep := range deps {
+		other := s.step(dep)
+		if !other.done() {
+			return false, ""
+		}
+		if other.State != JobStateCompleted {
+			return false, fmt.Sprintf("%s %s", dep, other.State)
+		}
+	}
+	return true, ""
+}
+
+func (r *runtime) queueStep(s *Suite, step *StepStatus) {
+	job := step.job
+	job.ID = fmt.Sprintf("%s-%s", s.ID, step.Name)
+	if !r.addJob(job) {
+		step.State = StepStateSkipped
+		step.Reason = fmt.Sprintf("job %s exists", job.ID)
+		return
+	}
+	step.JobID = job.ID
+	step.State = JobStateQueued
+	r.log.Info().Str("suiteID", s.ID).Str("step", step.Name).Str("jobID", job.ID).Msg("suite step queued")
+}
+
+// finishSuite sets the outcome of the suite, it passes if every step
+// completed
+func (r *runtime) finishSuite(s *Suite) {
+	now := time.Now()
+	s.Finished = &now
+	s.State = SuiteStatePassed
+	for _, step := range s.Steps {
+		if step.State != JobStateCompleted {
+			s.State = SuiteStateFailed
+			s.Reason = fmt.Sprintf("%s %s %s", step.Phase, step.Name, step.State)
+			break
+		}
+	}
+	if s.cancelled {
+		s.State = SuiteStateCancelled
+		s.Reason = "cancelled by request"
+	}
+	r.log.Info().Str("suiteID", s.ID).Str("state", string(s.State)).Str("reason", s.Reason).Msg("suite finished")
+}
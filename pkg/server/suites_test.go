@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"testing"
+)
+
+func TestNewSuiteInvalid(t *testing.T) {
+	for name, spec := range map[string]SuiteSpec{
+		"no steps":     {},
+		"unnamed step": {Steps: []SuiteStep{{}}},
+		"duplicate":    {Steps: []SuiteStep{{Name: "a"}, {Name: "a"}}},
+		"unknown dep":  {Steps: []SuiteStep{{Name: "a", After: []string{"b"}}}},
+		"cycle":        {Steps: []SuiteStep{{Name: "a", After: []string{"c"}}, {Name: "b", After: []string{"a"}}, {Name: "c", After: []string{"b"}}}},
+		"later phase":  {Setup: []SuiteStep{{Name: "a", After: []string{"b"}}}, Steps: []SuiteStep{{Name: "b"}}},
+	} {
+		if _, err := NewSuite(spec); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSuiteReady(t *testing.T) {
+	s, err := NewSuite(SuiteSpec{
+		Setup:    []SuiteStep{{Name: "setup"}},
+		Steps:    []SuiteStep{{Name: "a"}, {Name: "b", After: []string{"a"}}, {Name: "c"}},
+		Teardown: []SuiteStep{{Name: "teardown"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// steps wait on the setup
+	if ready, _ := s.ready(s.step("a")); ready {
+		t.Error("a is ready before the setup completed")
+	}
+	s.step("setup").State = JobStateCompleted
+	if ready, _ := s.ready(s.step("a")); !ready {
+		t.Error("a is not ready after the setup completed")
+	}
+
+	// a failed step skips the steps after it, the teardown still runs
+	s.step("a").State = JobStateFailed
+	if _, reason := s.ready(s.step("b")); reason != "a failed" {
+		t.Errorf("b skipped for %q, expected a failed", reason)
+	}
+	s.step("b").State = StepStateSkipped
+	if ready, _ := s.ready(s.step("teardown")); ready {
+		t.Error("teardown is ready while c is pending")
+	}
+	s.step("c").State = JobStateCompleted
+	if ready, _ := s.ready(s.step("teardown")); !ready {
+		t.Error("teardown is not ready after the steps finished")
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gideonw/peltr/pkg/proto"
+)
+
+// hostRateLimit is the total req/s the running jobs may send the host, 0 is
+// unlimited. A host's own limit is taken over the longest *.domain pattern
+// that matches it, then MaxHostRate.
+func (r *runtime) hostRateLimit(host string) int {
+	if limit, ok := r.config.HostRates[host]; ok {
+		return limit
+	}
+	limit, longest := r.config.MaxHostRate, 0
+	for pattern, l := range r.config.HostRates {
+		if len(pattern) > longest && proto.MatchHost(pattern, host) {
+			limit, longest = l, len(pattern)
+		}
+	}
+	return limit
+}
+
+// hostRates is the req/s sent to each host
+type hostRates map[string]int
+
+func (rates hostRates) add(job proto.Job) {
+	rates[job.Host()] += job.EffectiveRate()
+}
+
+// hostRates is what the jobs on the workers send each host, leaving out
+// the jobs of the group
+func (r *runtime) hostRates(except string) hostRates {
+	rates := hostRates{}
+	for _, wc := range r.Workers {
+		for _, job := range wc.Jobs() {
+			if job.Group() != except {
+				rates.add(job)
+			}
+		}
+	}
+	return rates
+}
+
+// overHostRate returns why the jobs, a job or the shards of a gang, would
+// send their host more than its limit
+func (r *runtime) overHostRate(rates hostRates, jobs []proto.Job) string {
+	host := jobs[0].Host()
+	limit := r.hostRateLimit(host)
+	if limit == 0 {
+		return ""
+	}
+	rate := 0
+	for _, job := range jobs {
+		rate += job.EffectiveRate()
+	}
+	if rates[host]+rate > limit {
+		return fmt.Sprintf("%s is sent %d of its %d req/s, the job needs %d", host, rates[host], limit, rate)
+	}
+	return ""
+}
+
+// checkTarget checks the job may ever be sent to its target, field names
+// are under prefix
+func (r *runtime) checkTarget(j proto.Job, prefix string) *APIError {
+	host := j.Host()
+	if err := r.config.Targets.Check(host, nil); err != nil {
+		return &APIError{Status: http.StatusForbidden, Code: ErrCodeTargetDenied, Message: err.Error(), Field: prefix + "url"}
+	}
+	if limit := r.hostRateLimit(host); limit > 0 && j.EffectiveRate() > limit {
+		return fieldError(prefix+"rate", "rate %d is over the %d req/s limit of %s", j.EffectiveRate(), limit, host)
+	}
+	return nil
+}
+
+// fitsHostRate checks the job's rate fits next to the jobs running against
+// its host, the job's own runs aren't counted. Field names are under prefix.
+func (r *runtime) fitsHostRate(j proto.Job, prefix string) *APIError {
+	if r.hostRateLimit(j.Host()) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if reason := r.overHostRate(r.hostRates(j.Group()), []proto.Job{j}); reason != "" {
+		return &APIError{Status: http.StatusTooManyRequests, Code: ErrCodeHostRateExceeded, Message: reason, Field: prefix + "rate"}
+	}
+	return nil
+}
+
+// fitsUpdate checks a new rate of the job fits its namespace quota and its
+// host's limit
+func (r *runtime) fitsUpdate(u proto.JobUpdate) *APIError {
+	js, ok := r.GetJob(u.ID)
+	if !ok || u.Rate == nil {
+		return nil
+	}
+	j := js.Job
+	j.Rate = *u.Rate
+	if err := r.fitsQuota(j, ""); err != nil {
+		return err
+	}
+	if err := r.fitsRunningQuota(j); err != nil {
+		return err
+	}
+	if err := r.checkTarget(j, ""); err != nil {
+		return err
+	}
+	return r.fitsHostRate(j, "")
+}
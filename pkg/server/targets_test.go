@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+func TestTargetGuardrails(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{
+		Targets:     proto.TargetPolicy{Allow: []string{"*.test", "localhost"}, Deny: []string{"prod.test"}},
+		MaxHostRate: 100,
+		HostRates:   map[string]int{"*.slow.test": 10, "big.slow.test": 1000},
+	}).(*runtime)
+	api := r.APIHandler()
+
+	for _, tc := range []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{"allowed", "POST", "/api/v1/jobs", `{"id": "a", "url": "http://a.test", "req": 1, "rate": 60}`, 201},
+		{"denied", "POST", "/api/v1/jobs", `{"url": "http://prod.test", "req": 1, "rate": 1}`, 403},
+		{"not allowed", "POST", "/api/v1/jobs", `{"url": "https://example.com", "req": 1, "rate": 1}`, 403},
+		{"over the host's rate", "POST", "/api/v1/jobs", `{"url": "http://x.slow.test", "req": 1, "rate": 20}`, 400},
+		{"pattern's own host", "POST", "/api/v1/jobs", `{"url": "http://big.slow.test:8080", "req": 1, "rate": 500}`, 201},
+		{"denied step", "POST", "/api/v1/suites", `{"steps": [{"name": "s", "job": {"url": "http://prod.test", "req": 1}}]}`, 403},
+		{"denied schedule", "POST", "/api/v1/schedules", `{"cron": "@daily", "job": {"url": "http://prod.test", "req": 1}}`, 403},
+	} {
+		rw := apiRequest(api, tc.method, tc.path, tc.body, nil)
+		if rw.Code != tc.status {
+			t.Errorf("%s: %d %s, expected %d", tc.name, rw.Code, rw.Body.String(), tc.status)
+		}
+	}
+
+	// running jobs count against their host's rate
+	wc := &WorkerConnection{ID: "w", cancelled: make(map[string]bool)}
+	r.Workers = append(r.Workers, wc)
+	wc.AssignJob(proto.Job{ID: "a", URL: "http://a.test", Rate: 60})
+	if reason := r.overHostRate(r.hostRates(""), []proto.Job{{ID: "b", URL: "http://a.test/x", Rate: 50}}); reason == "" {
+		t.Error("b allowed over the rate of a.test")
+	}
+	rw := apiRequest(api, "POST", "/api/v1/jobs", `{"url": "http://a.test", "req": 1, "rate": 50}`, nil)
+	if rw.Code != 429 {
+		t.Errorf("second job to a.test %d %s", rw.Code, rw.Body.String())
+	}
+	rw = apiRequest(api, "PATCH", "/api/v1/jobs/a", `{"rate": 100}`, nil)
+	if rw.Code != 200 {
+		t.Errorf("a's own rate counted against it %d %s", rw.Code, rw.Body.String())
+	}
+
+	// as do the jobs of schedules and suites
+	for _, tc := range []struct {
+		name, path, body string
+		handler          http.Handler
+	}{
+		{"schedule", "/api/v1/schedules", `{"cron": "@daily", "job": {"url": "http://a.test", "req": 1, "rate": 50}}`, api},
+		{"suite", "/api/v1/suites", `{"steps": [{"name": "s", "job": {"url": "http://a.test", "req": 1, "rate": 50}}]}`, api},
+		{"legacy schedule", "/schedule", `{"cron": "@daily", "job": {"url": "http://a.test", "req": 1, "rate": 50}}`, http.HandlerFunc(r.HandleSchedule)},
+		{"legacy suite", "/suite", `{"steps": [{"name": "s", "job": {"url": "http://a.test", "req": 1, "rate": 50}}]}`, http.HandlerFunc(r.HandleSuite)},
+	} {
+		rw := apiRequest(tc.handler, "POST", tc.path, tc.body, nil)
+		if rw.Code != 429 {
+			t.Errorf("%s to a.test %d %s", tc.name, rw.Code, rw.Body.String())
+		}
+	}
+}
@@ -7,9 +7,12 @@
 package server
 
 import (
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,47 +22,256 @@ import (
 
 var (
 	PING_INTERVAL = 1 * time.Second
+	// TLS_HANDSHAKE_TIMEOUT is how long a worker has to complete the TLS
+	// handshake on the control port
+	TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
 )
 
 type WorkerConnection struct {
-	log      zerolog.Logger
+	log zerolog.Logger
+	// mu guards the job queues, and the identity, state and clock the
+	// connection sets for the scheduler and the API to read
+	mu       sync.Mutex
+	tracker  JobTracker
 	Conn     net.Conn
 	ID       string
 	Capacity uint
+	// MaxRate and MaxConcurrency across all jobs, 0 is unlimited
+	MaxRate        uint
+	MaxConcurrency uint
+	Labels         map[string]string
 	// State
 	// - new
 	// - hello
 	// - alive
 	State    string
 	LastSeen time.Time
+	// Offset of the worker's clock ahead of the server's, and the round
+	// trip time of the ping it was measured with
+	Offset time.Duration
+	RTT    time.Duration
+	clock  []clockSample
 	// Server assigned jobs that have not been accepted or sent
 	JobQueue []proto.Job
 	// Server assigned jobs that have not been accepted
 	AssignJobQueue []proto.Job
 	// Jobs accepted by the worker
 	AcceptedJobs []proto.Job
-	// TODO handles to provide state to the runtime
+	// Cancel messages to send to the worker
+	CancelQueue []proto.Cancel
+	// Jobs with new settings to send in the next update message
+	UpdateQueue []proto.Job
+	// Job IDs cancelled on the worker awaiting their partial results
+	cancelled map[string]bool
+	// verify the credentials the worker identifies with against the
+	// challenge of the hello, nil takes any worker
+	verify    func(id proto.Identify, challenge []byte) error
+	challenge []byte
+	// credential the worker enrolled with, empty without enrollment
+	credential string
+	// targets is the policy sent with the jobs for the worker to check
+	targets proto.TargetPolicy
 }
 
 // NewWorkerConnection handles the connection and state for a worker connection
-func NewWorkerConnection(logger zerolog.Logger, conn net.Conn) *WorkerConnection {
+func NewWorkerConnection(logger zerolog.Logger, conn net.Conn, tracker JobTracker) *WorkerConnection {
 	return &WorkerConnection{
 		log:      logger,
+		tracker:  tracker,
 		ID:       "",
 		Conn:     conn,
 		Capacity: 0,
 		State:    "new",
+
+		cancelled: make(map[string]bool),
 	}
 }
 
+// AssignJob queues the job to send to the worker, the state is left to
+// the connection so it isn't changed while waiting on the worker
 func (wc *WorkerConnection) AssignJob(job proto.Job) {
+	wc.mu.Lock()
 	wc.JobQueue = append(wc.JobQueue, job)
-	wc.updateState("accept")
+	wc.mu.Unlock()
+}
+
+// Load is the work committed to the worker by the jobs it was assigned
+type Load struct {
+	Jobs        int `json:"jobs"`
+	Rate        int `json:"rate"`
+	Concurrency int `json:"concurrency"`
+}
+
+// Add the job to the load
+func (l Load) Add(j proto.Job) Load {
+	return Load{
+		Jobs:        l.Jobs + 1,
+		Rate:        l.Rate + j.EffectiveRate(),
+		Concurrency: l.Concurrency + j.VUs(),
+	}
+}
+
+// Load returns the load of the jobs assigned to the worker and not done
+func (wc *WorkerConnection) Load() Load {
+	load := Load{}
+	for _, job := range wc.Jobs() {
+		load = load.Add(job)
+	}
+	return load
+}
+
+// WorkerInfo describes a worker connection for the API
+type WorkerInfo struct {
+	ID             string            `json:"id"`
+	Remote         string            `json:"remote"`
+	State          string            `json:"state"`
+	LastSeen       time.Time         `json:"lastSeen"`
+	Capacity       uint              `json:"capacity"`
+	MaxRate        uint              `json:"maxRate"`
+	MaxConcurrency uint              `json:"maxConcurrency"`
+	Labels         map[string]string `json:"labels"`
+	ClockOffsetMs  float64           `json:"clockOffsetMs"`
+	RTTMs          float64           `json:"rttMs"`
+	Load           Load              `json:"load"`
+	Jobs           []string          `json:"jobs"`
+}
+
+// Info returns a description of the worker and the jobs assigned to it
+func (wc *WorkerConnection) Info() WorkerInfo {
+	wc.mu.Lock()
+	info := WorkerInfo{
+		ID:             wc.ID,
+		Remote:         wc.Conn.RemoteAddr().String(),
+		State:          wc.State,
+		LastSeen:       wc.LastSeen,
+		Capacity:       wc.Capacity,
+		MaxRate:        wc.MaxRate,
+		MaxConcurrency: wc.MaxConcurrency,
+		Labels:         wc.Labels,
+		ClockOffsetMs:  ms(wc.Offset),
+		RTTMs:          ms(wc.RTT),
+		Jobs:           []string{},
+	}
+	wc.mu.Unlock()
+
+	info.Load = wc.Load()
+	for _, job := range wc.Jobs() {
+		info.Jobs = append(info.Jobs, job.ID)
+	}
+	return info
+}
+
+// Jobs returns the jobs assigned to the worker that are not done
+func (wc *WorkerConnection) Jobs() []proto.Job {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	jobs := []proto.Job{}
+	for _, queue := range [][]proto.Job{wc.JobQueue, wc.AssignJobQueue, wc.AcceptedJobs} {
+		jobs = append(jobs, queue...)
+	}
+	return jobs
+}
+
+// Credential is the credential the worker enrolled with
+func (wc *WorkerConnection) Credential() string {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return wc.credential
+}
+
+// claims reports if the connection is open for the worker's ID under
+// another credential
+func (wc *WorkerConnection) claims(id proto.Identify) bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return wc.ID != "" && wc.ID == id.ID && wc.State != "closed" && wc.credential != id.Credential
+}
+
+// Connected reports if the worker has identified and can be assigned jobs
+func (wc *WorkerConnection) Connected() bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return wc.ID != "" && (wc.State == "alive" || wc.State == "accept")
+}
+
+// CurrentState is the state of the connection
+func (wc *WorkerConnection) CurrentState() string {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return wc.State
+}
+
+// HasJob reports if the job is queued, assigned or accepted on the worker
+func (wc *WorkerConnection) HasJob(id string) bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	for _, queue := range [][]proto.Job{wc.JobQueue, wc.AssignJobQueue, wc.AcceptedJobs} {
+		if indexJob(queue, id) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// CancelJob drops the job if it has not been sent to the worker yet,
+// otherwise a cancel is queued for the worker. The job no longer counts
+// towards the worker's load.
+func (wc *WorkerConnection) CancelJob(id, reason string) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if i := indexJob(wc.JobQueue, id); i >= 0 {
+		wc.JobQueue = append(wc.JobQueue[:i], wc.JobQueue[i+1:]...)
+		return
+	}
+	wc.AssignJobQueue = removeJob(wc.AssignJobQueue, id)
+	wc.AcceptedJobs = removeJob(wc.AcceptedJobs, id)
+	wc.CancelQueue = append(wc.CancelQueue, proto.Cancel{JobIDs: []string{id}, Reason: reason})
+}
+
+// Cancelling reports if the job was cancelled and the worker has not sent
+// its final results yet
+func (wc *WorkerConnection) Cancelling(id string) bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	for _, cancel := range wc.CancelQueue {
+		if contains(cancel.JobIDs, id) {
+			return true
+		}
+	}
+	return wc.cancelled[id]
+}
+
+// UpdateJob applies the update to the job if it has not been sent to the
+// worker yet, otherwise the update is queued for the worker.
+func (wc *WorkerConnection) UpdateJob(u proto.JobUpdate) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if i := indexJob(wc.JobQueue, u.ID); i >= 0 {
+		u.Apply(&wc.JobQueue[i])
+		return
+	}
+	for _, queue := range [][]proto.Job{wc.AssignJobQueue, wc.AcceptedJobs} {
+		if i := indexJob(queue, u.ID); i >= 0 {
+			u.Apply(&queue[i])
+			wc.UpdateQueue = append(removeJob(wc.UpdateQueue, u.ID), queue[i])
+			return
+		}
+	}
 }
 
 func (wc *WorkerConnection) Handle() {
+	defer wc.close()
 	wc.log.Info().Str("remote", wc.Conn.RemoteAddr().String()).Str("local", wc.Conn.LocalAddr().String()).Msg("handling connection")
+	wc.mu.Lock()
 	wc.LastSeen = time.Now().Add(2 * time.Second)
+	wc.mu.Unlock()
+	// the fields the connection sets are only written by it, it reads them
+	// without the lock
 	for {
 		var err error
 
@@ -73,7 +285,15 @@ func (wc *WorkerConnection) Handle() {
 			continue
 		case "alive":
 			for {
-				if len(wc.JobQueue) > 0 {
+				if wc.pendingCancel() {
+					err = wc.sendCancel()
+					wc.updateState("alive")
+					break
+				} else if wc.pendingUpdate() {
+					err = wc.sendUpdate()
+					wc.updateState("alive")
+					break
+				} else if wc.pendingAssign() {
 					err = wc.sendAssign()
 					wc.updateState("accept")
 					break
@@ -82,6 +302,7 @@ func (wc *WorkerConnection) Handle() {
 					wc.updateState("alive")
 					break
 				}
+				time.Sleep(10 * time.Millisecond)
 			}
 		case "accept":
 			wc.log.Info().Msg("waiting for next status for accept")
@@ -100,6 +321,7 @@ func (wc *WorkerConnection) Handle() {
 		// Read the message from the client
 		var message proto.Message
 		err = message.Read(wc.Conn)
+		arrived := time.Now()
 		if errors.Is(err, syscall.EPIPE) {
 			wc.log.Error().Err(err).Msg("EPIPE Connection closed")
 			return
@@ -111,6 +333,12 @@ func (wc *WorkerConnection) Handle() {
 			return
 		}
 
+		// nothing but the identify is taken before the worker identified
+		if wc.State == "new" && message.Type != proto.MessageTypeIdentify {
+			wc.log.Error().Uint8("type", uint8(message.Type)).Str("remote", wc.Conn.RemoteAddr().String()).Msg("Expected identify. Disconnecting")
+			return
+		}
+
 		switch {
 		case message.Type == proto.MessageTypeIdentify:
 			wc.log.Info().Str("cmd", "hello").Msg("identify")
@@ -127,10 +355,31 @@ func (wc *WorkerConnection) Handle() {
 				wc.log.Error().Err(err)
 				continue
 			}
+			if wc.verify != nil {
+				if err := wc.verify(id, wc.challenge); err != nil {
+					wc.log.Warn().
+						Err(err).
+						Str("remote", wc.Conn.RemoteAddr().String()).
+						Str("workerID", id.ID).
+						Str("credential", id.Credential).
+						Msg("rejected worker")
+					wc.sendReject(err.Error())
+					return
+				}
+				wc.log.Info().Str("workerID", id.ID).Str("credential", id.Credential).Msg("worker enrolled")
+			}
 
+			wc.mu.Lock()
 			wc.ID = id.ID
-			wc.log = wc.log.With().Str("id", wc.ID).Logger()
+			if wc.verify != nil {
+				wc.credential = id.Credential
+			}
 			wc.Capacity = id.Capacity
+			wc.MaxRate = id.MaxRate
+			wc.MaxConcurrency = id.MaxConcurrency
+			wc.Labels = id.Labels
+			wc.mu.Unlock()
+			wc.log = wc.log.With().Str("id", wc.ID).Logger()
 			wc.updateState("hello")
 		case message.Type == proto.MessageTypeStatus || message.Type == proto.MessageTypeAccept:
 			wc.log.Info().Str("cmd", "status").Msg("sync jobs")
@@ -140,10 +389,14 @@ func (wc *WorkerConnection) Handle() {
 				wc.log.Error().Err(err)
 				continue
 			}
-			err = wc.syncJobs(status)
-			if err != nil {
-				wc.log.Error().Err(err)
-				continue
+			wc.syncClock(status, arrived)
+			for id, result := range status.Results {
+				wc.tracker.ReportResult(id, wc.ID, result)
+			}
+			wc.reclaimJobs(status)
+			transitions := wc.syncJobs(status)
+			for _, t := range transitions {
+				wc.tracker.TransitionJob(t.id, wc.ID, t.state, t.reason)
 			}
 			wc.updateState("alive")
 		}
@@ -152,27 +405,116 @@ func (wc *WorkerConnection) Handle() {
 
 func (wc *WorkerConnection) updateState(state string) {
 	wc.log.Debug().Str("state", state).Msg("state change")
+	wc.mu.Lock()
 	wc.LastSeen = time.Now()
 	wc.State = state
+	wc.mu.Unlock()
 }
 
+// sendHello greets the worker, with a challenge to answer if it must
+// enroll
 func (wc *WorkerConnection) sendHello() error {
 	wc.log.Debug().Str("type", "hello").Msg("send")
 	hello := proto.Message{Type: proto.MessageTypeHello}
+	if wc.verify != nil {
+		wc.challenge = make([]byte, 32)
+		if _, err := rand.Read(wc.challenge); err != nil {
+			return err
+		}
+		var err error
+		hello, err = (&proto.Hello{Challenge: wc.challenge}).Encode()
+		if err != nil {
+			return err
+		}
+	}
 	err := hello.Write(wc.Conn)
 	return err
 }
 
+func (wc *WorkerConnection) sendReject(reason string) error {
+	wc.log.Debug().Str("type", "reject").Msg("send")
+	message, err := (&proto.Reject{Reason: reason}).Encode()
+	if err != nil {
+		return err
+	}
+	return message.Write(wc.Conn)
+}
+
 func (wc *WorkerConnection) sendAlive() error {
 	wc.log.Debug().Str("type", "alive").Msg("send")
-	alive := proto.Message{Type: proto.MessageTypeAlive}
-	err := alive.Write(wc.Conn)
-	return err
+	alive := proto.Alive{Sent: time.Now(), Offset: wc.Offset}
+	message, err := alive.Encode()
+	if err != nil {
+		return err
+	}
+	return message.Write(wc.Conn)
+}
+
+func (wc *WorkerConnection) pendingAssign() bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return len(wc.JobQueue) > 0
+}
+
+func (wc *WorkerConnection) pendingCancel() bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return len(wc.CancelQueue) > 0
+}
+
+func (wc *WorkerConnection) sendCancel() error {
+	wc.log.Debug().Str("type", "cancel").Msg("send")
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	cancel := wc.CancelQueue[0]
+	message, err := cancel.Encode()
+	if err != nil {
+		return err
+	}
+	err = message.Write(wc.Conn)
+	if err != nil {
+		return err
+	}
+	for _, id := range cancel.JobIDs {
+		wc.cancelled[id] = true
+	}
+	wc.CancelQueue = wc.CancelQueue[1:]
+
+	return nil
+}
+
+func (wc *WorkerConnection) pendingUpdate() bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return len(wc.UpdateQueue) > 0
+}
+
+func (wc *WorkerConnection) sendUpdate() error {
+	wc.log.Debug().Str("type", "update").Msg("send")
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	update := proto.Update{Jobs: wc.UpdateQueue}
+	message, err := update.Encode()
+	if err != nil {
+		return err
+	}
+	err = message.Write(wc.Conn)
+	if err != nil {
+		return err
+	}
+	wc.UpdateQueue = wc.UpdateQueue[0:0]
+
+	return nil
 }
 
 func (wc *WorkerConnection) sendAssign() error {
 	wc.log.Debug().Str("type", "assign").Msg("send")
-	assign := proto.Assign{Jobs: wc.JobQueue}
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	assign := proto.Assign{Jobs: wc.JobQueue, Targets: wc.targets}
 	message, err := assign.Encode()
 	if err != nil {
 		return err
@@ -181,40 +523,150 @@ func (wc *WorkerConnection) sendAssign() error {
 	if err != nil {
 		return err
 	}
-	wc.AssignJobQueue = wc.JobQueue[:]
+	wc.AssignJobQueue = append(wc.AssignJobQueue, wc.JobQueue...)
 	wc.JobQueue = wc.JobQueue[0:0]
 
 	return nil
 }
 
-func (wc *WorkerConnection) syncJobs(status proto.Status) error {
+type jobTransition struct {
+	id     string
+	state  JobState
+	reason string
+}
+
+// syncJobs reconciles the jobs the server assigned with the worker's status
+// and returns the job state changes it observed
+func (wc *WorkerConnection) syncJobs(status proto.Status) []jobTransition {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	transitions := []jobTransition{}
+
+	// cancelled jobs are stopping until their final results are in, jobs
+	// that never started on the worker have none
+	for id := range wc.cancelled {
+		results, ok := status.Results[id]
+		if !ok {
+			delete(wc.cancelled, id)
+			continue
+		}
+		if !results.Done {
+			continue
+		}
+		e := wc.log.Info().Str("jobID", id)
+		for code, count := range results.Codes {
+			e.Int(fmt.Sprint(code), count)
+		}
+		e.Msg("partial results for cancelled job")
+		delete(wc.cancelled, id)
+	}
+
+	// queued on the worker
+	for i := range status.JobQueue {
+		if wc.acceptJob(status.JobQueue[i].ID) {
+			transitions = append(transitions, jobTransition{id: status.JobQueue[i].ID, state: JobStateAccepted})
+		}
+	}
+
+	// started on the worker, done once the results are reported
 	for i := range status.ActiveJobs {
-		found := false
-		foundID := ""
-		for j := range wc.AcceptedJobs {
-			found = wc.AcceptedJobs[j].ID == status.ActiveJobs[i].ID
-			if found {
-				foundID = status.ActiveJobs[i].ID
-				break
-			}
+		id := status.ActiveJobs[i].ID
+		if wc.acceptJob(id) {
+			transitions = append(transitions, jobTransition{id: id, state: JobStateAccepted})
 		}
-		if found {
-			for i := range wc.AssignJobQueue {
-				if foundID == wc.AssignJobQueue[i].ID {
-					job := wc.AssignJobQueue[i]
-					wc.AssignJobQueue = append(wc.AssignJobQueue[0:i], wc.AssignJobQueue[min(i+1, len(wc.AssignJobQueue)):]...)
-					wc.AcceptedJobs = append(wc.AcceptedJobs, job)
-				}
-			}
+		if indexJob(wc.AcceptedJobs, id) < 0 {
+			continue
+		}
+
+		results := status.Results[id]
+		if !results.Done {
+			transitions = append(transitions, jobTransition{id: id, state: JobStateRunning})
+			continue
+		}
+
+		wc.AcceptedJobs = removeJob(wc.AcceptedJobs, id)
+		if results.Failure != "" {
+			transitions = append(transitions, jobTransition{id: id, state: JobStateFailed, reason: results.Failure})
+		} else if results.Requests > 0 && results.Codes[0] == results.Requests {
+			transitions = append(transitions, jobTransition{id: id, state: JobStateFailed, reason: "all requests failed"})
+		} else {
+			transitions = append(transitions, jobTransition{id: id, state: JobStateCompleted})
 		}
 	}
 
-	return nil
+	return transitions
+}
+
+// reclaimJobs takes back the jobs the worker kept running while the server
+// restarted. Jobs the worker runs that the server doesn't expect it to are
+// cancelled.
+func (wc *WorkerConnection) reclaimJobs(status proto.Status) {
+	jobs := append(append([]proto.Job{}, status.JobQueue...), status.ActiveJobs...)
+	for _, job := range jobs {
+		if wc.HasJob(job.ID) || wc.Cancelling(job.ID) {
+			continue
+		}
+		if wc.tracker.ReclaimJob(job.ID, wc.ID, wc.credential) {
+			wc.mu.Lock()
+			wc.AcceptedJobs = append(wc.AcceptedJobs, job)
+			wc.mu.Unlock()
+			continue
+		}
+		// finished jobs are dropped by the worker once reported
+		if status.Results[job.ID].Done {
+			continue
+		}
+		wc.log.Warn().Str("jobID", job.ID).Msg("cancelling job unknown to the server")
+		wc.CancelJob(job.ID, "cancel")
+	}
+}
+
+// acceptJob moves the job from the assigned to the accepted jobs
+func (wc *WorkerConnection) acceptJob(id string) bool {
+	i := indexJob(wc.AssignJobQueue, id)
+	if i < 0 {
+		return false
+	}
+	wc.AcceptedJobs = append(wc.AcceptedJobs, wc.AssignJobQueue[i])
+	wc.AssignJobQueue = append(wc.AssignJobQueue[:i], wc.AssignJobQueue[i+1:]...)
+	return true
+}
+
+// close fails the jobs that were never sent to the worker, the jobs it was
+// sent wait for it to reconnect and reclaim them
+func (wc *WorkerConnection) close() {
+	wc.Conn.Close()
+	wc.updateState("closed")
+
+	wc.mu.Lock()
+	unsent := append([]proto.Job{}, wc.JobQueue...)
+	sent := append(append([]proto.Job{}, wc.AssignJobQueue...), wc.AcceptedJobs...)
+	wc.JobQueue = wc.JobQueue[0:0]
+	wc.AssignJobQueue = wc.AssignJobQueue[0:0]
+	wc.AcceptedJobs = wc.AcceptedJobs[0:0]
+	wc.mu.Unlock()
+
+	for i := range unsent {
+		wc.tracker.TransitionJob(unsent[i].ID, wc.ID, JobStateFailed, "worker disconnected")
+	}
+	for i := range sent {
+		wc.tracker.OrphanJob(sent[i].ID, wc.ID)
+	}
+}
+
+func indexJob(jobs []proto.Job, id string) int {
+	for i := range jobs {
+		if jobs[i].ID == id {
+			return i
+		}
+	}
+	return -1
 }
 
-func min(a, b int) int {
-	if a >= b {
-		return b
+func removeJob(jobs []proto.Job, id string) []proto.Job {
+	if i := indexJob(jobs, id); i >= 0 {
+		return append(jobs[:i], jobs[i+1:]...)
 	}
-	return a
+	return jobs
 }
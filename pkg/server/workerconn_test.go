@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+func TestWorkerReconnect(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).(*runtime)
+	wc := testWorker(r, "w")
+	schedule := func() {
+		r.mu.Lock()
+		r.schedule()
+		r.mu.Unlock()
+	}
+
+	// running is sent to the worker, unsent is still queued on the
+	// connection when it drops
+	r.AddJob(proto.Job{ID: "running", Req: 10})
+	schedule()
+	wc.mu.Lock()
+	wc.AcceptedJobs, wc.JobQueue = wc.JobQueue, nil
+	wc.mu.Unlock()
+	r.TransitionJob("running", "w", JobStateRunning, "")
+	r.AddJob(proto.Job{ID: "unsent", Req: 10})
+	schedule()
+
+	wc.close()
+	if js, _ := r.GetJob("running"); js.State != JobStateRunning {
+		t.Errorf("running job %s %q after the worker disconnected", js.State, js.Reason)
+	}
+	if js, _ := r.GetJob("unsent"); js.State != JobStateFailed {
+		t.Errorf("unsent job %s", js.State)
+	}
+
+	// the worker reconnects and reports the job it kept running
+	wc = testWorker(r, "w")
+	wc.reclaimJobs(proto.Status{ActiveJobs: []proto.Job{{ID: "running"}}})
+	if !wc.HasJob("running") || wc.Cancelling("running") {
+		t.Fatal("job not reclaimed by its worker")
+	}
+
+	// and fails the job if it doesn't come back in time
+	wc.close()
+	r.mu.Lock()
+	r.requeueOrphans(time.Now().Add(RECLAIM_TIMEOUT + time.Second))
+	r.mu.Unlock()
+	if js, _ := r.GetJob("running"); js.State != JobStateFailed || js.Reason != "worker disconnected" {
+		t.Errorf("running job %s %q after its worker didn't come back", js.State, js.Reason)
+	}
+}
+
+func TestReclaimNeedsCredential(t *testing.T) {
+	r := NewRuntime(testMetrics{}, zerolog.Nop(), Config{}).(*runtime)
+	wc := testWorker(r, "w")
+	wc.credential = "fleet"
+	r.AddJob(proto.Job{ID: "running", Req: 10})
+	r.mu.Lock()
+	r.schedule()
+	r.mu.Unlock()
+	wc.mu.Lock()
+	wc.AcceptedJobs, wc.JobQueue = wc.JobQueue, nil
+	wc.mu.Unlock()
+	wc.close()
+
+	// the worker's ID enrolled with another key can't take its job
+	other := testWorker(r, "w")
+	other.credential = "spare"
+	other.reclaimJobs(proto.Status{ActiveJobs: []proto.Job{{ID: "running"}}})
+	if other.HasJob("running") || !other.Cancelling("running") {
+		t.Error("job reclaimed with another credential")
+	}
+	other.close()
+
+	wc = testWorker(r, "w")
+	wc.credential = "fleet"
+	wc.reclaimJobs(proto.Status{ActiveJobs: []proto.Job{{ID: "running"}}})
+	if !wc.HasJob("running") {
+		t.Error("job not reclaimed by its worker")
+	}
+}
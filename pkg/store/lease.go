@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package store
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// leases are kept in the log with the other records
+const bucketLeases = "leases"
+
+// Lease is held by one holder at a time, until it expires or is released.
+// Value is what the holder shares with the others, i.e. its address.
+type Lease struct {
+	Holder  string    `json:"holder"`
+	Value   []byte    `json:"value,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// Held reports if the lease is held by anyone at t
+func (l Lease) Held(t time.Time) bool {
+	return l.Holder != "" && t.Before(l.Expires)
+}
+
+func (s *FileStore) Acquire(name, holder string, value []byte, ttl time.Duration) (Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lease Lease
+	err := s.locked(func() error {
+		if err := s.refresh(); err != nil {
+			return err
+		}
+		var err error
+		lease, err = s.lease(name)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if lease.Held(now) && lease.Holder != holder {
+			return nil
+		}
+		lease = Lease{Holder: holder, Value: value, Expires: now.Add(ttl)}
+		b, err := json.Marshal(lease)
+		if err != nil {
+			return err
+		}
+		return s.append(record{Bucket: bucketLeases, Key: name, Value: b})
+	})
+	return lease, err
+}
+
+func (s *FileStore) Release(name, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.locked(func() error {
+		if err := s.refresh(); err != nil {
+			return err
+		}
+		lease, err := s.lease(name)
+		if err != nil || lease.Holder != holder {
+			return err
+		}
+		return s.append(record{Bucket: bucketLeases, Key: name})
+	})
+}
+
+func (s *FileStore) lease(name string) (Lease, error) {
+	var lease Lease
+	b, ok := s.data[bucketLeases][name]
+	if !ok {
+		return lease, nil
+	}
+	err := json.Unmarshal(b, &lease)
+	return lease, err
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+// Package store persists the server's state so it survives restarts
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// COMPACT_MIN is the number of records the log grows to before it is
+	// compacted to the live records
+	COMPACT_MIN = 1000
+)
+
+// Store keeps records by bucket and key, a write is durable once it returns
+type Store interface {
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	// Load returns every record of the bucket
+	Load(bucket string) (map[string][]byte, error)
+	// Acquire takes or renews the lease for the holder unless another
+	// holder has it, it returns the lease as it stands
+	Acquire(name, holder string, value []byte, ttl time.Duration) (Lease, error)
+	// Release gives up the lease if the holder has it
+	Release(name, holder string) error
+	Close() error
+}
+
+// record is a line of the log, a nil value deletes the key
+type record struct {
+	Bucket string `json:"b"`
+	Key    string `json:"k"`
+	Value  []byte `json:"v"`
+}
+
+// FileStore is a write-ahead log of records in a file, replayed into memory
+// when opened. The log is compacted once most of it is overwritten records.
+//
+// Several stores can share the file, i.e. server replicas on a shared
+// volume. Each operation holds a lock on the file and first reads the
+// records the other stores appended since.
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	// lock is held across processes while the log is read or written
+	lock *os.File
+	// offset of the log read into memory
+	offset  int64
+	records int
+	data    map[string]map[string][]byte
+}
+
+// Open the store at the path, creating it if it doesn't exist
+func Open(path string) (*FileStore, error) {
+	s := &FileStore{path: path}
+	var err error
+	s.lock, err = os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	err = s.locked(s.reopen)
+	if err != nil {
+		s.lock.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// locked runs fn holding the lock on the file
+func (s *FileStore) locked(fn func() error) error {
+	if err := lockFile(s.lock); err != nil {
+		return err
+	}
+	defer unlockFile(s.lock)
+	return fn()
+}
+
+// reopen replays the log from the start, after opening or when another
+// store compacted it
+func (s *FileStore) reopen() error {
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.data = make(map[string]map[string][]byte)
+	s.records = 0
+	s.offset = 0
+
+	var err error
+	s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	return s.read()
+}
+
+// refresh reads the records other stores wrote since the last read
+func (s *FileStore) refresh() error {
+	current, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	open, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(current, open) {
+		return s.reopen()
+	}
+	if current.Size() == s.offset {
+		return nil
+	}
+	return s.read()
+}
+
+// read applies the log from the offset. A partly written last record from
+// a crash is cut off, so the next record starts on its own line.
+func (s *FileStore) read() error {
+	reader := bufio.NewReader(io.NewSectionReader(s.file, s.offset, 1<<62))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return s.file.Truncate(s.offset)
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading %s: %w", s.path, err)
+		}
+		s.offset += int64(len(line))
+
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			continue
+		}
+		s.apply(rec)
+		s.records += 1
+	}
+}
+
+func (s *FileStore) apply(rec record) {
+	bucket, ok := s.data[rec.Bucket]
+	if !ok {
+		bucket = make(map[string][]byte)
+		s.data[rec.Bucket] = bucket
+	}
+	if rec.Value == nil {
+		delete(bucket, rec.Key)
+		return
+	}
+	bucket[rec.Key] = rec.Value
+}
+
+func (s *FileStore) Put(bucket, key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	return s.write(record{Bucket: bucket, Key: key, Value: value})
+}
+
+func (s *FileStore) Delete(bucket, key string) error {
+	return s.write(record{Bucket: bucket, Key: key})
+}
+
+func (s *FileStore) write(rec record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.locked(func() error {
+		if err := s.refresh(); err != nil {
+			return err
+		}
+		return s.append(rec)
+	})
+}
+
+// append writes the record to the log and syncs it before applying it
+func (s *FileStore) append(rec record) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = s.file.Write(b)
+	if err != nil {
+		return err
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return err
+	}
+	s.apply(rec)
+	s.offset += int64(len(b))
+	s.records += 1
+
+	if s.records > COMPACT_MIN && s.records > 2*s.live() {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *FileStore) Load(bucket string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make(map[string][]byte)
+	err := s.locked(func() error {
+		if err := s.refresh(); err != nil {
+			return err
+		}
+		for k, v := range s.data[bucket] {
+			records[k] = v
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lock.Close()
+	return s.file.Close()
+}
+
+func (s *FileStore) live() int {
+	n := 0
+	for _, bucket := range s.data {
+		n += len(bucket)
+	}
+	return n
+}
+
+// compact rewrites the log with only the live records, the new log
+// replaces the old one once it is synced
+func (s *FileStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for bucket, records := range s.data {
+		for key, value := range records {
+			if err := enc.Encode(record{Bucket: bucket, Key: key, Value: value}); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file, err = os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	s.offset = info.Size()
+	s.records = s.live()
+	return nil
+}
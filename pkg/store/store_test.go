@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peltr.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("jobs", "a", []byte("1"))
+	s.Put("jobs", "b", []byte("2"))
+	s.Put("jobs", "a", []byte("3"))
+	s.Delete("jobs", "b")
+	s.Put("schedules", "a", []byte("4"))
+	s.Close()
+
+	// a record cut off by a crash
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	f.Write([]byte(`{"b":"jobs","k":"c"`))
+	f.Close()
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("jobs", "d", []byte("5"))
+	s.Close()
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, _ := s.Load("jobs")
+	expected := map[string][]byte{"a": []byte("3"), "d": []byte("5")}
+	if !reflect.DeepEqual(jobs, expected) {
+		t.Errorf("jobs %v, expected %v", jobs, expected)
+	}
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peltr.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3*COMPACT_MIN; i++ {
+		if err := s.Put("jobs", "a", []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.records > COMPACT_MIN {
+		t.Errorf("%d records in the log after compaction", s.records)
+	}
+	s.Close()
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, _ := s.Load("jobs")
+	if len(jobs) != 1 || jobs["a"][0] != byte(3*COMPACT_MIN-1) {
+		t.Errorf("jobs %v after compaction", jobs)
+	}
+}
+
+func TestFileStoreShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peltr.db")
+	a, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	a.Put("jobs", "a", []byte("1"))
+	b.Put("jobs", "b", []byte("2"))
+	jobs, _ := a.Load("jobs")
+	expected := map[string][]byte{"a": []byte("1"), "b": []byte("2")}
+	if !reflect.DeepEqual(jobs, expected) {
+		t.Errorf("jobs %v, expected %v", jobs, expected)
+	}
+
+	// b reads the log a compacted from the start
+	for i := 0; i < 3*COMPACT_MIN; i++ {
+		a.Put("jobs", "a", []byte{byte(i)})
+	}
+	jobs, _ = b.Load("jobs")
+	if len(jobs) != 2 || jobs["a"][0] != byte(3*COMPACT_MIN-1) {
+		t.Errorf("jobs %v after compaction by the other store", jobs)
+	}
+}
+
+func TestFileStoreLease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peltr.db")
+	a, _ := Open(path)
+	defer a.Close()
+	b, _ := Open(path)
+	defer b.Close()
+
+	lease, err := a.Acquire("leader", "a", []byte("a:8000"), time.Minute)
+	if err != nil || lease.Holder != "a" {
+		t.Fatalf("a acquired %+v, %v", lease, err)
+	}
+	lease, _ = b.Acquire("leader", "b", []byte("b:8000"), time.Minute)
+	if lease.Holder != "a" || string(lease.Value) != "a:8000" {
+		t.Errorf("b acquired %+v while a holds it", lease)
+	}
+	lease, _ = a.Acquire("leader", "a", []byte("a:8000"), time.Minute)
+	if lease.Holder != "a" {
+		t.Errorf("a renewed %+v", lease)
+	}
+
+	b.Release("leader", "b")
+	if lease, _ = b.Acquire("leader", "b", nil, time.Minute); lease.Holder != "a" {
+		t.Errorf("released by a holder that didn't have it, %+v", lease)
+	}
+	a.Release("leader", "a")
+	if lease, _ = b.Acquire("leader", "b", nil, time.Minute); lease.Holder != "b" {
+		t.Errorf("b acquired %+v after a released it", lease)
+	}
+
+	// an expired lease is taken over
+	b.Acquire("leader", "b", nil, -time.Second)
+	if lease, _ = a.Acquire("leader", "a", nil, time.Minute); lease.Holder != "a" {
+		t.Errorf("a acquired %+v after it expired", lease)
+	}
+}
@@ -7,8 +7,14 @@
 package worker
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gideonw/peltr/pkg/proto"
@@ -18,63 +24,366 @@ import (
 type JobWorker struct {
 	log     zerolog.Logger
 	metrics Metrics
+	ctx     context.Context
+	cancel  context.CancelFunc
+	updates chan proto.JobUpdate
+	reason  string
+	// offset of the local clock ahead of the server's
+	offset time.Duration
+	// targets the job may send to, checked before each dial
+	targets proto.TargetPolicy
+	client  *http.Client
+	mu      sync.Mutex
 
-	Done    bool
-	Results map[int]int
-	Job     proto.Job
+	Done      bool
+	Cancelled bool
+	Results   proto.JobResult
+	Job       proto.Job
 }
 
-func NewJobWorker(log zerolog.Logger, metrics Metrics, j proto.Job) JobWorker {
-	return JobWorker{
-		log:     log,
+// NewJobWorker runs the job, offset is the local clock ahead of the server's
+// and translates the job's start and the results to the server's time.
+// Requests are only sent to the targets the policy allows.
+func NewJobWorker(log zerolog.Logger, metrics Metrics, j proto.Job, offset time.Duration, targets proto.TargetPolicy) *JobWorker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobWorker{
+		log:     log.With().Str("jobID", j.ID).Logger(),
 		metrics: metrics,
+		ctx:     ctx,
+		cancel:  cancel,
+		updates: make(chan proto.JobUpdate, 1),
+		offset:  offset,
+		targets: targets,
+		client:  targetClient(targets),
 		Done:    false,
-		Results: make(map[int]int),
+		Results: proto.NewJobResult(),
 		Job:     j,
 	}
 }
 
+// Cancel stops the job, in-flight requests are aborted and the results
+// gathered so far are kept as the final results. The reason is recorded in
+// the timeline.
+func (jw *JobWorker) Cancel(reason string) {
+	if reason == "" {
+		reason = "cancel"
+	}
+
+	jw.mu.Lock()
+	jw.Cancelled = !jw.Done
+	jw.reason = reason
+	jw.mu.Unlock()
+
+	jw.cancel()
+}
+
+// Update retunes or pauses the running job, it is applied by the job loop.
+// It doesn't wait on the loop: an update the loop hasn't taken yet is
+// replaced, as updates carry all of the job's settings.
+func (jw *JobWorker) Update(u proto.JobUpdate) {
+	select {
+	case <-jw.updates:
+	default:
+	}
+	select {
+	case jw.updates <- u:
+	default:
+	}
+}
+
+// CurrentJob returns the job with any updates applied
+func (jw *JobWorker) CurrentJob() proto.Job {
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	return jw.Job
+}
+
+// Snapshot returns a copy of the results gathered so far
+func (jw *JobWorker) Snapshot() proto.JobResult {
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+
+	results := jw.Results.Copy()
+	results.Done = jw.Done
+	return results
+}
+
 func (jw *JobWorker) HandleJob() {
-	// done := make(chan bool)
-	ticker := time.NewTicker(10 * time.Millisecond)
-
-	count := 0
-	errcount := 0
-	for range ticker.C {
-		if count+errcount >= jw.Job.Req {
-			ticker.Stop()
-			e := jw.log.Debug()
-			for k, v := range jw.Results {
-				e.Int(fmt.Sprint(k), v)
-			}
-			e.Msg("job complete")
-			ticker.Stop()
-			break
+	defer jw.cancel()
+
+	if err := jw.targets.Check(jw.Job.Host(), nil); err != nil {
+		jw.fail(err)
+		jw.cancelled(0)
+		return
+	}
+	if !jw.waitStart() {
+		jw.cancelled(0)
+		return
+	}
+
+	ticker := time.NewTicker(jw.interval())
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	// requests in flight, only the loop adds to it so a lowered concurrency
+	// holds new requests until enough of the running ones finish
+	var inflight int32
+
+	jw.record("start")
+	sent := 0
+	for sent < jw.Job.Req {
+		select {
+		case <-jw.ctx.Done():
+			wg.Wait()
+			jw.cancelled(sent)
+			return
+		case u := <-jw.updates:
+			jw.apply(u)
+			ticker.Reset(jw.interval())
+			continue
+		case <-ticker.C:
 		}
 
-		// Make request
-		code, r, dur, err := makeRequest(jw.Job.URL)
-		if err != nil {
-			jw.log.Error().Err(err).Msg("making request")
-			errcount += 1
+		if jw.Job.Paused {
+			continue
+		}
+
+		// Skip the tick when all the concurrent slots are in use
+		if int(atomic.LoadInt32(&inflight)) >= jw.concurrency() {
+			continue
+		}
+
+		sent += 1
+		wg.Add(1)
+		atomic.AddInt32(&inflight, 1)
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt32(&inflight, -1)
+			jw.request()
+		}()
+	}
+	wg.Wait()
+
+	e := jw.log.Debug()
+	results := jw.Snapshot()
+	for k, v := range results.Codes {
+		e.Int(fmt.Sprint(k), v)
+	}
+	e.Msg("job complete")
+
+	jw.record("complete")
+	jw.finish()
+}
+
+// waitStart holds the job until its start time on the server's clock, so
+// the shards of a gang scheduled job start together. It returns false if the job was cancelled
+// while waiting.
+func (jw *JobWorker) waitStart() bool {
+	if jw.Job.StartAt == nil {
+		return true
+	}
+	delay := jw.Job.StartAt.Sub(jw.now())
+	if delay <= 0 {
+		return true
+	}
+	jw.log.Info().Time("startAt", *jw.Job.StartAt).Msg("waiting to start")
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case u := <-jw.updates:
+			jw.apply(u)
+		case <-jw.ctx.Done():
+			return false
 		}
-		jw.Results[code] += r
-		count += r
-		jw.metrics.IncJobRequestCount(jw.Job.ID, code)
-		jw.metrics.ObserveJobRequestDurations(jw.Job.ID, code, dur)
-		jw.log.Debug().Int("count", count).Int("code", code).Dur("ms", dur).Msg("status")
 	}
+}
+
+// fail gives up on the job, the error is reported as the job's failure
+func (jw *JobWorker) fail(err error) {
+	jw.mu.Lock()
+	if jw.Results.Failure == "" {
+		jw.log.Error().Err(err).Msg("job failed")
+		jw.Results.Failure = err.Error()
+		jw.reason = "fail"
+	}
+	jw.mu.Unlock()
 
+	jw.cancel()
+}
+
+// cancelled records the cancel and finishes the job
+func (jw *JobWorker) cancelled(sent int) {
+	jw.mu.Lock()
+	reason := jw.reason
+	jw.mu.Unlock()
+	jw.log.Info().Int("sent", sent).Str("reason", reason).Msg("job cancelled")
+	jw.record(reason)
+	jw.finish()
+}
+
+func (jw *JobWorker) request() {
+	code, _, dur, err := makeRequest(jw.ctx, jw.client, jw.Job.URL)
+	if errors.Is(err, context.Canceled) {
+		// the request was aborted by a cancel and doesn't count
+		return
+	} else if errors.Is(err, proto.ErrTargetDenied) {
+		jw.fail(err)
+		return
+	} else if err != nil {
+		jw.log.Error().Err(err).Msg("making request")
+	}
+
+	// failed requests are counted under status code 0
+	jw.mu.Lock()
+	jw.Results.Codes[code] += 1
+	jw.Results.Requests += 1
+	jw.Results.End = jw.now()
+	if err != nil {
+		jw.Results.Errors[errorKind(err)] += 1
+	} else {
+		jw.Results.Latency.Observe(dur)
+	}
+	jw.mu.Unlock()
+
+	jw.metrics.IncJobRequestCount(jw.Job.ID, code)
+	jw.metrics.ObserveJobRequestDurations(jw.Job.ID, code, dur)
+	jw.log.Trace().Int("code", code).Dur("ms", dur).Msg("status")
+}
+
+func (jw *JobWorker) apply(u proto.JobUpdate) {
+	jw.mu.Lock()
+	paused := jw.Job.Paused
+	u.Apply(&jw.Job)
+	jw.mu.Unlock()
+
+	event := "update"
+	if !paused && jw.Job.Paused {
+		event = "pause"
+	} else if paused && !jw.Job.Paused {
+		event = "resume"
+	}
+	jw.log.Info().Str("event", event).Int("rate", jw.Job.Rate).Int("concurrency", jw.Job.Concurrency).Msg("job updated")
+	jw.record(event)
+}
+
+// record adds an event with the current job settings to the timeline
+func (jw *JobWorker) record(event string) {
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+
+	if event == "start" {
+		jw.Results.Start = jw.now()
+	}
+	jw.Results.Timeline = append(jw.Results.Timeline, proto.JobEvent{
+		At:          jw.now(),
+		Event:       event,
+		Rate:        jw.Job.Rate,
+		Concurrency: jw.Job.Concurrency,
+		Paused:      jw.Job.Paused,
+	})
+}
+
+// now is the server's time by the local clock
+func (jw *JobWorker) now() time.Time {
+	return time.Now().Add(-jw.offset)
+}
+
+// interval is the time between requests, never under a nanosecond so rates
+// above a billion still tick
+func (jw *JobWorker) interval() time.Duration {
+	if d := time.Second / time.Duration(jw.Job.EffectiveRate()); d > 0 {
+		return d
+	}
+	return time.Nanosecond
+}
+
+func (jw *JobWorker) concurrency() int {
+	return jw.Job.VUs()
+}
+
+func (jw *JobWorker) finish() {
+	jw.mu.Lock()
 	jw.Done = true
+	jw.mu.Unlock()
+}
+
+// errorKind groups request errors for the results
+func errorKind(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr):
+		return opErr.Op
+	}
+	return "other"
+}
+
+// targetClient is a client that checks every host it dials or is
+// redirected to against the policy, and every address the host resolves to
+// before connecting. Requests go straight to the targets, not through a
+// proxy, so the addresses checked are the targets'.
+func targetClient(targets proto.TargetPolicy) *http.Client {
+	if targets.Empty() {
+		return http.DefaultClient
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		d := *dialer
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return targets.Check(host, net.ParseIP(ip))
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return targets.Check(req.URL.Hostname(), nil)
+		},
+	}
 }
 
-func makeRequest(url string) (int, int, time.Duration, error) {
+func makeRequest(ctx context.Context, client *http.Client, url string) (int, int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
 	start := time.Now()
-	resp, err := http.Get(url)
+	resp, err := client.Do(req)
 	dur := time.Now().Sub(start)
 	if err != nil {
 		return 0, 0, dur, err
 	}
+	resp.Body.Close()
 
 	return resp.StatusCode, 1, dur, nil
 }
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2022, Gideon Williams <gideon@gideonw.com>
+ *
+ * SPDX-License-Identifier: BSD-2-Clause
+ */
+
+package worker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gideonw/peltr/pkg/proto"
+	"github.com/rs/zerolog"
+)
+
+type testMetrics struct{}
+
+func (testMetrics) IncJobs()                                              {}
+func (testMetrics) IncJobRequestCount(id string, status int)              {}
+func (testMetrics) ObserveJobRequestDurations(string, int, time.Duration) {}
+
+// slowTarget answers once released, started gets each request as it
+// arrives. It is released at the end of the test.
+func slowTarget(t *testing.T) (*httptest.Server, chan struct{}, func()) {
+	started, released := make(chan struct{}, 100), make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-released:
+		case <-req.Context().Done():
+		}
+	}))
+	var once sync.Once
+	release := func() { once.Do(func() { close(released) }) }
+	t.Cleanup(target.Close)
+	t.Cleanup(release)
+	return target, started, release
+}
+
+func TestJobUpdateWhileFinishing(t *testing.T) {
+	target, started, release := slowTarget(t)
+	jw := NewJobWorker(zerolog.Nop(), testMetrics{}, proto.Job{ID: "j", URL: target.URL, Req: 1, Rate: 1000}, 0, proto.TargetPolicy{})
+	done := make(chan struct{})
+	go func() {
+		jw.HandleJob()
+		close(done)
+	}()
+	<-started
+
+	// the job waits on its last request, updates don't wait on it
+	updated := make(chan struct{})
+	go func() {
+		jw.Update(proto.Job{ID: "j", Rate: 10}.Settings())
+		jw.Update(proto.Job{ID: "j", Rate: 20}.Settings())
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("update blocked on the finishing job")
+	}
+
+	release()
+	<-done
+	if results := jw.Snapshot(); !results.Done || results.Requests != 1 {
+		t.Errorf("results %+v", results)
+	}
+}
+
+// countTarget answers at once and counts the requests it answered
+func countTarget(t *testing.T) (*httptest.Server, *int32) {
+	var served int32
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&served, 1)
+	}))
+	t.Cleanup(target.Close)
+	return target, &served
+}
+
+// run starts the job, the returned channel is closed once it finishes. The
+// job is cancelled at the end of the test.
+func run(t *testing.T, jw *JobWorker) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		jw.HandleJob()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		jw.Cancel("")
+		<-done
+	})
+	return done
+}
+
+// eventually polls cond every 10ms for up to 5s
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestJobCancelKeepsResults(t *testing.T) {
+	target, served := countTarget(t)
+	jw := NewJobWorker(zerolog.Nop(), testMetrics{}, proto.Job{ID: "j", URL: target.URL, Req: 1000, Rate: 100}, 0, proto.TargetPolicy{})
+	done := run(t, jw)
+	eventually(t, "requests", func() bool { return jw.Snapshot().Requests >= 3 })
+
+	jw.Cancel("preempt")
+	<-done
+	results := jw.Snapshot()
+	if !results.Done || !jw.Cancelled || results.Requests < 3 || results.Requests >= 1000 {
+		t.Fatalf("cancelled %v with results %+v", jw.Cancelled, results)
+	}
+	if n := int(atomic.LoadInt32(served)); results.Requests > n {
+		t.Errorf("%d requests in the results, %d answered", results.Requests, n)
+	}
+	if last := results.Timeline[len(results.Timeline)-1]; last.Event != "preempt" {
+		t.Errorf("timeline ends on %s", last.Event)
+	}
+}
+
+func TestJobPause(t *testing.T) {
+	target, served := countTarget(t)
+	job := proto.Job{ID: "j", URL: target.URL, Req: 1000, Rate: 100}
+	jw := NewJobWorker(zerolog.Nop(), testMetrics{}, job, 0, proto.TargetPolicy{})
+	run(t, jw)
+	eventually(t, "requests", func() bool { return atomic.LoadInt32(served) >= 3 })
+
+	job.Paused = true
+	jw.Update(job.Settings())
+	eventually(t, "the pause", func() bool { return jw.CurrentJob().Paused })
+	// let the requests in flight finish
+	time.Sleep(50 * time.Millisecond)
+	paused := atomic.LoadInt32(served)
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(served); n != paused {
+		t.Errorf("%d requests sent while paused", n-paused)
+	}
+
+	job.Paused = false
+	jw.Update(job.Settings())
+	eventually(t, "requests after resuming", func() bool { return atomic.LoadInt32(served) > paused })
+	events := []string{}
+	for _, e := range jw.Snapshot().Timeline {
+		events = append(events, e.Event)
+	}
+	if strings.Join(events, ",") != "start,pause,resume" {
+		t.Errorf("timeline %v", events)
+	}
+}
+
+func TestJobWaitsForStart(t *testing.T) {
+	target, served := countTarget(t)
+	// the local clock is an hour ahead of the server's
+	offset := time.Hour
+	start := time.Now().Add(-offset).Add(200 * time.Millisecond)
+	jw := NewJobWorker(zerolog.Nop(), testMetrics{}, proto.Job{ID: "j", URL: target.URL, Req: 1, StartAt: &start}, offset, proto.TargetPolicy{})
+	began := time.Now()
+	done := run(t, jw)
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(served); n != 0 {
+		t.Errorf("%d requests before the start", n)
+	}
+	<-done
+	if waited := time.Since(began); waited < 150*time.Millisecond || waited > 5*time.Second {
+		t.Errorf("started after %s, want 200ms", waited)
+	}
+	if results := jw.Snapshot(); results.Start.Before(start) || results.Requests != 1 {
+		t.Errorf("start %s, want from %s, results %+v", results.Start, start, results)
+	}
+}
+
+func TestJobDeniedAddress(t *testing.T) {
+	target, served := countTarget(t)
+	// the host is allowed by name, the address it resolves to isn't
+	url := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	targets := proto.TargetPolicy{Allow: []string{"localhost"}, Deny: []string{"127.0.0.0/8", "::1/128"}}
+	jw := NewJobWorker(zerolog.Nop(), testMetrics{}, proto.Job{ID: "j", URL: url, Req: 10, Rate: 100}, 0, targets)
+	<-run(t, jw)
+
+	results := jw.Snapshot()
+	if !results.Done || !strings.Contains(results.Failure, proto.ErrTargetDenied.Error()) {
+		t.Errorf("results %+v", results)
+	}
+	if n := atomic.LoadInt32(served); n != 0 {
+		t.Errorf("%d requests reached the denied address", n)
+	}
+}
@@ -7,16 +7,25 @@
 package worker
 
 import (
-	"fmt"
+	"crypto/tls"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gideonw/peltr/pkg/auth"
 	"github.com/gideonw/peltr/pkg/proto"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 )
 
+var (
+	// RECONNECT_INTERVAL is the wait between attempts to reconnect to the
+	// server
+	RECONNECT_INTERVAL = 2 * time.Second
+)
+
 type WorkerRuntime interface {
 	Connect() error
 	Handle()
@@ -26,65 +35,175 @@ type WorkerRuntime interface {
 type workerRuntime struct {
 	metrics Metrics
 	log     zerolog.Logger
-	host    string
-	port    int
-
-	Capacity uint
-	ID       string
-	conn     net.Conn
+	// hosts of the servers, tried in turn when connecting
+	hosts []string
+	next  int
+	port  int
+
+	Limits      Limits
+	Labels      map[string]string
+	Credentials Credentials
+	TLS         *TLS
+	ID          string
+	conn        net.Conn
+	// challenge of the server's hello, answered when identifying
+	challenge []byte
 
 	State string
 
+	// offset of the local clock ahead of the server's, as estimated by
+	// the server
+	offset time.Duration
+	// ping is the alive to answer with the next status, and when it was
+	// received
+	ping     time.Time
+	received time.Time
+	// targets is the server's policy of the hosts jobs may send to
+	targets proto.TargetPolicy
+
 	JobQueue []proto.Job
-	Workers  []JobWorker
+	Workers  []*JobWorker
+}
+
+// Limits the worker announces to the server, 0 is unlimited
+type Limits struct {
+	// Jobs run at once
+	Jobs uint
+	// Rate of all jobs, req/s
+	Rate uint
+	// Concurrency of all jobs
+	Concurrency uint
+}
+
+// Credentials the worker enrolls with, the secret is read from the file each
+// time the worker identifies so it can be rotated in place
+type Credentials struct {
+	Name       string
+	SecretFile string
+	// Token sends the secret itself instead of answering the challenge
+	Token bool
+}
+
+// TLS the worker dials the servers with. Cert is the worker's client
+// certificate, if the servers ask for one, read again before connecting
+// when its files changed.
+type TLS struct {
+	Config *tls.Config
+	Cert   *auth.KeyPair
 }
 
-func NewRuntime(m Metrics, logger zerolog.Logger, host string, port int) WorkerRuntime {
+func NewRuntime(m Metrics, logger zerolog.Logger, host string, port int, limits Limits, labels map[string]string, creds Credentials, tlsConfig *TLS) WorkerRuntime {
 	id, err := uuid.NewRandom()
 	if err != nil {
 		panic(err)
 	}
 	return &workerRuntime{
-		log:      logger,
-		metrics:  m,
-		host:     host,
-		port:     port,
-		State:    "new",
-		Capacity: 10,
-		ID:       id.String(),
-		conn:     nil,
+		log:         logger,
+		metrics:     m,
+		hosts:       strings.Split(host, ","),
+		port:        port,
+		State:       "new",
+		Limits:      limits,
+		Labels:      labels,
+		Credentials: creds,
+		TLS:         tlsConfig,
+		ID:          id.String(),
+		conn:        nil,
 	}
 }
 
+// Connect dials the servers in turn until one answers, any server relays
+// the worker to the leader
 func (wr *workerRuntime) Connect() error {
 	retryCount := 3
 
 	var err error
-
 	for retryCount > 0 && wr.conn == nil {
-		wr.conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", wr.host, wr.port))
+		addr := wr.addr()
+		wr.conn, err = wr.dial(addr)
 		if err != nil {
-			wr.log.Error().Err(err)
+			wr.log.Error().Err(err).Str("addr", addr).Msg("error dialing server")
 			retryCount -= 1
 		}
 		time.Sleep(2 * time.Second)
 	}
+	if wr.conn == nil {
+		return err
+	}
 	wr.log.Info().Str("addr", wr.conn.RemoteAddr().String()).Msg("worker connected")
 
 	return nil
 }
 
+// dial connects to the server, over TLS if the worker has a TLS config
+func (wr *workerRuntime) dial(addr string) (net.Conn, error) {
+	if wr.TLS == nil {
+		return net.Dial("tcp", addr)
+	}
+	if wr.TLS.Cert != nil {
+		changed, err := wr.TLS.Cert.Reload()
+		if err != nil {
+			wr.log.Error().Err(err).Msg("error reloading the worker certificate, keeping the previous one")
+		} else if changed {
+			wr.log.Info().Time("notAfter", wr.TLS.Cert.Leaf().NotAfter).Msg("reloaded the worker certificate")
+		}
+	}
+
+	config := wr.TLS.Config.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: 10 * time.Second}, Config: config}
+	return dialer.Dial("tcp", addr)
+}
+
+// addr returns the next server to dial, the host may already carry the
+// port, i.e. localhost:8000
+func (wr *workerRuntime) addr() string {
+	host := strings.TrimSpace(wr.hosts[wr.next%len(wr.hosts)])
+	wr.next += 1
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return net.JoinHostPort(host, strconv.Itoa(wr.port))
+	}
+	return host
+}
+
 func (wr *workerRuntime) Close() {
-	wr.conn.Close()
+	wr.updateState("closed")
+	if wr.conn != nil {
+		wr.conn.Close()
+	}
 }
 
+// Handle serves the server connection and reconnects when it is lost. Jobs
+// keep running while disconnected and are reported to the server once
+// reconnected.
 func (wr *workerRuntime) Handle() {
+	for wr.State != "closed" {
+		wr.serve()
+		if wr.State == "closed" {
+			return
+		}
+
+		wr.log.Warn().Msg("lost connection to server, reconnecting")
+		wr.conn.Close()
+		wr.conn = nil
+		wr.updateState("new")
+		for wr.Connect() != nil {
+			time.Sleep(RECONNECT_INTERVAL)
+		}
+	}
+}
+
+func (wr *workerRuntime) serve() {
 	for wr.State != "closed" {
 		var message proto.Message
 		err := message.Read(wr.conn)
 		if err != nil {
-			break
+			wr.log.Error().Err(err).Msg("error reading from server")
+			return
 		}
+		wr.received = time.Now()
 
 		wr.processInput(message)
 		wr.processState()
@@ -117,36 +236,68 @@ func (wr *workerRuntime) read(b []byte) (int, error) {
 }
 
 func (wr *workerRuntime) scheduler() {
-	if len(wr.Workers) >= int(wr.Capacity) {
-		wr.log.Debug().Msg("worker at capacity")
-		return
-	}
+	for {
+		if wr.Limits.Jobs > 0 && len(wr.Workers) >= int(wr.Limits.Jobs) {
+			wr.log.Debug().Msg("worker at capacity")
+			return
+		}
 
-	if len(wr.JobQueue) <= 0 {
-		wr.log.Debug().Msg("no assigned jobs waiting")
-		return
-	}
+		if len(wr.JobQueue) <= 0 {
+			wr.log.Debug().Msg("no assigned jobs waiting")
+			return
+		}
 
-	// FIFO take the head of the job queue and create a JobWorker
-	job := wr.JobQueue[0]
-	wr.JobQueue = wr.JobQueue[1:]
+		// FIFO take the head of the job queue and create a JobWorker
+		job := wr.JobQueue[0]
+		wr.JobQueue = wr.JobQueue[1:]
 
-	// create the worker and keep track of it
-	jw := NewJobWorker(wr.log, wr.metrics, job)
-	wr.Workers = append(wr.Workers, jw)
+		// create the worker and keep track of it
+		jw := NewJobWorker(wr.log, wr.metrics, job, wr.offset, wr.targets)
+		wr.Workers = append(wr.Workers, jw)
 
-	// metrics
-	wr.metrics.IncJobs()
+		// metrics
+		wr.metrics.IncJobs()
 
-	// Start the job handler
-	go jw.HandleJob()
+		// Start the job handler
+		go jw.HandleJob()
+	}
 }
 
 func (wr *workerRuntime) processInput(message proto.Message) {
 	switch message.Type {
 	case proto.MessageTypeHello:
+		// servers that don't enroll workers send hello without a body
+		wr.challenge = nil
+		if len(message.Data) > 0 {
+			var hello proto.Hello
+			err := hello.Decode(message)
+			if err != nil {
+				wr.log.Error().Str("type", "hello").Err(err).Msg("error parsing message")
+			}
+			wr.challenge = hello.Challenge
+		}
 		wr.updateState("identify")
+	case proto.MessageTypeReject:
+		var reject proto.Reject
+		err := reject.Decode(message)
+		if err != nil {
+			wr.log.Error().Str("type", "reject").Err(err).Msg("error parsing message")
+		}
+		wr.log.Error().Str("reason", reject.Reason).Str("credential", wr.Credentials.Name).Msg("server rejected the worker")
 	case proto.MessageTypeAlive:
+		// servers before clock sync send alive without a body
+		if len(message.Data) > 0 {
+			var alive proto.Alive
+			err := alive.Decode(message)
+			if err != nil {
+				wr.log.Error().Str("type", "alive").Err(err).Msg("error parsing message")
+			}
+			wr.ping = alive.Sent
+			if alive.Offset != wr.offset {
+				wr.log.Debug().Dur("offset", alive.Offset).Msg("clock offset")
+			}
+			wr.offset = alive.Offset
+		}
 		wr.updateState("alive")
 	case proto.MessageTypeAssign:
 		var job proto.Assign
@@ -154,13 +305,69 @@ func (wr *workerRuntime) processInput(message proto.Message) {
 		if err != nil {
 			wr.log.Error().Str("type", "assign").Err(err).Msg("error parsing message")
 		}
+		wr.targets = job.Targets
 		wr.JobQueue = append(wr.JobQueue, job.Jobs...)
 		wr.updateState("assign")
+	case proto.MessageTypeCancel:
+		var cancel proto.Cancel
+		err := cancel.Decode(message)
+		if err != nil {
+			wr.log.Error().Str("type", "cancel").Err(err).Msg("error parsing message")
+		}
+		wr.cancelJobs(cancel.JobIDs, cancel.Reason)
+		wr.updateState("alive")
+	case proto.MessageTypeUpdate:
+		var update proto.Update
+		err := update.Decode(message)
+		if err != nil {
+			wr.log.Error().Str("type", "update").Err(err).Msg("error parsing message")
+		}
+		wr.updateJobs(update.Jobs)
+		wr.updateState("alive")
 	default:
 		// wr.log.Error().Msgf("Unknown command '%s','%s'\n", cmd, msg)
 	}
 }
 
+// cancelJobs drops queued jobs and stops running JobWorkers, the partial
+// results of running jobs are sent with the next status
+func (wr *workerRuntime) cancelJobs(ids []string, reason string) {
+	for _, id := range ids {
+		for i := range wr.JobQueue {
+			if wr.JobQueue[i].ID == id {
+				wr.JobQueue = append(wr.JobQueue[:i], wr.JobQueue[i+1:]...)
+				wr.log.Info().Str("jobID", id).Str("reason", reason).Msg("cancelled queued job")
+				break
+			}
+		}
+		for i := range wr.Workers {
+			if wr.Workers[i].Job.ID == id {
+				wr.Workers[i].Cancel(reason)
+				wr.log.Info().Str("jobID", id).Str("reason", reason).Msg("cancelled running job")
+			}
+		}
+	}
+}
+
+// updateJobs applies the updates to queued jobs before they start, and to
+// running JobWorkers on the fly
+func (wr *workerRuntime) updateJobs(jobs []proto.Job) {
+	for _, j := range jobs {
+		u := j.Settings()
+		for i := range wr.JobQueue {
+			if wr.JobQueue[i].ID == u.ID {
+				u.Apply(&wr.JobQueue[i])
+				wr.log.Info().Str("jobID", u.ID).Msg("updated queued job")
+			}
+		}
+		for i := range wr.Workers {
+			if wr.Workers[i].Job.ID == u.ID {
+				wr.Workers[i].Update(u)
+			}
+		}
+	}
+}
+
 func (wr *workerRuntime) processState() {
 	log := wr.log.With().Str("state", wr.State).Logger()
 	switch wr.State {
@@ -190,8 +397,15 @@ func (wr *workerRuntime) processState() {
 
 func (wr *workerRuntime) sendIdentify() error {
 	identify := proto.Identify{
-		ID:       wr.ID,
-		Capacity: wr.Capacity,
+		ID:             wr.ID,
+		Capacity:       wr.Limits.Jobs,
+		MaxRate:        wr.Limits.Rate,
+		MaxConcurrency: wr.Limits.Concurrency,
+		Labels:         wr.Labels,
+	}
+	if err := wr.Credentials.sign(&identify, wr.challenge); err != nil {
+		// identify without them, the server logs the rejection too
+		wr.log.Error().Err(err).Str("credential", wr.Credentials.Name).Msg("error reading the worker credential")
 	}
 
 	message, err := identify.Encode()
@@ -208,8 +422,32 @@ func (wr *workerRuntime) sendIdentify() error {
 	return nil
 }
 
+// sign answers the challenge with the credential, or sends its secret
+func (c Credentials) sign(id *proto.Identify, challenge []byte) error {
+	if c.Name == "" {
+		return nil
+	}
+	secret, err := auth.ReadSecretFile(c.SecretFile)
+	if err != nil {
+		return err
+	}
+	id.Credential = c.Name
+	if c.Token {
+		id.Token = string(secret)
+		return nil
+	}
+	id.Proof = auth.WorkerProof(secret, challenge, id.ID)
+	return nil
+}
+
 func (wr *workerRuntime) sendStatus() error {
 	status := wr.compileStatus()
+	if !wr.ping.IsZero() {
+		status.Ping = wr.ping
+		status.Received = wr.received
+		status.Replied = time.Now()
+		wr.ping = time.Time{}
+	}
 	message, err := status.Encode()
 	if err != nil {
 		return err
@@ -219,6 +457,7 @@ func (wr *workerRuntime) sendStatus() error {
 	if err != nil {
 		return err
 	}
+	wr.pruneWorkers(status.Results)
 	wr.log.Info().Str("type", "status").Msg("wrote")
 	return nil
 }
@@ -235,6 +474,7 @@ func (wr *workerRuntime) sendAccept() error {
 	if err != nil {
 		return err
 	}
+	wr.pruneWorkers(status.Results)
 	wr.log.Info().Str("type", "status").Msg("wrote")
 
 	return nil
@@ -244,17 +484,28 @@ func (wr *workerRuntime) compileStatus() proto.Status {
 	status := proto.Status{
 		JobQueue:   wr.JobQueue,
 		ActiveJobs: []proto.Job{},
-		Results:    make(map[string]map[int]int),
+		Results:    make(map[string]proto.JobResult),
 	}
 	for i := range wr.Workers {
-		status.ActiveJobs = append(status.ActiveJobs, wr.Workers[i].Job)
-		if wr.Workers[i].Done {
-			status.Results[wr.Workers[i].Job.ID] = wr.Workers[i].Results
-		}
+		job := wr.Workers[i].CurrentJob()
+		status.ActiveJobs = append(status.ActiveJobs, job)
+		status.Results[job.ID] = wr.Workers[i].Snapshot()
 	}
 	return status
 }
 
+// pruneWorkers drops the JobWorkers whose final results have been sent
+func (wr *workerRuntime) pruneWorkers(results map[string]proto.JobResult) {
+	workers := wr.Workers[:0]
+	for i := range wr.Workers {
+		if results[wr.Workers[i].Job.ID].Done {
+			continue
+		}
+		workers = append(workers, wr.Workers[i])
+	}
+	wr.Workers = workers
+}
+
 func (wr *workerRuntime) updateState(s string) {
 	wr.log.Debug().Str("state", s).Msg("state change")
 	wr.State = s